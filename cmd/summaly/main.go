@@ -1,6 +1,7 @@
 package main
 
 import (
+	"flag"
 	"log/slog"
 	"os"
 
@@ -14,7 +15,15 @@ const version = "0.0.2"
 var revision = "HEAD"
 
 func main() {
-	logger := slog.New(slog.NewJSONHandler(os.Stdout, &slog.HandlerOptions{}))
+	var configFile string
+	flag.StringVar(&configFile, "config", "", "config file (YAML or TOML). Environment variables take precedence")
+	flag.Parse()
+
+	level := new(slog.LevelVar)
+	logger := slog.New(slog.NewJSONHandler(os.Stdout, &slog.HandlerOptions{Level: level}))
 	slog.SetDefault(logger)
-	server.New().SetVersion(version).Start()
+	server.New(
+		server.WithConfigFile(configFile),
+		server.WithLogLevel(level),
+	).SetVersion(version).SetRevision(revision).Start()
 }
@@ -0,0 +1,229 @@
+package fetch
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+type BreakerOpts struct {
+	// Threshold 回連続で失敗したら開く
+	Threshold int
+	// OpenDuration の間は開いたままにし、その後1つだけ試す
+	OpenDuration time.Duration
+}
+
+// BreakerError はホストへのサーキットが開いているため送らなかったことを示す
+type BreakerError struct {
+	Host  string
+	Until time.Time
+}
+
+func (e *BreakerError) Error() string {
+	return fmt.Sprintf("circuit open: %s", e.Host)
+}
+
+const (
+	BreakerClosed   = "closed"
+	BreakerOpen     = "open"
+	BreakerHalfOpen = "half-open"
+)
+
+// BreakerState はホストごとのサーキットの状態
+type BreakerState struct {
+	Host     string     `json:"host"`
+	State    string     `json:"state"`
+	Failures int        `json:"failures"`
+	Until    *time.Time `json:"until,omitempty"` // 開いている間、次に試す時刻
+}
+
+// BreakerTransport はホストごとに連続した失敗を数え、
+// Threshold に達したらしばらくそのホストへのリクエストを送らない http.RoundTripper
+//
+// エラーと 5xx を失敗とし、呼び出し元のキャンセルとローカルの制限は数えない
+type BreakerTransport struct {
+	Transport http.RoundTripper
+	Opts      BreakerOpts
+
+	mu    sync.Mutex
+	hosts map[string]*hostBreaker // 失敗が続いているホストだけを持つ
+}
+
+type hostBreaker struct {
+	state       string
+	failures    int
+	openedAt    time.Time
+	lastFailure time.Time
+	probing     bool // half-open で試しているリクエストがある
+}
+
+// ホストがこの数を超えたら最後の失敗から OpenDuration が過ぎたものを掃除し、
+// それでも breakerMaxHosts に達していれば最後の失敗が最も古いものを消す
+const (
+	breakerSweepSize = 1024
+	breakerMaxHosts  = 4096
+)
+
+type breakerResult int
+
+const (
+	breakerSuccess breakerResult = iota
+	breakerFailure
+	breakerIgnore
+)
+
+func (t *BreakerTransport) transport() http.RoundTripper {
+	if t.Transport == nil {
+		return http.DefaultTransport
+	}
+	return t.Transport
+}
+
+func (t *BreakerTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	host := strings.ToLower(req.URL.Hostname())
+	if err := t.allow(host); err != nil {
+		return nil, err
+	}
+
+	resp, err := t.transport().RoundTrip(req)
+	t.record(host, breakerResultOf(req, resp, err))
+	return resp, err
+}
+
+// allow は host にリクエストを送ってよいかを返す
+//
+// 開いてから OpenDuration が過ぎていれば half-open にして1つだけ通す
+func (t *BreakerTransport) allow(host string) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	b, ok := t.hosts[host]
+	if !ok {
+		return nil
+	}
+	switch b.state {
+	case BreakerOpen:
+		until := b.openedAt.Add(t.Opts.OpenDuration)
+		if time.Now().Before(until) {
+			return &BreakerError{Host: host, Until: until}
+		}
+		b.state = BreakerHalfOpen
+		b.probing = true
+	case BreakerHalfOpen:
+		if b.probing {
+			return &BreakerError{Host: host}
+		}
+		b.probing = true
+	}
+	return nil
+}
+
+func (t *BreakerTransport) record(host string, result breakerResult) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.hosts == nil {
+		t.hosts = make(map[string]*hostBreaker)
+	}
+	b, ok := t.hosts[host]
+	switch result {
+	case breakerSuccess:
+		delete(t.hosts, host)
+		return
+	case breakerIgnore:
+		if ok {
+			// 結果が分からないので次のリクエストで試し直す
+			b.probing = false
+		}
+		return
+	}
+
+	now := time.Now()
+	if !ok {
+		if len(t.hosts) >= breakerSweepSize {
+			t.sweep(now)
+		}
+		b = &hostBreaker{state: BreakerClosed}
+		t.hosts[host] = b
+	}
+	b.failures++
+	b.lastFailure = now
+	if b.state == BreakerHalfOpen || b.failures >= t.Opts.Threshold {
+		b.state = BreakerOpen
+		b.openedAt = now
+		b.probing = false
+	}
+}
+
+// sweep は最後の失敗から OpenDuration が過ぎたホストを忘れる
+//
+// 開いていたものも次のリクエストで half-open になるだけなので消してよい。
+// 試しているリクエストがあるものは残す
+func (t *BreakerTransport) sweep(now time.Time) {
+	for host, b := range t.hosts {
+		if !b.probing && now.Sub(b.lastFailure) > t.Opts.OpenDuration {
+			delete(t.hosts, host)
+		}
+	}
+	for len(t.hosts) >= breakerMaxHosts {
+		var oldest string
+		for host, b := range t.hosts {
+			if oldest == "" || b.lastFailure.Before(t.hosts[oldest].lastFailure) {
+				oldest = host
+			}
+		}
+		delete(t.hosts, oldest)
+	}
+}
+
+// States は失敗が続いているホストのサーキットの状態を返す
+func (t *BreakerTransport) States() []BreakerState {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	states := make([]BreakerState, 0, len(t.hosts))
+	for host, b := range t.hosts {
+		s := BreakerState{
+			Host:     host,
+			State:    b.state,
+			Failures: b.failures,
+		}
+		if b.state == BreakerOpen {
+			until := b.openedAt.Add(t.Opts.OpenDuration)
+			s.Until = &until
+		}
+		states = append(states, s)
+	}
+	slices.SortFunc(states, func(a, b BreakerState) int {
+		return strings.Compare(a.Host, b.Host)
+	})
+	return states
+}
+
+func breakerResultOf(req *http.Request, resp *http.Response, err error) breakerResult {
+	if err != nil {
+		if rle := new(RateLimitError); errors.As(err, &rle) {
+			return breakerIgnore
+		}
+		// 呼び出し元のキャンセルはホストの失敗ではない
+		if errors.Is(req.Context().Err(), context.Canceled) {
+			return breakerIgnore
+		}
+		return breakerFailure
+	}
+	// HEAD に対応していないだけのものは Check が GET で送り直すので数えない
+	if req.Method == http.MethodHead && (resp.StatusCode == http.StatusMethodNotAllowed || resp.StatusCode == http.StatusNotImplemented) {
+		return breakerIgnore
+	}
+	// 501, 505 などはリクエストの問題でホストの不調ではない
+	switch resp.StatusCode {
+	case http.StatusInternalServerError, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return breakerFailure
+	}
+	return breakerSuccess
+}
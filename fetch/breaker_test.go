@@ -0,0 +1,126 @@
+package fetch
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestBreakerTransport(t *testing.T) {
+	var down atomic.Bool
+	var requests atomic.Int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		w.Header().Set("Content-Type", "text/html")
+		if down.Load() {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	defer ts.Close()
+
+	c := mustClient(t, ClientOpts{AllowPrivateIP: true, Breaker: &BreakerOpts{
+		Threshold:    2,
+		OpenDuration: 100 * time.Millisecond,
+	}})
+	u, _ := url.Parse(ts.URL)
+	get := func() error {
+		_, _, err := c.NewRequest(u).GetRaw()
+		return err
+	}
+	state := func() string {
+		states := c.BreakerStates()
+		if len(states) == 0 {
+			return BreakerClosed
+		}
+		return states[0].State
+	}
+
+	steps := []struct {
+		name         string
+		down         bool
+		wait         time.Duration
+		wantBreaker  bool
+		wantRequests int32
+		wantState    string
+	}{
+		{name: "first failure", down: true, wantRequests: 1, wantState: BreakerClosed},
+		{name: "opens", down: true, wantRequests: 2, wantState: BreakerOpen},
+		{name: "short circuit", down: true, wantBreaker: true, wantRequests: 2, wantState: BreakerOpen},
+		{name: "half-open probe fails", down: true, wait: 120 * time.Millisecond, wantRequests: 3, wantState: BreakerOpen},
+		{name: "reopened", down: false, wantBreaker: true, wantRequests: 3, wantState: BreakerOpen},
+		{name: "half-open probe succeeds", down: false, wait: 120 * time.Millisecond, wantRequests: 4, wantState: BreakerClosed},
+		{name: "closed", down: false, wantRequests: 5, wantState: BreakerClosed},
+	}
+	for _, s := range steps {
+		down.Store(s.down)
+		time.Sleep(s.wait)
+
+		err := get()
+		if be := new(BreakerError); errors.As(err, &be) != s.wantBreaker {
+			t.Errorf("%s: err = %v, wantBreaker %v", s.name, err, s.wantBreaker)
+		}
+		if got := requests.Load(); got != s.wantRequests {
+			t.Errorf("%s: requests = %d, want %d", s.name, got, s.wantRequests)
+		}
+		if got := state(); got != s.wantState {
+			t.Errorf("%s: state = %s, want %s", s.name, got, s.wantState)
+		}
+	}
+}
+
+func TestBreakerTransport_Sweep(t *testing.T) {
+	bt := &BreakerTransport{Opts: BreakerOpts{Threshold: 1, OpenDuration: time.Minute}}
+	for i := range breakerSweepSize {
+		bt.record(fmt.Sprintf("old%d.example", i), breakerFailure)
+	}
+	// 最後の失敗から OpenDuration が過ぎたことにする
+	for _, b := range bt.hosts {
+		b.lastFailure = b.lastFailure.Add(-2 * time.Minute)
+	}
+	bt.record("new.example", breakerFailure)
+	if got := len(bt.hosts); got != 1 {
+		t.Errorf("hosts = %d, want 1", got)
+	}
+
+	for i := range 2 * breakerMaxHosts {
+		bt.record(fmt.Sprintf("host%d.example", i), breakerFailure)
+	}
+	if got := len(bt.hosts); got > breakerMaxHosts {
+		t.Errorf("hosts = %d, want <= %d", got, breakerMaxHosts)
+	}
+	if err := bt.allow(fmt.Sprintf("host%d.example", 2*breakerMaxHosts-1)); err == nil {
+		t.Error("latest failed host should stay open")
+	}
+}
+
+func TestBreakerResultOf(t *testing.T) {
+	tests := []struct {
+		method string
+		status int
+		want   breakerResult
+	}{
+		{http.MethodGet, http.StatusOK, breakerSuccess},
+		{http.MethodGet, http.StatusNotFound, breakerSuccess},
+		{http.MethodGet, http.StatusInternalServerError, breakerFailure},
+		{http.MethodGet, http.StatusBadGateway, breakerFailure},
+		{http.MethodGet, http.StatusServiceUnavailable, breakerFailure},
+		{http.MethodGet, http.StatusGatewayTimeout, breakerFailure},
+		{http.MethodGet, http.StatusNotImplemented, breakerSuccess},
+		{http.MethodGet, http.StatusHTTPVersionNotSupported, breakerSuccess},
+		// GET で送り直すので数えない
+		{http.MethodHead, http.StatusNotImplemented, breakerIgnore},
+		{http.MethodHead, http.StatusMethodNotAllowed, breakerIgnore},
+		{http.MethodHead, http.StatusServiceUnavailable, breakerFailure},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(tt.method, "http://example.com/", nil)
+		if got := breakerResultOf(req, &http.Response{StatusCode: tt.status}, nil); got != tt.want {
+			t.Errorf("%s %d: got %v, want %v", tt.method, tt.status, got, tt.want)
+		}
+	}
+}
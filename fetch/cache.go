@@ -0,0 +1,479 @@
+package fetch
+
+import (
+	"bufio"
+	"bytes"
+	"container/list"
+	"crypto/sha256"
+	"encoding/gob"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"net/http/httputil"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/yulog/go-summaly/internal/diskcache"
+)
+
+// Cache は CacheTransport が使う保存先
+type Cache interface {
+	Get(key string) ([]byte, bool)
+	Set(key string, data []byte)
+	Delete(key string)
+}
+
+// CacheTransport は RFC 9111 に沿ってレスポンスをキャッシュする http.RoundTripper
+//
+// 複数の利用者で共有するキャッシュとして振る舞う (private は保存せず、 s-maxage を優先する)
+// 新鮮なものはそのまま返し、古くなったものは ETag, Last-Modified で再検証する
+type CacheTransport struct {
+	Transport http.RoundTripper
+	Cache     Cache
+	// MaxBodySize を超える Body は保存しない。0 のときは 10MiB
+	MaxBodySize int64
+}
+
+const (
+	// ヒューリスティックな新鮮さの上限
+	maxHeuristicFreshness = 24 * time.Hour
+	// MaxBodySize の既定値
+	defaultCacheMaxBodySize = 10 << 20 // 10MiB
+)
+
+// キャッシュしてよいステータスコード (RFC 9110 15.1)
+var cacheableStatus = []int{
+	http.StatusOK,
+	http.StatusNonAuthoritativeInfo,
+	http.StatusNoContent,
+	http.StatusMultipleChoices,
+	http.StatusMovedPermanently,
+	http.StatusPermanentRedirect,
+	http.StatusNotFound,
+	http.StatusGone,
+}
+
+type cacheEntry struct {
+	StoredAt time.Time
+	Vary     map[string]string // Vary に含まれるリクエストヘッダの値
+	Response []byte            // httputil.DumpResponse
+}
+
+func cacheKey(req *http.Request) string {
+	return req.Method + " " + req.URL.String()
+}
+
+func (t *CacheTransport) transport() http.RoundTripper {
+	if t.Transport == nil {
+		return http.DefaultTransport
+	}
+	return t.Transport
+}
+
+func (t *CacheTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	// Cookie や認証情報、 WithHeaders のヘッダーを送るものは送り手によって内容が変わるため共有しない
+	if req.Method != http.MethodGet || req.Header.Get("Range") != "" || req.Header.Get("Cookie") != "" ||
+		req.Header.Get("Authorization") != "" || hasScopedHeaders(req) {
+		return t.transport().RoundTrip(req)
+	}
+	reqCC := parseCacheControl(req.Header.Get("Cache-Control"))
+	if _, ok := reqCC["no-store"]; ok {
+		return t.transport().RoundTrip(req)
+	}
+
+	key := cacheKey(req)
+	entry, cached := t.load(key, req)
+	if !cached {
+		resp, err := t.transport().RoundTrip(req)
+		if err != nil {
+			return nil, err
+		}
+		return t.store(key, req, resp), nil
+	}
+
+	resp := entry.resp
+	if _, noCache := reqCC["no-cache"]; !noCache && entry.fresh() {
+		resp.Header.Set("Age", strconv.Itoa(int(entry.age().Seconds())))
+		return resp, nil
+	}
+
+	// 再検証
+	etag, lastModified := resp.Header.Get("ETag"), resp.Header.Get("Last-Modified")
+	if etag == "" && lastModified == "" {
+		resp.Body.Close()
+		resp, err := t.transport().RoundTrip(req)
+		if err != nil {
+			return nil, err
+		}
+		return t.store(key, req, resp), nil
+	}
+	creq := req.Clone(req.Context())
+	if etag != "" {
+		creq.Header.Set("If-None-Match", etag)
+	}
+	if lastModified != "" {
+		creq.Header.Set("If-Modified-Since", lastModified)
+	}
+	nresp, err := t.transport().RoundTrip(creq)
+	if err != nil {
+		resp.Body.Close()
+		return nil, err
+	}
+	if nresp.StatusCode != http.StatusNotModified {
+		resp.Body.Close()
+		return t.store(key, req, nresp), nil
+	}
+	nresp.Body.Close()
+
+	// 304 のヘッダで更新する (RFC 9111 4.3.4)
+	for k, v := range nresp.Header {
+		resp.Header[k] = v
+	}
+	resp.Header.Del("Age")
+	return t.store(key, req, resp), nil
+}
+
+type loadedEntry struct {
+	cacheEntry
+	resp *http.Response
+}
+
+// load は key のキャッシュを読み出す。 Vary が一致しない場合はないものとする
+func (t *CacheTransport) load(key string, req *http.Request) (*loadedEntry, bool) {
+	data, ok := t.Cache.Get(key)
+	if !ok {
+		return nil, false
+	}
+	var e cacheEntry
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&e); err != nil {
+		t.Cache.Delete(key)
+		return nil, false
+	}
+	for k, v := range e.Vary {
+		if req.Header.Get(k) != v {
+			return nil, false
+		}
+	}
+	resp, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(e.Response)), req)
+	if err != nil {
+		t.Cache.Delete(key)
+		return nil, false
+	}
+	return &loadedEntry{cacheEntry: e, resp: resp}, true
+}
+
+// store は保存できるなら resp を保存するようにして、呼び出し元に返す response を返す
+//
+// 先に読み込まず、呼び出し元が Body を最後まで読んで閉じたときに保存する。
+// 途中で閉じたものや MaxBodySize を超えたものは保存しない
+func (t *CacheTransport) store(key string, req *http.Request, resp *http.Response) *http.Response {
+	if !storable(resp) {
+		return resp
+	}
+
+	vary := map[string]string{}
+	for _, v := range resp.Header.Values("Vary") {
+		for _, name := range strings.Split(v, ",") {
+			name = strings.TrimSpace(name)
+			if name == "*" {
+				return resp
+			}
+			if name != "" {
+				vary[http.CanonicalHeaderKey(name)] = req.Header.Get(name)
+			}
+		}
+	}
+
+	maxBodySize := t.MaxBodySize
+	if maxBodySize <= 0 {
+		maxBodySize = defaultCacheMaxBodySize
+	}
+	if resp.ContentLength > maxBodySize {
+		return resp
+	}
+
+	// 共有キャッシュなので Set-Cookie は保存しない (RFC 9111 7.3)
+	// 呼び出し元にはそのまま返す
+	snapshot := *resp
+	snapshot.Header = resp.Header.Clone()
+	snapshot.Header.Del("Set-Cookie")
+	storedAt := time.Now()
+	resp.Body = &cacheBody{
+		ReadCloser: resp.Body,
+		max:        maxBodySize,
+		done: func(body []byte) {
+			snapshot.Body = io.NopCloser(bytes.NewReader(body))
+			snapshot.ContentLength = int64(len(body))
+			dump, err := httputil.DumpResponse(&snapshot, true)
+			if err != nil {
+				return
+			}
+			var buf bytes.Buffer
+			if err := gob.NewEncoder(&buf).Encode(cacheEntry{
+				StoredAt: storedAt,
+				Vary:     vary,
+				Response: dump,
+			}); err == nil {
+				t.Cache.Set(key, buf.Bytes())
+			}
+		},
+	}
+	return resp
+}
+
+// cacheBody は読んだ Body を貯め、最後まで読んで閉じたら done を呼ぶ
+type cacheBody struct {
+	io.ReadCloser
+	max  int64
+	buf  bytes.Buffer
+	over bool // max を超えたので保存しない
+	eof  bool
+	done func(body []byte)
+}
+
+func (b *cacheBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if !b.over {
+		if int64(b.buf.Len()+n) > b.max {
+			b.over = true
+			b.buf = bytes.Buffer{}
+		} else {
+			b.buf.Write(p[:n])
+		}
+	}
+	if err == io.EOF {
+		b.eof = true
+	}
+	return n, err
+}
+
+func (b *cacheBody) Close() error {
+	err := b.ReadCloser.Close()
+	if b.eof && !b.over && b.done != nil {
+		b.done(b.buf.Bytes())
+	}
+	b.done = nil
+	return err
+}
+
+// storable は resp を保存してよいかを返す
+func storable(resp *http.Response) bool {
+	if !slices.Contains(cacheableStatus, resp.StatusCode) {
+		return false
+	}
+	cc := parseCacheControl(strings.Join(resp.Header.Values("Cache-Control"), ","))
+	if _, ok := cc["no-store"]; ok {
+		return false
+	}
+	if _, ok := cc["private"]; ok {
+		return false
+	}
+	// 新鮮さか検証子のどちらかがなければ保存しても使えない
+	_, maxAge := cc["max-age"]
+	_, sMaxAge := cc["s-maxage"]
+	return maxAge || sMaxAge ||
+		resp.Header.Get("Expires") != "" ||
+		resp.Header.Get("ETag") != "" ||
+		resp.Header.Get("Last-Modified") != ""
+}
+
+// age は保存されてからの経過時間 (Age ヘッダを含む) を返す
+func (e *loadedEntry) age() time.Duration {
+	age := time.Since(e.StoredAt)
+	if v, err := strconv.Atoi(e.resp.Header.Get("Age")); err == nil && v > 0 {
+		age += time.Duration(v) * time.Second
+	}
+	return age
+}
+
+// fresh は RFC 9111 4.2 の新鮮さを返す
+func (e *loadedEntry) fresh() bool {
+	h := e.resp.Header
+	cc := parseCacheControl(strings.Join(h.Values("Cache-Control"), ","))
+	if _, ok := cc["no-cache"]; ok {
+		return false
+	}
+
+	var lifetime time.Duration
+	date, err := http.ParseTime(h.Get("Date"))
+	if err != nil {
+		date = e.StoredAt
+	}
+	if v, ok := cc["s-maxage"]; ok {
+		lifetime = parseSeconds(v)
+	} else if v, ok := cc["max-age"]; ok {
+		lifetime = parseSeconds(v)
+	} else if v := h.Get("Expires"); v != "" {
+		// 不正な Expires は期限切れとみなす
+		if expires, err := http.ParseTime(v); err == nil {
+			lifetime = expires.Sub(date)
+		}
+	} else if v := h.Get("Last-Modified"); v != "" {
+		// ヒューリスティック (RFC 9111 4.2.2)
+		if lastModified, err := http.ParseTime(v); err == nil {
+			lifetime = min(date.Sub(lastModified)/10, maxHeuristicFreshness)
+		}
+	}
+	return lifetime > e.age()
+}
+
+func parseSeconds(v string) time.Duration {
+	n, err := strconv.ParseInt(strings.Trim(v, `"`), 10, 64)
+	if err != nil || n < 0 {
+		return 0
+	}
+	return time.Duration(n) * time.Second
+}
+
+// parseCacheControl は Cache-Control のディレクティブを返す
+func parseCacheControl(v string) map[string]string {
+	cc := map[string]string{}
+	for _, d := range strings.Split(v, ",") {
+		d = strings.TrimSpace(d)
+		if d == "" {
+			continue
+		}
+		name, value, _ := strings.Cut(d, "=")
+		cc[strings.ToLower(strings.TrimSpace(name))] = strings.TrimSpace(value)
+	}
+	return cc
+}
+
+// MemoryCache は最大 MaxEntries 件、合計 MaxBytes バイトまでを保持する LRU の Cache
+//
+// それぞれ 0 のときは制限しない。 MaxBytes より大きいものは保存しない
+type MemoryCache struct {
+	MaxEntries int
+	MaxBytes   int64
+
+	mu    sync.Mutex
+	ll    *list.List
+	items map[string]*list.Element
+	size  int64
+}
+
+type memoryItem struct {
+	key  string
+	data []byte
+}
+
+func NewMemoryCache(maxEntries int, maxBytes int64) *MemoryCache {
+	return &MemoryCache{
+		MaxEntries: maxEntries,
+		MaxBytes:   maxBytes,
+		ll:         list.New(),
+		items:      make(map[string]*list.Element),
+	}
+}
+
+func (c *MemoryCache) Get(key string) ([]byte, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.items[key]; ok {
+		c.ll.MoveToFront(el)
+		return el.Value.(*memoryItem).data, true
+	}
+	return nil, false
+}
+
+func (c *MemoryCache) Set(key string, data []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.items[key]; ok {
+		c.remove(el)
+	}
+	if c.MaxBytes > 0 && int64(len(data)) > c.MaxBytes {
+		return
+	}
+	c.items[key] = c.ll.PushFront(&memoryItem{key: key, data: data})
+	c.size += int64(len(data))
+	for (c.MaxEntries > 0 && c.ll.Len() > c.MaxEntries) || (c.MaxBytes > 0 && c.size > c.MaxBytes) {
+		c.remove(c.ll.Back())
+	}
+}
+
+func (c *MemoryCache) Delete(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.items[key]; ok {
+		c.remove(el)
+	}
+}
+
+func (c *MemoryCache) remove(el *list.Element) {
+	item := el.Value.(*memoryItem)
+	c.ll.Remove(el)
+	delete(c.items, item.key)
+	c.size -= int64(len(item.data))
+}
+
+// DiskCache は Dir 以下にファイルとして保存する Cache
+//
+// Set のたびに (間隔をあけて) MaxAge より長く使われていないものを消し、
+// 合計が MaxSize バイトを超えていれば使われていないものから消す
+type DiskCache struct {
+	Dir     string
+	MaxSize int64         // 0 は無制限
+	MaxAge  time.Duration // 0 は無制限
+
+	sweeper diskcache.Sweeper
+}
+
+func (c *DiskCache) path(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	name := hex.EncodeToString(sum[:])
+	return filepath.Join(c.Dir, name[:2], name)
+}
+
+func (c *DiskCache) Get(key string) ([]byte, bool) {
+	p := c.path(key)
+	fi, err := os.Stat(p)
+	if err != nil || diskcache.Expired(fi.ModTime(), c.MaxAge) {
+		return nil, false
+	}
+	data, err := os.ReadFile(p)
+	if err != nil {
+		return nil, false
+	}
+	diskcache.Touch(p)
+	return data, true
+}
+
+// Sweep は MaxAge, MaxSize を超えたものを消す
+func (c *DiskCache) Sweep() error {
+	return diskcache.Sweep(c.Dir, c.MaxSize, c.MaxAge)
+}
+
+func (c *DiskCache) Set(key string, data []byte) {
+	p := c.path(key)
+	if err := os.MkdirAll(filepath.Dir(p), 0o755); err != nil {
+		return
+	}
+	// 書き込み途中のファイルを読まないように rename する
+	tmp, err := os.CreateTemp(filepath.Dir(p), ".tmp-*")
+	if err != nil {
+		return
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return
+	}
+	if err := tmp.Close(); err != nil {
+		return
+	}
+	if err := os.Rename(tmp.Name(), p); err != nil {
+		return
+	}
+	dir, maxSize, maxAge := c.Dir, c.MaxSize, c.MaxAge
+	c.sweeper.Trigger(func() { diskcache.Sweep(dir, maxSize, maxAge) })
+}
+
+func (c *DiskCache) Delete(key string) {
+	os.Remove(c.path(key))
+}
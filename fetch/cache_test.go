@@ -0,0 +1,315 @@
+package fetch
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestCacheTransport(t *testing.T) {
+	tests := []struct {
+		name string
+		// header はレスポンスヘッダを設定する
+		header func(h http.Header)
+		// 2回目のリクエストの Accept-Language
+		lang     [2]string
+		wantHits int32
+		want304  int32
+	}{
+		{
+			name: "fresh max-age",
+			header: func(h http.Header) {
+				h.Set("Cache-Control", "max-age=60")
+			},
+			wantHits: 1,
+		},
+		{
+			name: "s-maxage overrides max-age",
+			header: func(h http.Header) {
+				h.Set("Cache-Control", "max-age=60, s-maxage=0")
+			},
+			wantHits: 2,
+		},
+		{
+			name: "fresh expires",
+			header: func(h http.Header) {
+				h.Set("Expires", time.Now().Add(time.Hour).UTC().Format(http.TimeFormat))
+			},
+			wantHits: 1,
+		},
+		{
+			name: "no-store",
+			header: func(h http.Header) {
+				h.Set("Cache-Control", "no-store, max-age=60")
+			},
+			wantHits: 2,
+		},
+		{
+			name: "private",
+			header: func(h http.Header) {
+				h.Set("Cache-Control", "private, max-age=60")
+			},
+			wantHits: 2,
+		},
+		{
+			name: "revalidate etag",
+			header: func(h http.Header) {
+				h.Set("Cache-Control", "no-cache")
+				h.Set("ETag", `"v1"`)
+			},
+			wantHits: 2,
+			want304:  1,
+		},
+		{
+			name: "revalidate last-modified",
+			header: func(h http.Header) {
+				h.Set("Expires", "0")
+				h.Set("Last-Modified", time.Now().Add(-time.Hour).UTC().Format(http.TimeFormat))
+			},
+			wantHits: 2,
+			want304:  1,
+		},
+		{
+			name: "heuristic last-modified",
+			header: func(h http.Header) {
+				h.Set("Last-Modified", time.Now().Add(-24*time.Hour).UTC().Format(http.TimeFormat))
+			},
+			wantHits: 1,
+		},
+		{
+			name: "vary match",
+			header: func(h http.Header) {
+				h.Set("Cache-Control", "max-age=60")
+				h.Set("Vary", "Accept-Language")
+			},
+			lang:     [2]string{"ja", "ja"},
+			wantHits: 1,
+		},
+		{
+			name: "vary mismatch",
+			header: func(h http.Header) {
+				h.Set("Cache-Control", "max-age=60")
+				h.Set("Vary", "Accept-Language")
+			},
+			lang:     [2]string{"ja", "en"},
+			wantHits: 2,
+		},
+		{
+			name: "vary star",
+			header: func(h http.Header) {
+				h.Set("Cache-Control", "max-age=60")
+				h.Set("Vary", "*")
+			},
+			wantHits: 2,
+		},
+	}
+
+	backends := map[string]func(t *testing.T) Cache{
+		"memory": func(t *testing.T) Cache { return NewMemoryCache(10, 0) },
+		"disk":   func(t *testing.T) Cache { return &DiskCache{Dir: t.TempDir()} },
+	}
+
+	for backend, newCache := range backends {
+		for _, tt := range tests {
+			t.Run(backend+"/"+tt.name, func(t *testing.T) {
+				var hits, notModified atomic.Int32
+				ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					hits.Add(1)
+					tt.header(w.Header())
+					if etag := w.Header().Get("ETag"); etag != "" && r.Header.Get("If-None-Match") == etag {
+						notModified.Add(1)
+						w.WriteHeader(http.StatusNotModified)
+						return
+					}
+					if lm := w.Header().Get("Last-Modified"); lm != "" && r.Header.Get("If-Modified-Since") == lm {
+						notModified.Add(1)
+						w.WriteHeader(http.StatusNotModified)
+						return
+					}
+					w.Header().Set("Content-Type", "text/html")
+					w.Write([]byte("<title>cached</title>"))
+				}))
+				defer ts.Close()
+
+				c := mustClient(t, ClientOpts{AllowPrivateIP: true, Cache: newCache(t)})
+				u, _ := url.Parse(ts.URL)
+				for i := range 2 {
+					body, err := c.NewRequest(u, WithAcceptLanguage(tt.lang[i])).Do()
+					if err != nil {
+						t.Fatal(err)
+					}
+					if string(body) != "<title>cached</title>" {
+						t.Errorf("body = %q", body)
+					}
+				}
+				if got := hits.Load(); got != tt.wantHits {
+					t.Errorf("hits = %d, want %d", got, tt.wantHits)
+				}
+				if got := notModified.Load(); got != tt.want304 {
+					t.Errorf("304 = %d, want %d", got, tt.want304)
+				}
+			})
+		}
+	}
+}
+
+func TestMemoryCache_Evict(t *testing.T) {
+	c := NewMemoryCache(2, 0)
+	c.Set("a", []byte("a"))
+	c.Set("b", []byte("b"))
+	c.Get("a")
+	c.Set("c", []byte("c"))
+
+	if _, ok := c.Get("b"); ok {
+		t.Error("least recently used entry was not evicted")
+	}
+	for _, k := range []string{"a", "c"} {
+		if _, ok := c.Get(k); !ok {
+			t.Errorf("%s was evicted", k)
+		}
+	}
+}
+
+func TestMemoryCache_MaxBytes(t *testing.T) {
+	c := NewMemoryCache(0, 4)
+	c.Set("a", []byte("aa"))
+	c.Set("b", []byte("bb"))
+	c.Get("a")
+	c.Set("c", []byte("c"))
+
+	if _, ok := c.Get("b"); ok {
+		t.Error("least recently used entry was not evicted")
+	}
+	for _, k := range []string{"a", "c"} {
+		if _, ok := c.Get(k); !ok {
+			t.Errorf("%s was evicted", k)
+		}
+	}
+
+	c.Set("a", []byte("too large"))
+	if _, ok := c.Get("a"); ok {
+		t.Error("entry larger than MaxBytes was stored")
+	}
+	if c.size != 1 {
+		t.Errorf("size = %d, want 1", c.size)
+	}
+}
+
+func TestDiskCache_MaxAge(t *testing.T) {
+	c := &DiskCache{Dir: t.TempDir(), MaxAge: time.Hour}
+	c.Set("a", []byte("a"))
+	if _, ok := c.Get("a"); !ok {
+		t.Fatal("a was not stored")
+	}
+	old := time.Now().Add(-2 * time.Hour)
+	os.Chtimes(c.path("a"), old, old)
+	if _, ok := c.Get("a"); ok {
+		t.Error("expired entry was returned")
+	}
+}
+
+func TestCacheTransport_SetCookie(t *testing.T) {
+	var hits atomic.Int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Header().Set("Set-Cookie", "session=secret")
+		w.Write([]byte("ok"))
+	}))
+	defer ts.Close()
+
+	client := &http.Client{Transport: &CacheTransport{Cache: NewMemoryCache(10, 0)}}
+	for i, want := range []string{"session=secret", ""} {
+		resp, err := client.Get(ts.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if got := resp.Header.Get("Set-Cookie"); got != want {
+			t.Errorf("request %d: Set-Cookie = %q, want %q", i, got, want)
+		}
+	}
+	if got := hits.Load(); got != 1 {
+		t.Errorf("hits = %d, want 1", got)
+	}
+}
+
+func TestCacheTransport_Store(t *testing.T) {
+	var hits atomic.Int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Write([]byte("0123456789"))
+	}))
+	defer ts.Close()
+
+	tests := []struct {
+		name     string
+		header   map[string]string
+		read     int // -1 は最後まで
+		wantHits int32
+	}{
+		{name: "read to EOF", read: -1, wantHits: 1},
+		{name: "closed early", read: 4, wantHits: 2},
+		{name: "authorization", header: map[string]string{"Authorization": "Bearer secret"}, read: -1, wantHits: 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hits.Store(0)
+			client := &http.Client{Transport: &CacheTransport{Cache: NewMemoryCache(10, 0)}}
+			for range 2 {
+				req, _ := http.NewRequest(http.MethodGet, ts.URL, nil)
+				for k, v := range tt.header {
+					req.Header.Set(k, v)
+				}
+				resp, err := client.Do(req)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if tt.read < 0 {
+					io.ReadAll(resp.Body)
+				} else {
+					io.ReadFull(resp.Body, make([]byte, tt.read))
+				}
+				resp.Body.Close()
+			}
+			if got := hits.Load(); got != tt.wantHits {
+				t.Errorf("hits = %d, want %d", got, tt.wantHits)
+			}
+		})
+	}
+}
+
+func TestCacheTransport_ScopedHeaders(t *testing.T) {
+	var hits atomic.Int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Header().Set("Content-Type", "text/html")
+		w.Write([]byte("<title>" + r.Header.Get("X-Token") + "</title>"))
+	}))
+	defer ts.Close()
+
+	c := mustClient(t, ClientOpts{AllowPrivateIP: true, Cache: NewMemoryCache(10, 0)})
+	u, _ := url.Parse(ts.URL)
+	// WithHeaders のヘッダーを送るレスポンスは他のリクエストと共有しない
+	if _, err := c.NewRequest(u, WithHeaders(map[string]string{"X-Token": "secret"})).Do(); err != nil {
+		t.Fatal(err)
+	}
+	body, err := c.NewRequest(u).Do()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(body) != "<title></title>" {
+		t.Errorf("body = %q", body)
+	}
+	if got := hits.Load(); got != 2 {
+		t.Errorf("hits = %d, want 2", got)
+	}
+}
@@ -0,0 +1,107 @@
+package fetch
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"golang.org/x/net/publicsuffix"
+)
+
+// DefaultConsentHosts は既知の同意画面のホスト
+var DefaultConsentHosts = []string{
+	"consent.youtube.com",
+	"consent.google.com",
+	"*.consent.google.com",
+	"consent.yahoo.com",
+	"guce.yahoo.com",
+	"guce.aol.com",
+}
+
+// ConsentOpts は同意画面へのリダイレクトへの対応
+type ConsentOpts struct {
+	// Cookies はホストごとに同意画面を避けるために送る Cookie。 "*.example.com" でサブドメインにも適用する
+	Cookies map[string][]*http.Cookie
+	// Hosts は同意画面のホスト。 nil なら DefaultConsentHosts
+	Hosts []string
+}
+
+// ConsentError は Cookie を送っても同意画面にリダイレクトされたことを示す
+type ConsentError struct {
+	URL string
+}
+
+func (e *ConsentError) Error() string {
+	return fmt.Sprintf("redirected to consent page: %s", e.URL)
+}
+
+// consentPolicy は同意画面へのリダイレクトを見つけ、 Cookie を補って送り直せるようにする
+type consentPolicy struct {
+	cookies map[string][]*http.Cookie
+	hosts   map[string]bool
+}
+
+func newConsentPolicy(opts ConsentOpts) *consentPolicy {
+	hosts := opts.Hosts
+	if hosts == nil {
+		hosts = DefaultConsentHosts
+	}
+	p := &consentPolicy{
+		cookies: make(map[string][]*http.Cookie, len(opts.Cookies)),
+		hosts:   make(map[string]bool, len(hosts)),
+	}
+	for host, cookies := range opts.Cookies {
+		p.cookies[strings.ToLower(host)] = cookies
+	}
+	for _, host := range hosts {
+		p.hosts[strings.ToLower(host)] = true
+	}
+	return p
+}
+
+// seeds は host に送る Cookie を返す
+func (p *consentPolicy) seeds(host string) []*http.Cookie {
+	cookies, _ := matchHost(p.cookies, strings.ToLower(host))
+	return cookies
+}
+
+// checkRedirect は http.Client.CheckRedirect として、
+// Cookie の指定があるホストから同意画面へのリダイレクトを止める
+//
+// 指定がないホストは今まで通り同意画面までたどる
+func (p *consentPolicy) checkRedirect(req *http.Request, via []*http.Request) error {
+	// http.Client の既定と同じ
+	if len(via) >= 10 {
+		return errors.New("stopped after 10 redirects")
+	}
+	if _, ok := matchHost(p.hosts, strings.ToLower(req.URL.Hostname())); !ok {
+		return nil
+	}
+	if len(p.seeds(via[0].URL.Hostname())) == 0 {
+		return nil
+	}
+	return &ConsentError{URL: via[0].URL.String()}
+}
+
+// seed は u に送る Cookie を jar に入れる
+//
+// 同じサイトのサブドメインへのリダイレクトでも送られるように Domain を付ける
+func (p *consentPolicy) seed(jar http.CookieJar, u *url.URL) {
+	// IP やサフィックスのないホストでは Domain を付けられない
+	var domain string
+	if net.ParseIP(u.Hostname()) == nil {
+		domain, _ = publicsuffix.EffectiveTLDPlusOne(u.Hostname())
+	}
+	seeds := p.seeds(u.Hostname())
+	cookies := make([]*http.Cookie, 0, len(seeds))
+	for _, c := range seeds {
+		c := *c
+		c.Domain = domain
+		c.Path = "/"
+		cookies = append(cookies, &c)
+	}
+	jar.SetCookies(u, cookies)
+}
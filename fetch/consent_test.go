@@ -0,0 +1,77 @@
+package fetch
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func TestConsent(t *testing.T) {
+	var consentURL string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		c, err := r.Cookie("SOCS")
+		consented := err == nil && c.Value == "CAI"
+		switch r.URL.Path {
+		case "/consent":
+			w.Write([]byte("consent"))
+		case "/article":
+			if !consented {
+				http.Redirect(w, r, consentURL, http.StatusSeeOther)
+				return
+			}
+			// 同意済みでも別のページにリダイレクトする
+			http.Redirect(w, r, "/final", http.StatusFound)
+		case "/final":
+			if !consented {
+				http.Redirect(w, r, consentURL, http.StatusSeeOther)
+				return
+			}
+			w.Write([]byte("article"))
+		default:
+			http.Redirect(w, r, consentURL, http.StatusSeeOther)
+		}
+	}))
+	defer ts.Close()
+	// 同じサーバーを別のホスト名で同意画面とする
+	u, _ := url.Parse(ts.URL)
+	consentURL = "http://localhost:" + u.Port() + "/consent"
+
+	tests := []struct {
+		name    string
+		path    string
+		session bool
+		seeds   string // Cookie を指定するホスト
+		want    string
+		wantErr bool
+	}{
+		{name: "cookie jar", path: "/article", session: true, seeds: "127.0.0.1", want: "article"},
+		{name: "without cookie jar", path: "/article", seeds: "127.0.0.1", want: "article"},
+		{name: "still consent", path: "/always", session: true, seeds: "127.0.0.1", wantErr: true},
+		{name: "no cookies for host", path: "/article", session: true, seeds: "example.com", want: "consent"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := mustClient(t, ClientOpts{AllowPrivateIP: true, Consent: &ConsentOpts{
+				Cookies: map[string][]*http.Cookie{tt.seeds: {{Name: "SOCS", Value: "CAI"}}},
+				Hosts:   []string{"localhost"},
+			}})
+			if tt.session {
+				c = c.Session()
+			}
+
+			u, _ := url.Parse(ts.URL + tt.path)
+			got, err := c.NewRequest(u).Do()
+			if ce := new(ConsentError); errors.As(err, &ce) != tt.wantErr {
+				t.Fatalf("err = %v, wantErr %v", err, tt.wantErr)
+			} else if err != nil && !tt.wantErr {
+				t.Fatal(err)
+			}
+			if string(got) != tt.want {
+				t.Errorf("body = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,286 @@
+package fetch
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"sync"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// DNSOpts は名前解決の方法
+type DNSOpts struct {
+	// Server は DNS サーバーのアドレス (1.1.1.1:53 など)。空ならシステムの設定を使う
+	Server string
+	// DoH は DNS over HTTPS のエンドポイント (https://cloudflare-dns.com/dns-query など)。 Server より優先する
+	//
+	// エンドポイントへの接続は SSRF の確認をしない
+	DoH string
+	// CacheTTL を上限に名前解決の結果をキャッシュする。
+	// 0 は上限なしでレコードの TTL だけに従い、負の値はキャッシュしない
+	//
+	// レコードの TTL は DoH でしかわからないため、 DoH 以外では 0 でもキャッシュしない
+	CacheTTL time.Duration
+}
+
+// dnsResolver は DNSOpts に従って名前解決し、結果をキャッシュする
+type dnsResolver struct {
+	opts     DNSOpts
+	resolver *net.Resolver
+	doh      *http.Client
+
+	mu    sync.Mutex
+	cache map[string]dnsEntry
+}
+
+type dnsEntry struct {
+	addrs   []netip.Addr
+	expires time.Time
+}
+
+const (
+	// キャッシュがこの数を超えたら期限切れのものを掃除する
+	dnsCacheSweepSize = 1024
+	dnsTimeout        = 5 * time.Second
+	// RFC 8484 4.2.1
+	dnsMessageType = "application/dns-message"
+)
+
+func newDNSResolver(opts *DNSOpts) *dnsResolver {
+	r := &dnsResolver{
+		resolver: net.DefaultResolver,
+		cache:    make(map[string]dnsEntry),
+	}
+	if opts == nil {
+		return r
+	}
+	r.opts = *opts
+
+	switch {
+	case opts.DoH != "":
+		r.doh = &http.Client{Timeout: dnsTimeout}
+	case opts.Server != "":
+		r.resolver = &net.Resolver{
+			PreferGo: true,
+			Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+				d := net.Dialer{Timeout: dnsTimeout}
+				return d.DialContext(ctx, network, opts.Server)
+			},
+		}
+	}
+	return r
+}
+
+// lookup は host の IP を返す
+func (r *dnsResolver) lookup(ctx context.Context, host string) ([]netip.Addr, error) {
+	now := time.Now()
+	if r.opts.CacheTTL >= 0 {
+		r.mu.Lock()
+		e, ok := r.cache[host]
+		r.mu.Unlock()
+		if ok && now.Before(e.expires) {
+			return e.addrs, nil
+		}
+	}
+
+	var addrs []netip.Addr
+	var ttl time.Duration
+	var err error
+	if r.doh != nil {
+		addrs, ttl, err = r.lookupDoH(ctx, host)
+	} else {
+		addrs, err = r.resolver.LookupNetIP(ctx, "ip", host)
+		ttl = r.opts.CacheTTL
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(addrs) == 0 {
+		return nil, fmt.Errorf("no addresses: %s", host)
+	}
+	for i, a := range addrs {
+		addrs[i] = a.Unmap()
+	}
+
+	if r.opts.CacheTTL > 0 {
+		ttl = min(ttl, r.opts.CacheTTL)
+	}
+	if ttl > 0 && r.opts.CacheTTL >= 0 {
+		r.mu.Lock()
+		if len(r.cache) >= dnsCacheSweepSize {
+			for k, v := range r.cache {
+				if now.After(v.expires) {
+					delete(r.cache, k)
+				}
+			}
+		}
+		r.cache[host] = dnsEntry{addrs: addrs, expires: now.Add(ttl)}
+		r.mu.Unlock()
+	}
+	return addrs, nil
+}
+
+// lookupDoH は A と AAAA を DoH で問い合わせ、 IP と最小の TTL を返す
+//
+// https://www.rfc-editor.org/rfc/rfc8484.html
+func (r *dnsResolver) lookupDoH(ctx context.Context, host string) ([]netip.Addr, time.Duration, error) {
+	type result struct {
+		addrs []netip.Addr
+		ttl   time.Duration
+		err   error
+	}
+	types := []dnsmessage.Type{dnsmessage.TypeA, dnsmessage.TypeAAAA}
+	results := make([]result, len(types))
+
+	var wg sync.WaitGroup
+	for i, t := range types {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			addrs, ttl, err := r.queryDoH(ctx, host, t)
+			results[i] = result{addrs, ttl, err}
+		}()
+	}
+	wg.Wait()
+
+	var addrs []netip.Addr
+	var ttl time.Duration
+	var firstErr error
+	for _, res := range results {
+		if res.err != nil {
+			if firstErr == nil {
+				firstErr = res.err
+			}
+			continue
+		}
+		if len(res.addrs) > 0 {
+			if len(addrs) == 0 || res.ttl < ttl {
+				ttl = res.ttl
+			}
+			addrs = append(addrs, res.addrs...)
+		}
+	}
+	if len(addrs) == 0 && firstErr != nil {
+		return nil, 0, firstErr
+	}
+	return addrs, ttl, nil
+}
+
+func (r *dnsResolver) queryDoH(ctx context.Context, host string, t dnsmessage.Type) ([]netip.Addr, time.Duration, error) {
+	name, err := dnsmessage.NewName(dnsName(host))
+	if err != nil {
+		return nil, 0, err
+	}
+	// RFC 8484 4.1 キャッシュしやすいように ID は 0 にする
+	q := dnsmessage.Message{
+		Header:    dnsmessage.Header{RecursionDesired: true},
+		Questions: []dnsmessage.Question{{Name: name, Type: t, Class: dnsmessage.ClassINET}},
+	}
+	body, err := q.Pack()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, r.opts.DoH, bytes.NewReader(body))
+	if err != nil {
+		return nil, 0, err
+	}
+	req.Header.Set("Content-Type", dnsMessageType)
+	req.Header.Set("Accept", dnsMessageType)
+	resp, err := r.doh.Do(req)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, 0, fmt.Errorf("doh: unexpected status: %s", resp.Status)
+	}
+	b, err := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+	if err != nil {
+		return nil, 0, err
+	}
+
+	var m dnsmessage.Message
+	if err := m.Unpack(b); err != nil {
+		return nil, 0, err
+	}
+	if m.RCode != dnsmessage.RCodeSuccess {
+		return nil, 0, fmt.Errorf("doh: %s: %s", host, m.RCode)
+	}
+
+	var addrs []netip.Addr
+	var ttl time.Duration
+	for _, a := range m.Answers {
+		var addr netip.Addr
+		switch b := a.Body.(type) {
+		case *dnsmessage.AResource:
+			addr = netip.AddrFrom4(b.A)
+		case *dnsmessage.AAAAResource:
+			addr = netip.AddrFrom16(b.AAAA)
+		default:
+			// CNAME などは解決済みの A, AAAA が続く
+			continue
+		}
+		addrs = append(addrs, addr)
+		d := time.Duration(a.Header.TTL) * time.Second
+		if len(addrs) == 1 || d < ttl {
+			ttl = d
+		}
+	}
+	return addrs, ttl, nil
+}
+
+// dnsName は host を完全修飾名にする
+func dnsName(host string) string {
+	if len(host) > 0 && host[len(host)-1] == '.' {
+		return host
+	}
+	return host + "."
+}
+
+type pinsKey struct{}
+
+// pins は1回の要約の中でホストごとに確認済みの IP を覚えておく
+type pins struct {
+	mu sync.Mutex
+	m  map[string]netip.Addr
+}
+
+func withPins(ctx context.Context, p *pins) context.Context {
+	return context.WithValue(ctx, pinsKey{}, p)
+}
+
+func pinsFrom(ctx context.Context) *pins {
+	p, _ := ctx.Value(pinsKey{}).(*pins)
+	return p
+}
+
+func (p *pins) get(host string) (netip.Addr, bool) {
+	if p == nil {
+		return netip.Addr{}, false
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	addr, ok := p.m[host]
+	return addr, ok
+}
+
+func (p *pins) set(host string, addr netip.Addr) {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.m == nil {
+		p.m = make(map[string]netip.Addr)
+	}
+	if _, ok := p.m[host]; !ok {
+		p.m[host] = addr
+	}
+}
@@ -0,0 +1,123 @@
+package fetch
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"net/url"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// newDoHServer は A の問い合わせに answer(n) を返す DoH のスタンドイン
+func newDoHServer(t *testing.T, ttl uint32, answer func(n int32) [4]byte) (*httptest.Server, *atomic.Int32) {
+	t.Helper()
+	var queries atomic.Int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		var q dnsmessage.Message
+		if err := q.Unpack(b); err != nil || len(q.Questions) != 1 {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		m := dnsmessage.Message{
+			Header:    dnsmessage.Header{Response: true, RecursionAvailable: true},
+			Questions: q.Questions,
+		}
+		if q.Questions[0].Type == dnsmessage.TypeA {
+			m.Answers = []dnsmessage.Resource{{
+				Header: dnsmessage.ResourceHeader{Name: q.Questions[0].Name, Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET, TTL: ttl},
+				Body:   &dnsmessage.AResource{A: answer(queries.Add(1))},
+			}}
+		}
+		res, _ := m.Pack()
+		w.Header().Set("Content-Type", dnsMessageType)
+		w.Write(res)
+	}))
+	return ts, &queries
+}
+
+func TestDNSResolver_DoH(t *testing.T) {
+	tests := []struct {
+		name        string
+		ttl         uint32
+		cacheTTL    time.Duration
+		wantQueries int32
+	}{
+		{name: "cached", ttl: 300, cacheTTL: time.Minute, wantQueries: 1},
+		{name: "record ttl shorter", ttl: 0, cacheTTL: time.Minute, wantQueries: 2},
+		{name: "record ttl only", ttl: 300, cacheTTL: 0, wantQueries: 1},
+		{name: "record ttl zero", ttl: 0, cacheTTL: 0, wantQueries: 2},
+		{name: "no cache", ttl: 300, cacheTTL: -1, wantQueries: 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ts, queries := newDoHServer(t, tt.ttl, func(int32) [4]byte { return [4]byte{93, 184, 215, 14} })
+			defer ts.Close()
+
+			r := newDNSResolver(&DNSOpts{DoH: ts.URL, CacheTTL: tt.cacheTTL})
+			for range 2 {
+				addrs, err := r.lookup(context.Background(), "example.com")
+				if err != nil {
+					t.Fatal(err)
+				}
+				if want := netip.MustParseAddr("93.184.215.14"); len(addrs) != 1 || addrs[0] != want {
+					t.Errorf("lookup() = %v, want [%s]", addrs, want)
+				}
+			}
+			if got := queries.Load(); got != tt.wantQueries {
+				t.Errorf("A queries = %d, want %d", got, tt.wantQueries)
+			}
+		})
+	}
+}
+
+func TestClient_Pinned(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// 毎回接続し直させる
+		w.Header().Set("Connection", "close")
+		w.Header().Set("Content-Type", "text/html")
+	}))
+	defer ts.Close()
+	port := ts.URL[len("http://127.0.0.1:"):]
+
+	tests := []struct {
+		name    string
+		pinned  bool
+		wantErr bool
+	}{
+		// 2回目以降の問い合わせは待ち受けていない 127.0.0.2 を返す
+		{name: "pinned", pinned: true, wantErr: false},
+		{name: "not pinned", pinned: false, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			doh, _ := newDoHServer(t, 0, func(n int32) [4]byte {
+				if n == 1 {
+					return [4]byte{127, 0, 0, 1}
+				}
+				return [4]byte{127, 0, 0, 2}
+			})
+			defer doh.Close()
+
+			c := mustClient(t, ClientOpts{AllowPrivateIP: true, DNS: &DNSOpts{DoH: doh.URL}})
+			if tt.pinned {
+				c = c.Pinned()
+			}
+			u, _ := url.Parse("http://rebind.test:" + port + "/")
+
+			if _, err := c.NewRequest(u).Do(); err != nil {
+				t.Fatal(err)
+			}
+			_, err := c.NewRequest(u).Do()
+			if (err != nil) != tt.wantErr {
+				t.Errorf("err = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
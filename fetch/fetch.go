@@ -2,22 +2,31 @@ package fetch
 
 import (
 	"bufio"
+	"context"
+	"errors"
 	"fmt"
 	"io"
+	"log/slog"
+	"maps"
 	"mime"
 	"net"
 	"net/http"
-	"net/netip"
+	"net/http/cookiejar"
 	"net/url"
 	"slices"
+	"strings"
 	"time"
 
 	"golang.org/x/net/html/charset"
 
-	"code.dny.dev/ssrf"
 	"github.com/goccy/go-json"
 	"github.com/mattn/go-encoding"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
 	"golang.org/x/net/html"
+	"golang.org/x/net/publicsuffix"
 )
 
 var defaultAllowType = []string{"text/html", "application/xhtml+xml"}
@@ -25,11 +34,19 @@ var defaultAllowType = []string{"text/html", "application/xhtml+xml"}
 type Request struct {
 	url *url.URL
 
+	method         string
 	allowType      []string
 	limit          int64
+	prefixLimit    int64
+	headThreshold  int64
+	headSufficient func(*html.Node) bool
 	userAgent      string
 	accept         string
 	acceptLanguage string
+	headers        map[string]string
+	headerHosts    func(host string) bool
+	cookies        map[string]string
+	byteRange      string // Range ヘッダー
 
 	client *Client
 }
@@ -38,86 +55,215 @@ type Option func(*Request)
 
 type Client struct {
 	HTTPClient *http.Client
+
+	retry     *RetryTransport
+	breaker   *BreakerTransport
+	consent   *consentPolicy
+	cookieJar bool  // Session で cookie jar を持つ
+	pins      *pins // nil でなければ同じホストには同じ IP で接続する
+	logger    *slog.Logger
+	ctx       context.Context
 }
 
 type ClientOpts struct {
 	AllowPrivateIP bool
 	Timeout        time.Duration
+
+	// SSRF は接続先の制限を追加・緩和する
+	SSRF SSRFPolicy
+	// DNS を指定すると名前解決の方法を変え、結果をキャッシュする
+	DNS *DNSOpts
+
+	// Proxy を指定するとホストごとにプロキシを経由する
+	Proxy *ProxyOpts
+
+	// Cache を指定すると RFC 9111 に沿ってレスポンスをキャッシュする
+	Cache Cache
+	// CacheMaxBodySize を超える Body はキャッシュしない
+	CacheMaxBodySize int64
+	// RateLimit を指定するとホストごとにリクエストを制限する
+	RateLimit *RateLimitOpts
+	// Retry を指定すると一時的な失敗を再試行する
+	Retry *RetryOpts
+	// Breaker を指定すると失敗が続くホストへのリクエストをしばらく送らない
+	Breaker *BreakerOpts
+	// Robots を指定すると robots.txt で拒否された URL を取得しない
+	Robots *RobotsOpts
+
+	// CookieJar を指定すると Session ごとに cookie jar を持ち、サイトが設定した Cookie を送り返す
+	CookieJar bool
+	// Consent を指定すると同意画面にリダイレクトされたときに Cookie を補って送り直す
+	//
+	// CookieJar を指定しなくても Session ごとに cookie jar を持つ
+	Consent *ConsentOpts
 }
 
 // NewClient は Client を作成する
 //
-// プライベートIPを許可する場合は http.DefaultClient を返し、
-// 許可しない場合は独自の Client を返す
-func NewClient(c ClientOpts) *Client {
-	if c.AllowPrivateIP {
-		return &Client{HTTPClient: http.DefaultClient}
+// http.DefaultTransport を元にし、 SSRF を防ぐために接続先を確認する
+// プライベートIPを許可する場合も SSRF.DenyHosts は確認する
+// RateLimit, Retry, Breaker, Cache, Robots があれば Transport をその順に包む
+// Proxy の指定が正しくなければエラーを返す
+func NewClient(c ClientOpts) (*Client, error) {
+	client, err := newClient(c)
+	if err != nil {
+		return nil, err
 	}
+
+	hc := client.HTTPClient
+
+	if c.RateLimit != nil {
+		hc.Transport = &RateLimitTransport{
+			Transport: hc.Transport,
+			Opts:      *c.RateLimit,
+		}
+	}
+	if c.Retry != nil {
+		// 再試行も RateLimit を通す
+		client.retry = &RetryTransport{
+			Transport: hc.Transport,
+			Opts:      *c.Retry,
+			Timeout:   c.Timeout,
+		}
+		hc.Transport = client.retry
+	}
+	if c.Breaker != nil {
+		// 再試行を含めて1回の失敗と数える
+		client.breaker = &BreakerTransport{
+			Transport: hc.Transport,
+			Opts:      *c.Breaker,
+		}
+		hc.Transport = client.breaker
+	}
+	if c.Cache != nil {
+		// キャッシュから返すものは制限しない
+		hc.Transport = &CacheTransport{
+			Transport:   hc.Transport,
+			Cache:       c.Cache,
+			MaxBodySize: c.CacheMaxBodySize,
+		}
+	}
+	if c.Robots != nil {
+		// robots.txt も Cache, RateLimit を通して取得する
+		hc.Transport = &RobotsTransport{
+			Transport: hc.Transport,
+			Opts:      *c.Robots,
+		}
+	}
+	var next func(*http.Request, []*http.Request) error
+	if c.Consent != nil {
+		client.consent = newConsentPolicy(*c.Consent)
+		next = client.consent.checkRedirect
+	}
+	hc.CheckRedirect = checkRedirect(next)
+	client.cookieJar = c.CookieJar || c.Consent != nil
+	return client, nil
+}
+
+// Pinned は c と同じ設定で、ホストごとに最初に接続した IP を使い続ける *Client を返す
+//
+// 1回の要約の中で DNS の結果が変わって別の IP に接続されるのを防ぐ
+func (c *Client) Pinned() *Client {
+	pinned := *c
+	pinned.pins = &pins{}
+	return &pinned
+}
+
+// Session は1回の要約に使う *Client を返す
+//
+// Pinned に加えて、 CookieJar か Consent があれば新しい cookie jar を持つ
+func (c *Client) Session() *Client {
+	s := c.Pinned()
+	if c.cookieJar {
+		hc := *c.HTTPClient
+		hc.Jar, _ = cookiejar.New(&cookiejar.Options{PublicSuffixList: publicsuffix.List})
+		s.HTTPClient = &hc
+	}
+	return s
+}
+
+// WithLogger は c と同じ設定で、 Transport でのログも含めて logger に出力する *Client を返す
+func (c *Client) WithLogger(logger *slog.Logger) *Client {
+	l := *c
+	l.logger = logger
+	return &l
+}
+
+// Logger は c のログの出力先を返す。指定がなければ slog.Default
+func (c *Client) Logger() *slog.Logger {
+	if c.logger == nil {
+		return slog.Default()
+	}
+	return c.logger
+}
+
+// WithContext は c と同じ設定で、 ctx のキャンセルと trace を引き継いでリクエストを送る *Client を返す
+func (c *Client) WithContext(ctx context.Context) *Client {
+	l := *c
+	l.ctx = ctx
+	return &l
+}
+
+// Context はリクエストに使う context.Context を返す。指定がなければ context.Background
+func (c *Client) Context() context.Context {
+	if c.ctx == nil {
+		return context.Background()
+	}
+	return c.ctx
+}
+
+// RetryStats は再試行の累計を返す
+func (c *Client) RetryStats() RetryStats {
+	if c.retry == nil {
+		return RetryStats{}
+	}
+	return c.retry.Stats()
+}
+
+// BreakerStates は失敗が続いているホストのサーキットの状態を返す
+func (c *Client) BreakerStates() []BreakerState {
+	if c.breaker == nil {
+		return nil
+	}
+	return c.breaker.States()
+}
+
+func newClient(c ClientOpts) (*Client, error) {
 	// https://budougumi0617.github.io/2021/09/13/how_to_copy_default_transport/
 	t, ok := http.DefaultTransport.(*http.Transport)
 	if !ok {
-		return nil
+		return nil, fmt.Errorf("http.DefaultTransport is not *http.Transport")
 	}
 	t = t.Clone()
-	t.DialContext = (&net.Dialer{
-		// DefaultTransport
+
+	// DefaultTransport
+	dialer := &net.Dialer{
 		Timeout:   30 * time.Second,
 		KeepAlive: 30 * time.Second,
-		// Custom
-		// iana-ipv4/6-special-registry に記載のあるものを一律拒否
-		// TODO: 不要なものがあるかも
-		// Default:
-		// https://github.com/daenney/ssrf/blob/main/ssrf_gen.go
-		Control: ssrf.New(
-			ssrf.WithDeniedV4Prefixes(
-				// https://www.iana.org/assignments/iana-ipv4-special-registry/iana-ipv4-special-registry.xhtml
-				[]netip.Prefix{
-					netip.MustParsePrefix("0.0.0.0/32"),         // "This host on this network" (RFC 1122, Section 3.2.1.3)
-					netip.MustParsePrefix("192.0.0.0/29"),       // IPv4 Service Continuity Prefix (RFC 7335)
-					netip.MustParsePrefix("192.0.0.8/32"),       // IPv4 dummy address (RFC 7600)
-					netip.MustParsePrefix("192.0.0.9/32"),       // Port Control Protocol Anycast (RFC 7723)
-					netip.MustParsePrefix("192.0.0.10/32"),      // Traversal Using Relays around NAT Anycast (RFC 8155)
-					netip.MustParsePrefix("192.0.0.170/32"),     // NAT64/DNS64 Discovery (RFC 8880, RFC 7050, Section 2.2)
-					netip.MustParsePrefix("192.0.0.171/32"),     // NAT64/DNS64 Discovery (RFC 8880, RFC 7050, Section 2.2)
-					netip.MustParsePrefix("192.0.2.0/24"),       // Documentation (TEST-NET-1) (RFC 5737)
-					netip.MustParsePrefix("255.255.255.255/32"), // Limited Broadcast (RFC 8190, RFC 919, Section 7)
-				}...,
-			),
-			ssrf.WithDeniedV6Prefixes(
-				[]netip.Prefix{
-					// https://www.iana.org/assignments/iana-ipv6-special-registry/iana-ipv6-special-registry.xhtml
-					netip.MustParsePrefix("::1/128"),         // Loopback Address (RFC 4291)
-					netip.MustParsePrefix("::/128"),          // Unspecified Address (RFC 4291)
-					netip.MustParsePrefix("::ffff:0:0/96"),   // IPv4-mapped Address (RFC 4291)
-					ssrf.IPv6NAT64Prefix,                     // IPv4-IPv6 Translat. (RFC 6052)
-					netip.MustParsePrefix("64:ff9b:1::/48"),  // IPv4-IPv6 Translat. (RFC 8215)
-					netip.MustParsePrefix("100::/64"),        // Discard-Only Address Block (RFC 6666)
-					netip.MustParsePrefix("2001::/32"),       // TEREDO (RFC4380, RFC8190)
-					netip.MustParsePrefix("2001:1::1/128"),   // Port Control Protocol Anycast (RFC 7723)
-					netip.MustParsePrefix("2001:1::2/128"),   // Traversal Using Relays around NAT Anycast (RFC 8155)
-					netip.MustParsePrefix("2001:1::3/128"),   // DNS-SD Service Registration Protocol Anycast Address (RFC-ietf-dnssd-srp-25)
-					netip.MustParsePrefix("2001:2::/48"),     // Benchmarking (RFC 5180, RFC Errata 1752)
-					netip.MustParsePrefix("2001:3::/32"),     // AMT (RFC 7450)
-					netip.MustParsePrefix("2001:4:112::/48"), // AS112-v6 (RFC 7535)
-					netip.MustParsePrefix("2001:10::/28"),    // Deprecated (previously ORCHID) (RFC 4843)
-					netip.MustParsePrefix("2001:20::/28"),    // ORCHIDv2 (RFC 7343)
-					netip.MustParsePrefix("2001:30::/28"),    // Drone Remote ID Protocol Entity Tags (DETs) Prefix (RFC 9374)
-					netip.MustParsePrefix("5f00::/16"),       // Segment Routing (SRv6) SIDs (RFC-ietf-6man-sids-06)
-					netip.MustParsePrefix("fc00::/7"),        // Unique-Local (RFC 4193, RFC 8190)
-					netip.MustParsePrefix("fe80::/10"),       // Link-Local Unicast (RFC 4291)
-					// https://www.rfc-editor.org/rfc/rfc4291.html
-					netip.MustParsePrefix("ff00::/8"), // Multicast
-				}...,
-			),
-		).Safe,
-	}).DialContext
+	}
+	policy := newSSRFPolicy(c.SSRF, !c.AllowPrivateIP, newDNSResolver(c.DNS))
+	t.DialContext = policy.dialContext(dialer)
+	var rt http.RoundTripper = t
+	if c.Proxy != nil {
+		r, err := newProxyRouter(*c.Proxy, policy, dialer, t.DialContext)
+		if err != nil {
+			return nil, fmt.Errorf("proxy: %w", err)
+		}
+		rt = r.apply(t)
+	}
 
 	// TODO: MaxIdleConnsPerHost とか設定必要？
 	return &Client{
 		HTTPClient: &http.Client{
 			Timeout:   c.Timeout,
-			Transport: t,
-		}}
+			Transport: rt,
+		}}, nil
+}
+
+func WithMethod(method string) func(*Request) {
+	return func(r *Request) {
+		r.method = method
+	}
 }
 
 func WithAllowType(allowType []string) func(*Request) {
@@ -132,6 +278,23 @@ func WithLimit(limit int64) func(*Request) {
 	}
 }
 
+// WithPrefixLimit は GetDocument で HTML 以外のときに読む最大バイト数を指定する
+func WithPrefixLimit(limit int64) func(*Request) {
+	return func(r *Request) {
+		r.prefixLimit = limit
+	}
+}
+
+// WithHeadOnly は GetDocument で HTML を </head> までだけパースする
+//
+// threshold は ParseHead を参照。 sufficient が false を返したときは全体をパースし直す
+func WithHeadOnly(threshold int64, sufficient func(*html.Node) bool) func(*Request) {
+	return func(r *Request) {
+		r.headThreshold = threshold
+		r.headSufficient = sufficient
+	}
+}
+
 func WithUserAgent(userAgent string) func(*Request) {
 	return func(r *Request) {
 		r.userAgent = userAgent
@@ -150,14 +313,39 @@ func WithAcceptLanguage(acceptLanguage string) func(*Request) {
 	}
 }
 
+// WithHeaders は追加のヘッダーを指定する。 User-Agent などより優先する
+func WithHeaders(headers map[string]string) func(*Request) {
+	return func(r *Request) {
+		r.headers = headers
+	}
+}
+
+// WithHeaderHosts は WithHeaders のヘッダーを送ってよいホストを指定する
+//
+// 指定しなければリダイレクトで最初の URL と違うホストに移ったときには送らない
+func WithHeaderHosts(match func(host string) bool) func(*Request) {
+	return func(r *Request) {
+		r.headerHosts = match
+	}
+}
+
+// WithCookies は送る Cookie を指定する
+func WithCookies(cookies map[string]string) func(*Request) {
+	return func(r *Request) {
+		r.cookies = cookies
+	}
+}
+
 // NewRequest は *Request を返す
 func (c *Client) NewRequest(url *url.URL, options ...Option) *Request {
 	// p.110 Go言語プログラミングエッセンス
 	// Functional Options Pattern
 	req := &Request{
-		url:       url,
-		allowType: defaultAllowType,
-		limit:     10 << 20, // 10MiB
+		url:         url,
+		method:      http.MethodGet,
+		allowType:   defaultAllowType,
+		limit:       10 << 20, // 10MiB
+		prefixLimit: 1 << 20,  // 1MiB
 		// like Googlebot
 		userAgent: "Mozilla/5.0 (compatible; SummalyBot/0.0.1; +https://github.com/yulog/go-summaly)",
 		accept:    "text/html, application/xhtml+xml",
@@ -193,30 +381,141 @@ func (reqs *Request) limitEncode(resp *http.Response) io.Reader {
 	return br
 }
 
-// Do は指定の url から response を取得する
-func (reqs *Request) do() (*http.Response, error) {
-	req, err := http.NewRequest(http.MethodGet, reqs.url.String(), nil)
+// send は指定の url にリクエストを送る
+//
+// 同意画面にリダイレクトされたときは Cookie を補って1回だけ送り直す
+func (reqs *Request) send() (*http.Response, error) {
+	req, err := reqs.newRequest()
 	if err != nil {
 		return nil, err
 	}
-	req.Header.Set("User-Agent", reqs.userAgent)
-	req.Header.Set("Accept", reqs.accept)
-	if reqs.acceptLanguage != "" {
-		req.Header.Set("Accept-Language", reqs.acceptLanguage)
+	resp, err := reqs.doRequest(req)
+	if ce := new(ConsentError); !errors.As(err, &ce) {
+		return resp, err
 	}
 
+	reqs.client.Logger().Info("consent page, retry with cookies", "url", reqs.url.String())
+	if req, err = reqs.newRequest(); err != nil {
+		return nil, err
+	}
+	if jar := reqs.client.HTTPClient.Jar; jar != nil {
+		reqs.client.consent.seed(jar, reqs.url)
+	} else {
+		for _, c := range reqs.client.consent.seeds(reqs.url.Hostname()) {
+			req.AddCookie(c)
+		}
+	}
+	return reqs.doRequest(req)
+}
+
+// doRequest は req を送り、結果をログと span に記録する
+//
+// span は Body を Close したときに読んだバイト数とともに終える
+func (reqs *Request) doRequest(req *http.Request) (*http.Response, error) {
+	ctx, span := tracer.Start(req.Context(), "fetch "+req.Method,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(
+			semconv.HTTPRequestMethodKey.String(req.Method),
+			semconv.URLFull(req.URL.String()),
+			semconv.ServerAddress(req.URL.Hostname()),
+		),
+	)
+	req = req.WithContext(ctx)
+
+	start := time.Now()
 	resp, err := reqs.client.HTTPClient.Do(req)
+	logger := reqs.client.Logger()
+	if err != nil {
+		logger.Debug("fetch", "method", req.Method, "url", req.URL.String(), "duration", time.Since(start), "err", err)
+		endSpan(span, err)
+		return nil, err
+	}
+	logger.Debug("fetch", "method", req.Method, "url", req.URL.String(), "duration", time.Since(start), "status", resp.StatusCode)
+	span.SetAttributes(
+		semconv.HTTPResponseStatusCode(resp.StatusCode),
+		attribute.String("http.response.header.content-type", resp.Header.Get("Content-Type")),
+	)
+	if resp.StatusCode >= 400 {
+		span.SetStatus(codes.Error, resp.Status)
+	}
+	resp.Body = &tracedBody{ReadCloser: resp.Body, span: span}
+	return resp, nil
+}
+
+func (reqs *Request) newRequest() (*http.Request, error) {
+	ctx := withLogger(reqs.client.Context(), reqs.client.Logger())
+	if reqs.client.pins != nil {
+		ctx = withPins(ctx, reqs.client.pins)
+	}
+	if len(reqs.headers) > 0 {
+		match := reqs.headerHosts
+		if match == nil {
+			host := strings.ToLower(reqs.url.Hostname())
+			match = func(h string) bool { return h == host }
+		}
+		ctx = withHeaderScope(ctx, &headerScope{headers: reqs.headers, match: match})
+	}
+	req, err := http.NewRequestWithContext(ctx, reqs.method, reqs.url.String(), nil)
 	if err != nil {
 		return nil, err
 	}
+	req.Header.Set("User-Agent", reqs.userAgent)
+	req.Header.Set("Accept", reqs.accept)
+	if reqs.acceptLanguage != "" {
+		req.Header.Set("Accept-Language", reqs.acceptLanguage)
+	}
+	for k, v := range reqs.headers {
+		req.Header.Set(k, v)
+	}
+	for _, name := range slices.Sorted(maps.Keys(reqs.cookies)) {
+		req.AddCookie(&http.Cookie{Name: name, Value: reqs.cookies[name]})
+	}
+	if reqs.byteRange != "" {
+		req.Header.Set("Range", reqs.byteRange)
+	}
+	return req, nil
+}
+
+// StatusError は 2xx 以外のレスポンスを示す
+type StatusError struct {
+	StatusCode int
+	Status     string
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("unexpected status: %s", e.Status)
+}
 
+// checkType は response の Content-Type が許可されているかを確認する
+//
+// allowType には "image/*" のようなワイルドカードも使える
+func (reqs *Request) checkType(resp *http.Response) error {
 	ct := resp.Header.Get("Content-Type")
 	mediatype, _, err := mime.ParseMediaType(ct)
+	if err != nil {
+		return err
+	}
+	if !slices.ContainsFunc(reqs.allowType, func(t string) bool {
+		if prefix, ok := strings.CutSuffix(t, "*"); ok {
+			return strings.HasPrefix(mediatype, prefix)
+		}
+		return t == mediatype
+	}) {
+		return fmt.Errorf("rejected by type: %s", mediatype)
+	}
+	return nil
+}
+
+// Do は指定の url から response を取得する
+func (reqs *Request) do() (*http.Response, error) {
+	resp, err := reqs.send()
 	if err != nil {
 		return nil, err
 	}
-	if !slices.Contains(reqs.allowType, mediatype) {
-		return nil, fmt.Errorf("rejected by type: %s", mediatype)
+
+	if err := reqs.checkType(resp); err != nil {
+		resp.Body.Close()
+		return nil, err
 	}
 
 	return resp, nil
@@ -237,6 +536,50 @@ func (reqs *Request) Do() ([]byte, error) {
 	return body, nil
 }
 
+// GetRaw は指定の url から Body を変換せずに取得し、 Content-Type とともに返す
+//
+// limit を超える場合はエラーにする
+func (reqs *Request) GetRaw() ([]byte, string, error) {
+	resp, err := reqs.do()
+	if err != nil {
+		return nil, "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return nil, "", &StatusError{StatusCode: resp.StatusCode, Status: resp.Status}
+	}
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, reqs.limit+1))
+	if err != nil {
+		return nil, "", err
+	}
+	if int64(len(body)) > reqs.limit {
+		return nil, "", fmt.Errorf("body too large: limit %d bytes", reqs.limit)
+	}
+	return body, resp.Header.Get("Content-Type"), nil
+}
+
+// Check は指定の url が取得可能で、Content-Type が許可されているかを確認する
+//
+// HEAD が拒否された場合は GET で再確認する
+func (reqs *Request) Check() error {
+	resp, err := reqs.send()
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if reqs.method == http.MethodHead && (resp.StatusCode == http.StatusMethodNotAllowed || resp.StatusCode == http.StatusNotImplemented) {
+		reqs.method = http.MethodGet
+		return reqs.Check()
+	}
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return &StatusError{StatusCode: resp.StatusCode, Status: resp.Status}
+	}
+	return reqs.checkType(resp)
+}
+
 // GetHtmlNode は指定の url から Body を取得し、 html.Node を返す
 func (reqs *Request) GetHtmlNode() (*html.Node, error) {
 	resp, err := reqs.do()
@@ -252,6 +595,102 @@ func (reqs *Request) GetHtmlNode() (*html.Node, error) {
 	return node, nil
 }
 
+// Document は GetDocument で取得した内容
+type Document struct {
+	MediaType     string
+	ContentLength int64 // 不明な場合は -1
+
+	// HTML のときは Node 、それ以外のときは先頭 prefixLimit バイトの Prefix
+	Node   *html.Node
+	Prefix []byte
+	// Prefix が Body の途中までのとき true
+	Truncated bool
+}
+
+// GetDocument は指定の url から Body を取得する
+//
+// HTML なら html.Node を返し、それ以外は先頭の一部だけを読む
+func (reqs *Request) GetDocument() (*Document, error) {
+	resp, err := reqs.do()
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	mediatype, _, err := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if err != nil {
+		return nil, err
+	}
+	doc := &Document{
+		MediaType:     mediatype,
+		ContentLength: resp.ContentLength,
+	}
+
+	if slices.Contains(defaultAllowType, mediatype) {
+		doc.Node, err = reqs.parseHTML(reqs.limitEncode(resp))
+		if err != nil {
+			return nil, err
+		}
+		return doc, nil
+	}
+
+	doc.Prefix, err = io.ReadAll(io.LimitReader(resp.Body, reqs.prefixLimit+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(doc.Prefix)) > reqs.prefixLimit {
+		doc.Prefix = doc.Prefix[:reqs.prefixLimit]
+		doc.Truncated = true
+	}
+	return doc, nil
+}
+
+// GetTail は指定の url から Body の末尾 n バイトを Range リクエストで取得する
+//
+// Range に対応していないときは limit まで読んで末尾を返す。 limit を超える場合はエラーにする
+func (reqs *Request) GetTail(n int64) ([]byte, error) {
+	n = min(n, reqs.limit)
+	reqs.byteRange = fmt.Sprintf("bytes=-%d", n)
+	resp, err := reqs.do()
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+		return io.ReadAll(io.LimitReader(resp.Body, n))
+	case http.StatusOK:
+		body, err := io.ReadAll(io.LimitReader(resp.Body, reqs.limit+1))
+		if err != nil {
+			return nil, err
+		}
+		if int64(len(body)) > reqs.limit {
+			return nil, fmt.Errorf("body too large: limit %d bytes", reqs.limit)
+		}
+		return body[max(0, int64(len(body))-n):], nil
+	default:
+		return nil, &StatusError{StatusCode: resp.StatusCode, Status: resp.Status}
+	}
+}
+
+// parseHTML は WithHeadOnly の指定があれば </head> までをパースし、
+// 足りなければ全体をパースする
+func (reqs *Request) parseHTML(r io.Reader) (*html.Node, error) {
+	if reqs.headThreshold <= 0 {
+		return html.Parse(r)
+	}
+
+	node, full, err := ParseHead(r, reqs.headThreshold)
+	if err != nil {
+		return nil, err
+	}
+	if reqs.headSufficient == nil || reqs.headSufficient(node) {
+		return node, nil
+	}
+	return html.Parse(full)
+}
+
 // GetJSON は指定の url から Body を取得し、 out に decode する
 func (reqs *Request) GetJSON(out any) error {
 	resp, err := reqs.do()
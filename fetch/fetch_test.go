@@ -0,0 +1,13 @@
+package fetch
+
+import "testing"
+
+// mustClient は opts から *Client を作る
+func mustClient(t *testing.T, opts ClientOpts) *Client {
+	t.Helper()
+	c, err := NewClient(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
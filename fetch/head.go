@@ -0,0 +1,67 @@
+package fetch
+
+import (
+	"bytes"
+	"io"
+
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+// head に置かれる要素
+var headElements = map[atom.Atom]bool{
+	atom.Html:     true,
+	atom.Head:     true,
+	atom.Title:    true,
+	atom.Meta:     true,
+	atom.Link:     true,
+	atom.Base:     true,
+	atom.Style:    true,
+	atom.Script:   true,
+	atom.Noscript: true,
+	atom.Template: true,
+}
+
+// ParseHead は r を </head> まで読み、その部分だけの html.Node を返す
+//
+// </head> がない場合は threshold バイト以上読んだ後の最初の body の要素で止める
+// full は読み込み済みの分を含む r 全体で、全体をパースし直すときに使う
+func ParseHead(r io.Reader, threshold int64) (node *html.Node, full io.Reader, err error) {
+	var read bytes.Buffer
+	z := html.NewTokenizer(io.TeeReader(r, &read))
+
+	var head bytes.Buffer
+	var n int64
+loop:
+	for {
+		tt := z.Next()
+		raw := z.Raw()
+		n += int64(len(raw))
+
+		switch tt {
+		case html.ErrorToken:
+			if z.Err() != io.EOF {
+				return nil, nil, z.Err()
+			}
+			break loop
+		case html.StartTagToken, html.SelfClosingTagToken:
+			name, _ := z.TagName()
+			if !headElements[atom.Lookup(name)] && n >= threshold {
+				break loop
+			}
+		case html.EndTagToken:
+			name, _ := z.TagName()
+			if atom.Lookup(name) == atom.Head {
+				head.Write(raw)
+				break loop
+			}
+		}
+		head.Write(raw)
+	}
+
+	node, err = html.Parse(&head)
+	if err != nil {
+		return nil, nil, err
+	}
+	return node, io.MultiReader(&read, r), nil
+}
@@ -0,0 +1,21 @@
+package fetch
+
+import (
+	"context"
+	"log/slog"
+)
+
+type loggerKey struct{}
+
+// withLogger は Transport で使うログの出力先を ctx に入れる
+func withLogger(ctx context.Context, logger *slog.Logger) context.Context {
+	return context.WithValue(ctx, loggerKey{}, logger)
+}
+
+// loggerFrom は ctx のログの出力先を返す。なければ slog.Default
+func loggerFrom(ctx context.Context) *slog.Logger {
+	if l, ok := ctx.Value(loggerKey{}).(*slog.Logger); ok {
+		return l
+	}
+	return slog.Default()
+}
@@ -0,0 +1,197 @@
+package fetch
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"golang.org/x/net/proxy"
+)
+
+// ProxyOpts は外向きのリクエストに使うプロキシ
+//
+// http, https, socks5, socks5h の URL を指定できる
+// socks5 だけは確認した IP をプロキシに渡す。ほかはホスト名を渡してプロキシ側で名前解決するため、
+// 確認の後で別の IP を返す DNS (DNS rebinding) には、プロキシ側で内部のアドレスを拒否して備える
+type ProxyOpts struct {
+	// Default はどの Hosts にも一致しないときのプロキシ。 nil は直接接続する
+	Default *url.URL
+	// Hosts はホストごとの上書き。 "*.example.com" でサブドメインにも適用する。 nil は直接接続する
+	Hosts map[string]*url.URL
+}
+
+// proxy は host に使うプロキシを返す
+func (o *ProxyOpts) proxy(host string) *url.URL {
+	if u, ok := matchHost(o.Hosts, host); ok {
+		return u
+	}
+	return o.Default
+}
+
+// proxyRouter は宛先のホストごとにプロキシを振り分ける
+//
+// SSRF の確認はプロキシに渡す前に宛先を名前解決して行い、
+// Transport がプロキシを経由するときのプロキシ自体への接続は確認しない
+type proxyRouter struct {
+	opts   ProxyOpts
+	policy *ssrfPolicy
+	dialer *net.Dialer // プロキシへの接続
+	direct func(ctx context.Context, network, addr string) (net.Conn, error)
+
+	socks map[string]proxy.ContextDialer // socks5 プロキシの URL ごと
+}
+
+// httpProxyKey は http(s) プロキシを経由するリクエストの context に、プロキシの host:port を持たせるキー
+type httpProxyKey struct{}
+
+func newProxyRouter(opts ProxyOpts, policy *ssrfPolicy, dialer *net.Dialer, direct func(ctx context.Context, network, addr string) (net.Conn, error)) (*proxyRouter, error) {
+	r := &proxyRouter{
+		opts:   opts,
+		policy: policy,
+		dialer: dialer,
+		direct: direct,
+		socks:  make(map[string]proxy.ContextDialer),
+	}
+
+	urls := []*url.URL{opts.Default}
+	for _, u := range opts.Hosts {
+		urls = append(urls, u)
+	}
+	for _, u := range urls {
+		if u == nil {
+			continue
+		}
+		switch u.Scheme {
+		case "http", "https":
+		case "socks5", "socks5h":
+			d, err := proxy.FromURL(u, dialer)
+			if err != nil {
+				return nil, err
+			}
+			cd, ok := d.(proxy.ContextDialer)
+			if !ok {
+				return nil, fmt.Errorf("unsupported proxy: %s", u.Redacted())
+			}
+			r.socks[u.String()] = cd
+		default:
+			return nil, fmt.Errorf("unsupported proxy scheme: %s", u.Scheme)
+		}
+	}
+	return r, nil
+}
+
+// apply は t の Proxy と DialContext を置き換え、 t を包んだ http.RoundTripper を返す
+func (r *proxyRouter) apply(t *http.Transport) http.RoundTripper {
+	t.Proxy = r.httpProxy
+	t.DialContext = r.dialContext
+	return &proxyTransport{Transport: t, router: r}
+}
+
+// httpProxyURL は host に使う http(s) プロキシを返す。なければ nil
+func (r *proxyRouter) httpProxyURL(host string) *url.URL {
+	u := r.opts.proxy(strings.ToLower(host))
+	if u == nil || (u.Scheme != "http" && u.Scheme != "https") {
+		return nil
+	}
+	return u
+}
+
+// httpProxy は http.Transport.Proxy として宛先を確認してから http(s) プロキシを返す
+//
+// 宛先はホスト名のままプロキシに渡すため、プロキシ側の名前解決は確認できない。
+// ここで確認した後に DNS が内部の IP を返すようになると、プロキシはその IP に接続する。
+// CONNECT の宛先を IP にすると SNI と証明書の確認もその IP になるため、固定はしていない
+func (r *proxyRouter) httpProxy(req *http.Request) (*url.URL, error) {
+	u := r.httpProxyURL(req.URL.Hostname())
+	if u == nil {
+		return nil, nil
+	}
+	if _, err := r.policy.resolve(req.Context(), canonicalAddr(req.URL)); err != nil {
+		return nil, err
+	}
+	return u, nil
+}
+
+// dialContext は http(s) プロキシへはそのまま、 socks5 プロキシへは確認した宛先の IP で、
+// socks5h プロキシへは確認した後にホスト名のままで接続する
+//
+// プロキシのアドレスを宛先にしたリクエストは、ほかの宛先と同じように確認する
+func (r *proxyRouter) dialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	// Transport が http(s) プロキシに接続するとき
+	if proxyAddr, _ := ctx.Value(httpProxyKey{}).(string); proxyAddr != "" && proxyAddr == addr {
+		return r.dialer.DialContext(ctx, network, addr)
+	}
+
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	u := r.opts.proxy(strings.ToLower(host))
+	if u == nil || r.socks[u.String()] == nil {
+		return r.direct(ctx, network, addr)
+	}
+
+	// 確認した IP を渡してプロキシ側で別の IP に解決されないようにする
+	target, err := r.policy.resolve(ctx, addr)
+	if err != nil {
+		return nil, err
+	}
+	// socks5h はプロキシ側で名前解決するという指定なので、ホスト名のまま渡す
+	if u.Scheme == "socks5h" {
+		target = addr
+	}
+	return r.socks[u.String()].DialContext(ctx, network, target)
+}
+
+// proxyTransport は http(s) プロキシを経由するリクエストの context にプロキシの host:port を持たせ、
+// dialContext がプロキシへの接続とプロキシのアドレスを宛先にした接続を見分けられるようにする
+type proxyTransport struct {
+	Transport http.RoundTripper
+	router    *proxyRouter
+}
+
+func (t *proxyTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if u := t.router.httpProxyURL(req.URL.Hostname()); u != nil {
+		req = req.WithContext(context.WithValue(req.Context(), httpProxyKey{}, canonicalAddr(u)))
+	}
+	return t.Transport.RoundTrip(req)
+}
+
+// canonicalAddr は u の host:port を返す。ポートがなければスキームから補う
+func canonicalAddr(u *url.URL) string {
+	port := u.Port()
+	if port == "" {
+		switch u.Scheme {
+		case "https":
+			port = "443"
+		case "socks5", "socks5h":
+			port = "1080"
+		default:
+			port = "80"
+		}
+	}
+	return net.JoinHostPort(u.Hostname(), port)
+}
+
+// matchHost は m から host に一致するものを返す
+//
+// 完全一致を優先し、 "*.example.com" はサブドメインに一致する
+// 複数のパターンに一致するときは最も長いもの ("*.cdn.example.com" など) を使う
+func matchHost[T any](m map[string]T, host string) (T, bool) {
+	if v, ok := m[host]; ok {
+		return v, true
+	}
+	var (
+		match   T
+		longest = -1
+	)
+	for pattern, v := range m {
+		if suffix, ok := strings.CutPrefix(pattern, "*"); ok && strings.HasSuffix(host, suffix) && len(suffix) > longest {
+			match, longest = v, len(suffix)
+		}
+	}
+	return match, longest >= 0
+}
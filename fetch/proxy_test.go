@@ -0,0 +1,197 @@
+package fetch
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"net/url"
+	"strconv"
+	"sync/atomic"
+	"testing"
+)
+
+func TestProxy(t *testing.T) {
+	var proxied atomic.Value
+	ps := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// プロキシへのリクエストは絶対 URI になる
+		proxied.Store(r.URL.String())
+		w.Header().Set("Content-Type", "text/html")
+	}))
+	defer ps.Close()
+	ds := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+	}))
+	defer ds.Close()
+
+	proxyURL, _ := url.Parse(ps.URL)
+	opts := &ProxyOpts{Hosts: map[string]*url.URL{
+		"example.com":   proxyURL,
+		"*.example.net": proxyURL,
+		"127.0.0.2":     proxyURL,
+	}}
+
+	tests := []struct {
+		name           string
+		allowPrivateIP bool
+		url            string
+		wantProxied    string
+		wantErr        bool
+	}{
+		{"proxied", true, "http://example.com/a", "http://example.com/a", false},
+		{"proxied wildcard", true, "http://www.example.net/", "http://www.example.net/", false},
+		{"direct", true, ds.URL, "", false},
+		{"ssrf checked before proxy", false, "http://127.0.0.2/", "", true},
+		// プロキシ自体のアドレスを宛先にしても確認を飛ばさない
+		{"proxy address checked", false, ps.URL + "/internal", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			proxied.Store("")
+			c := mustClient(t, ClientOpts{AllowPrivateIP: tt.allowPrivateIP, Proxy: opts})
+			u, _ := url.Parse(tt.url)
+
+			_, err := c.NewRequest(u).Do()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got := proxied.Load(); got != tt.wantProxied {
+				t.Errorf("proxied = %q, want %q", got, tt.wantProxied)
+			}
+		})
+	}
+}
+
+func TestMatchHost(t *testing.T) {
+	m := map[string]string{
+		"example.com":         "exact",
+		"*.example.com":       "wildcard",
+		"*.cdn.example.com":   "cdn",
+		"*.a.cdn.example.com": "a.cdn",
+	}
+	tests := []struct {
+		host   string
+		want   string
+		wantOK bool
+	}{
+		{"example.com", "exact", true},
+		{"www.example.com", "wildcard", true},
+		{"img.cdn.example.com", "cdn", true},
+		{"x.a.cdn.example.com", "a.cdn", true},
+		{"cdn.example.com", "wildcard", true},
+		{"example.net", "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.host, func(t *testing.T) {
+			// map の順序に依存しないことを確かめるため何度か試す
+			for range 20 {
+				got, ok := matchHost(m, tt.host)
+				if got != tt.want || ok != tt.wantOK {
+					t.Fatalf("matchHost(%q) = %q, %v, want %q, %v", tt.host, got, ok, tt.want, tt.wantOK)
+				}
+			}
+		})
+	}
+}
+
+// newSOCKS5Server は CONNECT の宛先を記録し、空の HTML を返す SOCKS5 プロキシのスタンドイン
+func newSOCKS5Server(t *testing.T) (string, *atomic.Value) {
+	t.Helper()
+	var target atomic.Value
+	target.Store("")
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				br := bufio.NewReader(conn)
+				// 挨拶: VER NMETHODS METHODS
+				head := make([]byte, 2)
+				if _, err := io.ReadFull(br, head); err != nil {
+					return
+				}
+				io.CopyN(io.Discard, br, int64(head[1]))
+				conn.Write([]byte{5, 0})
+				// 要求: VER CMD RSV ATYP DST.ADDR DST.PORT
+				req := make([]byte, 4)
+				if _, err := io.ReadFull(br, req); err != nil {
+					return
+				}
+				var host string
+				switch req[3] {
+				case 1, 4:
+					ip := make([]byte, map[byte]int{1: 4, 4: 16}[req[3]])
+					io.ReadFull(br, ip)
+					host = net.IP(ip).String()
+				case 3:
+					n, _ := br.ReadByte()
+					name := make([]byte, n)
+					io.ReadFull(br, name)
+					host = string(name)
+				}
+				port := make([]byte, 2)
+				io.ReadFull(br, port)
+				target.Store(net.JoinHostPort(host, strconv.Itoa(int(port[0])<<8|int(port[1]))))
+				conn.Write([]byte{5, 0, 0, 1, 0, 0, 0, 0, 0, 0})
+
+				if _, err := http.ReadRequest(br); err != nil {
+					return
+				}
+				io.WriteString(conn, "HTTP/1.1 200 OK\r\nContent-Type: text/html\r\nContent-Length: 0\r\nConnection: close\r\n\r\n")
+			}()
+		}
+	}()
+	return l.Addr().String(), &target
+}
+
+func TestProxy_SOCKS5(t *testing.T) {
+	addr, target := newSOCKS5Server(t)
+	tests := []struct {
+		scheme string
+		wantIP bool
+	}{
+		// socks5 は確認した IP を渡す
+		{scheme: "socks5", wantIP: true},
+		// socks5h はプロキシ側で名前解決する
+		{scheme: "socks5h", wantIP: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.scheme, func(t *testing.T) {
+			target.Store("")
+			proxyURL, _ := url.Parse(tt.scheme + "://" + addr)
+			c := mustClient(t, ClientOpts{
+				SSRF: SSRFPolicy{AllowPrefixes: []netip.Prefix{
+					netip.MustParsePrefix("127.0.0.0/8"),
+					netip.MustParsePrefix("::1/128"),
+				}},
+				Proxy: &ProxyOpts{Default: proxyURL},
+				DNS:   &DNSOpts{},
+			})
+			u, _ := url.Parse("http://localhost/")
+			if _, err := c.NewRequest(u).Do(); err != nil {
+				t.Fatal(err)
+			}
+			got := target.Load().(string)
+			host, _, err := net.SplitHostPort(got)
+			if err != nil {
+				t.Fatalf("target = %q: %v", got, err)
+			}
+			if _, err := netip.ParseAddr(host); (err == nil) != tt.wantIP {
+				t.Errorf("target = %q, want IP %v", got, tt.wantIP)
+			}
+			if !tt.wantIP && host != "localhost" {
+				t.Errorf("target = %q, want localhost", got)
+			}
+		})
+	}
+}
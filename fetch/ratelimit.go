@@ -0,0 +1,179 @@
+package fetch
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// HostLimit はホストごとの制限
+type HostLimit struct {
+	// Rate は1秒あたりのリクエスト数。0 は無制限
+	Rate  float64
+	Burst int
+	// MaxConcurrency は同時リクエスト数。0 は無制限
+	MaxConcurrency int
+}
+
+type RateLimitOpts struct {
+	Default HostLimit
+	// Hosts はホストごとの上書き。 "*.example.com" でサブドメインにも適用する
+	Hosts map[string]HostLimit
+	// MaxWait を超えて待つ必要があるときは RateLimitError にする
+	MaxWait time.Duration
+}
+
+// RateLimitError はローカルの制限により送らなかったことを示す
+type RateLimitError struct {
+	Host string
+}
+
+func (e *RateLimitError) Error() string {
+	return fmt.Sprintf("rate limited locally: %s", e.Host)
+}
+
+// RateLimitTransport はホストごとにリクエストの頻度と同時数を制限する http.RoundTripper
+type RateLimitTransport struct {
+	Transport http.RoundTripper
+	Opts      RateLimitOpts
+
+	mu    sync.Mutex
+	hosts map[string]*hostLimiter
+}
+
+type hostLimiter struct {
+	limiter  *rate.Limiter // nil は無制限
+	sem      chan struct{} // nil は無制限
+	lastUsed time.Time
+}
+
+// ホストがこの数を超えたらしばらく使われていないものを掃除する
+// それでも hostLimiterMaxHosts に達していれば最も使われていないものを消す
+const (
+	hostLimiterSweepSize = 1024
+	hostLimiterMaxHosts  = 4096
+	hostLimiterIdle      = 10 * time.Minute
+)
+
+func (t *RateLimitTransport) transport() http.RoundTripper {
+	if t.Transport == nil {
+		return http.DefaultTransport
+	}
+	return t.Transport
+}
+
+// limit は host に適用する HostLimit を返す
+func (o *RateLimitOpts) limit(host string) HostLimit {
+	if l, ok := matchHost(o.Hosts, host); ok {
+		return l
+	}
+	return o.Default
+}
+
+func (t *RateLimitTransport) limiter(host string) *hostLimiter {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := time.Now()
+	if t.hosts == nil {
+		t.hosts = make(map[string]*hostLimiter)
+	}
+	if l, ok := t.hosts[host]; ok {
+		l.lastUsed = now
+		return l
+	}
+
+	if len(t.hosts) >= hostLimiterSweepSize {
+		t.sweep(now)
+	}
+
+	hl := t.Opts.limit(host)
+	l := &hostLimiter{lastUsed: now}
+	if hl.Rate > 0 {
+		l.limiter = rate.NewLimiter(rate.Limit(hl.Rate), max(hl.Burst, 1))
+	}
+	if hl.MaxConcurrency > 0 {
+		l.sem = make(chan struct{}, hl.MaxConcurrency)
+	}
+	t.hosts[host] = l
+	return l
+}
+
+// sweep はしばらく使われておらず、処理中のリクエストもないホストを忘れる
+func (t *RateLimitTransport) sweep(now time.Time) {
+	for host, l := range t.hosts {
+		if now.Sub(l.lastUsed) > hostLimiterIdle && (l.sem == nil || len(l.sem) == 0) {
+			delete(t.hosts, host)
+		}
+	}
+	for len(t.hosts) >= hostLimiterMaxHosts {
+		var oldest string
+		for host, l := range t.hosts {
+			if oldest == "" || l.lastUsed.Before(t.hosts[oldest].lastUsed) {
+				oldest = host
+			}
+		}
+		delete(t.hosts, oldest)
+	}
+}
+
+func (t *RateLimitTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	host := strings.ToLower(req.URL.Hostname())
+	l := t.limiter(host)
+
+	ctx := req.Context()
+	if t.Opts.MaxWait > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, t.Opts.MaxWait)
+		defer cancel()
+	}
+
+	if l.limiter != nil {
+		// 期限までに順番が来ない場合はすぐにエラーになる
+		if err := l.limiter.Wait(ctx); err != nil {
+			if req.Context().Err() != nil {
+				return nil, req.Context().Err()
+			}
+			return nil, &RateLimitError{Host: host}
+		}
+	}
+
+	if l.sem == nil {
+		return t.transport().RoundTrip(req)
+	}
+	select {
+	case l.sem <- struct{}{}:
+	case <-ctx.Done():
+		if req.Context().Err() != nil {
+			return nil, req.Context().Err()
+		}
+		return nil, &RateLimitError{Host: host}
+	}
+
+	resp, err := t.transport().RoundTrip(req)
+	if err != nil {
+		<-l.sem
+		return nil, err
+	}
+	// Body を閉じるまでを同時リクエストとして数える
+	resp.Body = &releaseBody{ReadCloser: resp.Body, release: func() { <-l.sem }}
+	return resp, nil
+}
+
+type releaseBody struct {
+	io.ReadCloser
+	once    sync.Once
+	release func()
+}
+
+func (b *releaseBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.once.Do(b.release)
+	return err
+}
@@ -0,0 +1,146 @@
+package fetch
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestRateLimitTransport(t *testing.T) {
+	tests := []struct {
+		name     string
+		opts     RateLimitOpts
+		requests int
+		wantErrs int
+	}{
+		{
+			name:     "unlimited",
+			opts:     RateLimitOpts{},
+			requests: 5,
+			wantErrs: 0,
+		},
+		{
+			name: "burst then rate limited",
+			opts: RateLimitOpts{
+				Default: HostLimit{Rate: 0.1, Burst: 2},
+				MaxWait: 50 * time.Millisecond,
+			},
+			requests: 4,
+			wantErrs: 2,
+		},
+		{
+			name: "host override",
+			opts: RateLimitOpts{
+				Default: HostLimit{Rate: 0.1, Burst: 1},
+				Hosts:   map[string]HostLimit{"127.0.0.1": {}},
+				MaxWait: 50 * time.Millisecond,
+			},
+			requests: 4,
+			wantErrs: 0,
+		},
+		{
+			name: "wildcard override",
+			opts: RateLimitOpts{
+				Hosts:   map[string]HostLimit{"*.0.0.1": {Rate: 0.1, Burst: 1}},
+				MaxWait: 50 * time.Millisecond,
+			},
+			requests: 3,
+			wantErrs: 2,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "text/html")
+			}))
+			defer ts.Close()
+
+			opts := tt.opts
+			c := mustClient(t, ClientOpts{AllowPrivateIP: true, RateLimit: &opts})
+			u, _ := url.Parse(ts.URL)
+
+			var errs int
+			for range tt.requests {
+				_, err := c.NewRequest(u).Do()
+				if rle := new(RateLimitError); errors.As(err, &rle) {
+					errs++
+				} else if err != nil {
+					t.Fatal(err)
+				}
+			}
+			if errs != tt.wantErrs {
+				t.Errorf("rate limited = %d, want %d", errs, tt.wantErrs)
+			}
+		})
+	}
+}
+
+func TestRateLimitTransport_Concurrency(t *testing.T) {
+	var inflight, peak atomic.Int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := inflight.Add(1)
+		defer inflight.Add(-1)
+		for {
+			p := peak.Load()
+			if n <= p || peak.CompareAndSwap(p, n) {
+				break
+			}
+		}
+		time.Sleep(20 * time.Millisecond)
+		w.Header().Set("Content-Type", "text/html")
+	}))
+	defer ts.Close()
+
+	c := mustClient(t, ClientOpts{AllowPrivateIP: true, RateLimit: &RateLimitOpts{
+		Default: HostLimit{MaxConcurrency: 2},
+		MaxWait: time.Second,
+	}})
+	u, _ := url.Parse(ts.URL)
+
+	var wg sync.WaitGroup
+	for range 6 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := c.NewRequest(u).Do(); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if got := peak.Load(); got > 2 {
+		t.Errorf("peak concurrency = %d, want <= 2", got)
+	}
+}
+
+func TestRateLimitTransport_Sweep(t *testing.T) {
+	rt := &RateLimitTransport{Opts: RateLimitOpts{Default: HostLimit{Rate: 1, Burst: 1}}}
+	for i := range hostLimiterSweepSize {
+		rt.limiter(fmt.Sprintf("old%d.example", i))
+	}
+	// しばらく使われていないことにする
+	for _, l := range rt.hosts {
+		l.lastUsed = l.lastUsed.Add(-2 * hostLimiterIdle)
+	}
+	rt.limiter("new.example")
+	if got := len(rt.hosts); got != 1 {
+		t.Errorf("hosts = %d, want 1", got)
+	}
+
+	for i := range 2 * hostLimiterMaxHosts {
+		rt.limiter(fmt.Sprintf("host%d.example", i))
+	}
+	if got := len(rt.hosts); got > hostLimiterMaxHosts {
+		t.Errorf("hosts = %d, want <= %d", got, hostLimiterMaxHosts)
+	}
+	if _, ok := rt.hosts[fmt.Sprintf("host%d.example", 2*hostLimiterMaxHosts-1)]; !ok {
+		t.Error("latest host should be kept")
+	}
+}
@@ -0,0 +1,57 @@
+package fetch
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+)
+
+type headerScopeKey struct{}
+
+// headerScope は WithHeaders のヘッダーと、それを送ってよいホスト
+type headerScope struct {
+	headers map[string]string
+	match   func(host string) bool
+}
+
+func withHeaderScope(ctx context.Context, s *headerScope) context.Context {
+	return context.WithValue(ctx, headerScopeKey{}, s)
+}
+
+// checkRedirect は http.Client.CheckRedirect として、
+// WithHeaders のヘッダーを送ってよいホストでなければリダイレクト先に送らない
+//
+// http.Client は Authorization や Cookie 以外のヘッダーを別のドメインにもそのまま送るため。
+// next があればその後に確認する
+func checkRedirect(next func(*http.Request, []*http.Request) error) func(*http.Request, []*http.Request) error {
+	return func(req *http.Request, via []*http.Request) error {
+		if s, ok := req.Context().Value(headerScopeKey{}).(*headerScope); ok && !s.match(strings.ToLower(req.URL.Hostname())) {
+			for k := range s.headers {
+				req.Header.Del(k)
+			}
+		}
+		if next != nil {
+			return next(req, via)
+		}
+		// http.Client の既定と同じ
+		if len(via) >= 10 {
+			return errors.New("stopped after 10 redirects")
+		}
+		return nil
+	}
+}
+
+// hasScopedHeaders は req が WithHeaders のヘッダーを送るかを返す
+func hasScopedHeaders(req *http.Request) bool {
+	s, ok := req.Context().Value(headerScopeKey{}).(*headerScope)
+	if !ok {
+		return false
+	}
+	for k := range s.headers {
+		if req.Header.Get(k) != "" {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,53 @@
+package fetch
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func TestCheckRedirect_Headers(t *testing.T) {
+	var got string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/final" {
+			got = r.Header.Get("X-Token")
+			w.Header().Set("Content-Type", "text/html")
+			w.Write([]byte("ok"))
+			return
+		}
+		http.Redirect(w, r, r.URL.Query().Get("to")+"/final", http.StatusFound)
+	}))
+	defer ts.Close()
+	u, _ := url.Parse(ts.URL)
+	other := "http://localhost:" + u.Port()
+
+	tests := []struct {
+		name  string
+		to    string
+		hosts func(string) bool
+		want  string
+	}{
+		{name: "same host", to: ts.URL, want: "secret"},
+		{name: "other host", to: other, want: ""},
+		{name: "other host allowed", to: other, hosts: func(h string) bool { return h == "localhost" }, want: "secret"},
+		{name: "other host not allowed", to: other, hosts: func(h string) bool { return h == "127.0.0.1" }, want: ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got = "unset"
+			c := mustClient(t, ClientOpts{AllowPrivateIP: true})
+			reqURL, _ := url.Parse(ts.URL + "/start?to=" + url.QueryEscape(tt.to))
+			options := []Option{WithHeaders(map[string]string{"X-Token": "secret"})}
+			if tt.hosts != nil {
+				options = append(options, WithHeaderHosts(tt.hosts))
+			}
+			if _, err := c.NewRequest(reqURL, options...).Do(); err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("X-Token = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,182 @@
+package fetch
+
+import (
+	"errors"
+	"io"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"slices"
+	"strconv"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+type RetryOpts struct {
+	// MaxRetries は最初のリクエストに加えて再試行する最大回数
+	MaxRetries int
+	// BaseDelay * 2^n を上限にジッターを入れて待つ
+	BaseDelay time.Duration
+	// MaxDelay を超えて待つ必要があるときは再試行しない
+	MaxDelay time.Duration
+}
+
+// RetryStats は再試行の累計
+type RetryStats struct {
+	// Retries は再試行した回数
+	Retries uint64 `json:"retries"`
+	// Exhausted は再試行しても失敗したリクエスト数
+	Exhausted uint64 `json:"exhausted"`
+}
+
+// RetryTransport は冪等なリクエストを一時的な失敗のときに再試行する http.RoundTripper
+//
+// 接続のリセットや 429, 502, 503, 504 を一時的な失敗とし、 Retry-After があれば従う
+// リクエストの context の期限と Timeout を超えては待たない
+type RetryTransport struct {
+	Transport http.RoundTripper
+	Opts      RetryOpts
+	// Timeout は http.Client.Timeout と同じく最初のリクエストからの全体の期限
+	Timeout time.Duration
+
+	retries   atomic.Uint64
+	exhausted atomic.Uint64
+}
+
+var retryStatus = []int{
+	http.StatusTooManyRequests,
+	http.StatusBadGateway,
+	http.StatusServiceUnavailable,
+	http.StatusGatewayTimeout,
+}
+
+// 再試行前に読み捨てる Body の最大バイト数。これを超えると接続は再利用しない
+const retryDrainSize = 4 << 10
+
+func (t *RetryTransport) transport() http.RoundTripper {
+	if t.Transport == nil {
+		return http.DefaultTransport
+	}
+	return t.Transport
+}
+
+// Stats は再試行の累計を返す
+func (t *RetryTransport) Stats() RetryStats {
+	return RetryStats{
+		Retries:   t.retries.Load(),
+		Exhausted: t.exhausted.Load(),
+	}
+}
+
+func (t *RetryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if !idempotent(req) {
+		return t.transport().RoundTrip(req)
+	}
+
+	deadline, hasDeadline := req.Context().Deadline()
+	if t.Timeout > 0 {
+		if d := time.Now().Add(t.Timeout); !hasDeadline || d.Before(deadline) {
+			deadline, hasDeadline = d, true
+		}
+	}
+
+	for attempt := 0; ; attempt++ {
+		resp, err := t.transport().RoundTrip(req)
+		if !retryable(resp, err) || req.Context().Err() != nil {
+			return resp, err
+		}
+		if attempt >= t.Opts.MaxRetries {
+			t.exhausted.Add(1)
+			return resp, err
+		}
+
+		delay, ok := t.delay(attempt, resp)
+		if hasDeadline && time.Now().Add(delay).After(deadline) {
+			ok = false
+		}
+		if !ok {
+			t.exhausted.Add(1)
+			return resp, err
+		}
+
+		logger := loggerFrom(req.Context()).With("attempt", attempt+1, "max", t.Opts.MaxRetries, "delay", delay, "url", req.URL.String())
+		if resp != nil {
+			io.CopyN(io.Discard, resp.Body, retryDrainSize)
+			resp.Body.Close()
+			logger.Warn("retry", "status", resp.StatusCode)
+		} else {
+			logger.Warn("retry", "err", err)
+		}
+		t.retries.Add(1)
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-req.Context().Done():
+			timer.Stop()
+			return nil, req.Context().Err()
+		case <-timer.C:
+		}
+	}
+}
+
+// delay は attempt 回目の失敗の後に待つ時間を返す
+//
+// Retry-After が MaxDelay を超えるときは false を返す
+func (t *RetryTransport) delay(attempt int, resp *http.Response) (time.Duration, bool) {
+	if resp != nil {
+		if d, ok := parseRetryAfter(resp.Header.Get("Retry-After")); ok {
+			return d, t.Opts.MaxDelay <= 0 || d <= t.Opts.MaxDelay
+		}
+	}
+
+	// Full Jitter
+	// https://aws.amazon.com/jp/blogs/architecture/exponential-backoff-and-jitter/
+	d := t.Opts.BaseDelay << attempt
+	if d <= 0 || (t.Opts.MaxDelay > 0 && d > t.Opts.MaxDelay) {
+		d = t.Opts.MaxDelay
+	}
+	if d <= 0 {
+		return 0, true
+	}
+	return rand.N(d) + 1, true
+}
+
+// parseRetryAfter は秒数か HTTP-date の Retry-After を解釈する
+func parseRetryAfter(v string) (time.Duration, bool) {
+	if v == "" {
+		return 0, false
+	}
+	if s, err := strconv.Atoi(v); err == nil {
+		return time.Duration(max(s, 0)) * time.Second, true
+	}
+	if t, err := http.ParseTime(v); err == nil {
+		return max(time.Until(t), 0), true
+	}
+	return 0, false
+}
+
+// idempotent は req を送り直せるかを返す
+func idempotent(req *http.Request) bool {
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		return false
+	}
+	return req.Body == nil || req.Body == http.NoBody
+}
+
+// retryable は一時的な失敗かを返す
+func retryable(resp *http.Response, err error) bool {
+	if err != nil {
+		// ローカルの制限は再試行しない
+		if rle := new(RateLimitError); errors.As(err, &rle) {
+			return false
+		}
+		if errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.ECONNREFUSED) ||
+			errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			return true
+		}
+		var ne net.Error
+		return errors.As(err, &ne) && ne.Timeout()
+	}
+	return slices.Contains(retryStatus, resp.StatusCode)
+}
@@ -0,0 +1,188 @@
+package fetch
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"slices"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestRetryTransport(t *testing.T) {
+	tests := []struct {
+		name         string
+		method       string
+		handler      func(w http.ResponseWriter, n int32)
+		timeout      time.Duration
+		wantErr      bool
+		wantRequests int32
+		wantStats    RetryStats
+	}{
+		{
+			name:   "success after 503",
+			method: http.MethodGet,
+			handler: func(w http.ResponseWriter, n int32) {
+				if n < 3 {
+					w.WriteHeader(http.StatusServiceUnavailable)
+				}
+			},
+			wantRequests: 3,
+			wantStats:    RetryStats{Retries: 2},
+		},
+		{
+			name:   "exhausted",
+			method: http.MethodGet,
+			handler: func(w http.ResponseWriter, n int32) {
+				w.WriteHeader(http.StatusBadGateway)
+			},
+			wantErr:      true,
+			wantRequests: 3,
+			wantStats:    RetryStats{Retries: 2, Exhausted: 1},
+		},
+		{
+			name:   "retry after",
+			method: http.MethodGet,
+			handler: func(w http.ResponseWriter, n int32) {
+				if n == 1 {
+					w.Header().Set("Retry-After", "0")
+					w.WriteHeader(http.StatusTooManyRequests)
+				}
+			},
+			wantRequests: 2,
+			wantStats:    RetryStats{Retries: 1},
+		},
+		{
+			name:   "retry after too long",
+			method: http.MethodGet,
+			handler: func(w http.ResponseWriter, n int32) {
+				w.Header().Set("Retry-After", "120")
+				w.WriteHeader(http.StatusTooManyRequests)
+			},
+			wantErr:      true,
+			wantRequests: 1,
+			wantStats:    RetryStats{Exhausted: 1},
+		},
+		{
+			name:   "connection reset",
+			method: http.MethodGet,
+			handler: func(w http.ResponseWriter, n int32) {
+				if n == 1 {
+					conn, _, _ := w.(http.Hijacker).Hijack()
+					conn.Close()
+				}
+			},
+			wantRequests: 2,
+			wantStats:    RetryStats{Retries: 1},
+		},
+		{
+			name:   "not found",
+			method: http.MethodGet,
+			handler: func(w http.ResponseWriter, n int32) {
+				w.WriteHeader(http.StatusNotFound)
+			},
+			wantErr:      true,
+			wantRequests: 1,
+		},
+		{
+			name:   "not idempotent",
+			method: http.MethodPost,
+			handler: func(w http.ResponseWriter, n int32) {
+				w.WriteHeader(http.StatusServiceUnavailable)
+			},
+			wantErr:      true,
+			wantRequests: 1,
+		},
+		{
+			name:   "deadline",
+			method: http.MethodGet,
+			handler: func(w http.ResponseWriter, n int32) {
+				w.Header().Set("Retry-After", "1")
+				w.WriteHeader(http.StatusServiceUnavailable)
+			},
+			timeout:      500 * time.Millisecond,
+			wantErr:      true,
+			wantRequests: 1,
+			wantStats:    RetryStats{Exhausted: 1},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var requests atomic.Int32
+			ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "text/html")
+				tt.handler(w, requests.Add(1))
+			}))
+			defer ts.Close()
+
+			c := mustClient(t, ClientOpts{
+				AllowPrivateIP: true,
+				Timeout:        tt.timeout,
+				Retry: &RetryOpts{
+					MaxRetries: 2,
+					BaseDelay:  time.Millisecond,
+					MaxDelay:   2 * time.Second,
+				},
+			})
+			u, _ := url.Parse(ts.URL)
+
+			_, _, err := c.NewRequest(u, WithMethod(tt.method)).GetRaw()
+			if (err != nil) != tt.wantErr {
+				t.Errorf("err = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got := requests.Load(); got != tt.wantRequests {
+				t.Errorf("requests = %d, want %d", got, tt.wantRequests)
+			}
+			if got := c.RetryStats(); got != tt.wantStats {
+				t.Errorf("RetryStats() = %+v, want %+v", got, tt.wantStats)
+			}
+		})
+	}
+}
+
+func TestClient_WithLogger(t *testing.T) {
+	var requests atomic.Int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		if requests.Add(1) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer ts.Close()
+
+	var buf bytes.Buffer
+	logger := slog.New(slog.NewJSONHandler(&buf, &slog.HandlerOptions{Level: slog.LevelDebug}))
+	c := mustClient(t, ClientOpts{
+		AllowPrivateIP: true,
+		Retry:          &RetryOpts{MaxRetries: 1, BaseDelay: time.Millisecond},
+	}).WithLogger(logger.With("request_id", "abc"))
+	u, _ := url.Parse(ts.URL)
+
+	if _, err := c.NewRequest(u).Do(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Transport の再試行のログにも request_id が付く
+	var msgs []string
+	dec := json.NewDecoder(&buf)
+	for dec.More() {
+		var v struct {
+			Msg       string `json:"msg"`
+			RequestID string `json:"request_id"`
+		}
+		if err := dec.Decode(&v); err != nil {
+			t.Fatal(err)
+		}
+		if v.RequestID != "abc" {
+			t.Errorf("%s: request_id = %q, want abc", v.Msg, v.RequestID)
+		}
+		msgs = append(msgs, v.Msg)
+	}
+	if want := []string{"retry", "fetch"}; !slices.Equal(msgs, want) {
+		t.Errorf("logs = %v, want %v", msgs, want)
+	}
+}
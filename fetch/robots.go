@@ -0,0 +1,305 @@
+package fetch
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RobotsOpts は robots.txt の扱い
+type RobotsOpts struct {
+	// Agent は robots.txt の User-agent と照合するトークン (SummalyBot など)
+	Agent string
+	// Exempt のホストは robots.txt を確認しない
+	//
+	// User-Agent に Agent を含まないリクエストも確認しない
+	Exempt []string
+	// TTL の間 robots.txt の内容をキャッシュする。0 は24時間
+	TTL time.Duration
+}
+
+// RobotsError は robots.txt により拒否されたことを示す
+type RobotsError struct {
+	URL string
+}
+
+func (e *RobotsError) Error() string {
+	return fmt.Sprintf("disallowed by robots.txt: %s", e.URL)
+}
+
+// RobotsTransport は robots.txt で拒否された URL へのリクエストを送らない http.RoundTripper
+//
+// robots.txt はオリジンごとに Transport 経由で取得する
+// https://www.rfc-editor.org/rfc/rfc9309.html
+type RobotsTransport struct {
+	Transport http.RoundTripper
+	Opts      RobotsOpts
+
+	mu      sync.Mutex
+	origins map[string]*robotsEntry
+}
+
+type robotsEntry struct {
+	ready   chan struct{} // 取得が終わったら close する
+	rules   []robotsRule
+	err     error
+	expires time.Time
+}
+
+type robotsRule struct {
+	allow   bool
+	pattern string
+}
+
+const (
+	// オリジンがこの数を超えたら期限切れのものを掃除する
+	robotsSweepSize = 1024
+	// 取得できなかったときは短い間だけキャッシュする
+	robotsErrorTTL = time.Minute
+	// RFC 9309 2.5 少なくとも 500KiB は読む
+	robotsMaxSize = 500 << 10
+	robotsTimeout = 10 * time.Second
+)
+
+// disallowAll は robots.txt が取得できなかったときのルール
+var disallowAll = []robotsRule{{allow: false, pattern: "/"}}
+
+func (t *RobotsTransport) transport() http.RoundTripper {
+	if t.Transport == nil {
+		return http.DefaultTransport
+	}
+	return t.Transport
+}
+
+func (t *RobotsTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.URL.Path == "/robots.txt" || slices.Contains(t.Opts.Exempt, req.URL.Hostname()) ||
+		!strings.Contains(strings.ToLower(req.Header.Get("User-Agent")), strings.ToLower(t.Opts.Agent)) {
+		return t.transport().RoundTrip(req)
+	}
+
+	rules, err := t.rules(req)
+	if err != nil {
+		return nil, err
+	}
+	if !robotsAllowed(rules, robotsPath(req.URL)) {
+		return nil, &RobotsError{URL: req.URL.String()}
+	}
+	return t.transport().RoundTrip(req)
+}
+
+// rules は req のオリジンの robots.txt のルールを返す
+//
+// 同じオリジンへの同時リクエストでは1度だけ取得する
+func (t *RobotsTransport) rules(req *http.Request) ([]robotsRule, error) {
+	origin := req.URL.Scheme + "://" + req.URL.Host
+	now := time.Now()
+
+	t.mu.Lock()
+	if t.origins == nil {
+		t.origins = make(map[string]*robotsEntry)
+	}
+	e, ok := t.origins[origin]
+	if ok {
+		select {
+		case <-e.ready:
+			if now.After(e.expires) {
+				ok = false
+			}
+		default:
+			// 取得中
+		}
+	}
+	if ok {
+		t.mu.Unlock()
+		<-e.ready
+		return e.rules, e.err
+	}
+
+	if len(t.origins) > robotsSweepSize {
+		for k, v := range t.origins {
+			select {
+			case <-v.ready:
+				if now.After(v.expires) {
+					delete(t.origins, k)
+				}
+			default:
+			}
+		}
+	}
+	e = &robotsEntry{ready: make(chan struct{})}
+	t.origins[origin] = e
+	t.mu.Unlock()
+
+	rules, ttl, err := t.fetch(req, origin)
+	e.rules, e.err = rules, err
+	e.expires = time.Now().Add(ttl)
+	close(e.ready)
+	return rules, err
+}
+
+// fetch は robots.txt を取得してルールとキャッシュする期間を返す
+//
+// 4xx は制限なし、5xx や取得できなかったときはすべて拒否として扱う
+// ローカルの RateLimitError, BreakerError だけはキャッシュせずにそのまま返す
+func (t *RobotsTransport) fetch(req *http.Request, origin string) ([]robotsRule, time.Duration, error) {
+	ttl := t.Opts.TTL
+	if ttl <= 0 {
+		ttl = 24 * time.Hour
+	}
+
+	// 最初に待っているリクエストがキャンセルされても他は待っているので切り離す
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(req.Context()), robotsTimeout)
+	defer cancel()
+
+	r, err := http.NewRequestWithContext(ctx, http.MethodGet, origin+"/robots.txt", nil)
+	if err != nil {
+		return disallowAll, robotsErrorTTL, nil
+	}
+	r.Header.Set("User-Agent", req.Header.Get("User-Agent"))
+	r.Header.Set("Accept", "text/plain")
+
+	// リダイレクトは http.Client に任せる
+	resp, err := (&http.Client{Transport: t.transport()}).Do(r)
+	if rle, be := new(RateLimitError), new(BreakerError); errors.As(err, &rle) || errors.As(err, &be) {
+		return nil, 0, err
+	}
+	if err != nil {
+		return disallowAll, robotsErrorTTL, nil
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode < 300:
+	case resp.StatusCode == http.StatusTooManyRequests, resp.StatusCode >= 500:
+		return disallowAll, robotsErrorTTL, nil
+	case resp.StatusCode >= 400:
+		return nil, ttl, nil
+	default:
+		return disallowAll, robotsErrorTTL, nil
+	}
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, robotsMaxSize))
+	if err != nil {
+		return disallowAll, robotsErrorTTL, nil
+	}
+	return parseRobots(body, t.Opts.Agent), ttl, nil
+}
+
+// parseRobots は agent に適用されるルールを返す
+//
+// agent に一致するグループがなければ * のグループを使う
+func parseRobots(data []byte, agent string) []robotsRule {
+	agent = strings.ToLower(agent)
+
+	var matched, wildcard []robotsRule
+	var agents []string
+	found := false   // agent のグループがあるか
+	inRules := false // 直前の行がルールなら次の user-agent で新しいグループ
+
+	s := bufio.NewScanner(bytes.NewReader(data))
+	s.Buffer(nil, robotsMaxSize)
+	for s.Scan() {
+		line, _, _ := strings.Cut(s.Text(), "#")
+		key, value, ok := strings.Cut(line, ":")
+		if !ok {
+			continue
+		}
+		key = strings.ToLower(strings.TrimSpace(key))
+		value = strings.TrimSpace(value)
+
+		switch key {
+		case "user-agent":
+			if inRules {
+				agents = nil
+				inRules = false
+			}
+			value = strings.ToLower(value)
+			agents = append(agents, value)
+			if value == agent {
+				found = true
+			}
+		case "allow", "disallow":
+			inRules = true
+			if value == "" {
+				// 空の disallow は何も拒否しない
+				continue
+			}
+			rule := robotsRule{allow: key == "allow", pattern: value}
+			if slices.Contains(agents, agent) {
+				matched = append(matched, rule)
+			}
+			if slices.Contains(agents, "*") {
+				wildcard = append(wildcard, rule)
+			}
+		}
+	}
+
+	// 一致するグループがあればルールが空でもそれを使う
+	if found {
+		return matched
+	}
+	return wildcard
+}
+
+// robotsPath は u のパスとクエリを返す
+func robotsPath(u *url.URL) string {
+	p := u.EscapedPath()
+	if p == "" {
+		p = "/"
+	}
+	if u.RawQuery != "" {
+		p += "?" + u.RawQuery
+	}
+	return p
+}
+
+// robotsAllowed は path に最も長く一致するルールで判定する
+//
+// 同じ長さなら allow を優先し、一致するものがなければ許可する
+func robotsAllowed(rules []robotsRule, path string) bool {
+	allowed, length := true, -1
+	for _, r := range rules {
+		if !matchRobots(r.pattern, path) {
+			continue
+		}
+		if l := len(r.pattern); l > length || (l == length && r.allow) {
+			allowed, length = r.allow, l
+		}
+	}
+	return allowed
+}
+
+// matchRobots は * と末尾の $ を解釈して pattern が path に一致するかを返す
+func matchRobots(pattern, path string) bool {
+	pattern, anchored := strings.CutSuffix(pattern, "$")
+	parts := strings.Split(pattern, "*")
+
+	rest, ok := strings.CutPrefix(path, parts[0])
+	if !ok {
+		return false
+	}
+	if len(parts) == 1 {
+		return !anchored || rest == ""
+	}
+	for _, p := range parts[1 : len(parts)-1] {
+		i := strings.Index(rest, p)
+		if i < 0 {
+			return false
+		}
+		rest = rest[i+len(p):]
+	}
+	last := parts[len(parts)-1]
+	if anchored {
+		return strings.HasSuffix(rest, last)
+	}
+	return strings.Contains(rest, last)
+}
@@ -0,0 +1,112 @@
+package fetch
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
+	"testing"
+)
+
+func TestRobotsAllowed(t *testing.T) {
+	robots := `# comment
+User-agent: *
+Disallow: /private
+Allow: /private/public$
+
+User-agent: OtherBot
+User-agent: SummalyBot
+Disallow: /*.pdf$
+Disallow: /search?
+Allow: /search?q=ok
+Disallow: /tmp/ # trailing comment
+
+User-agent: EmptyBot
+Disallow:
+`
+	tests := []struct {
+		name  string
+		agent string
+		path  string
+		want  bool
+	}{
+		{"wildcard disallow", "AnyBot", "/private/a", false},
+		{"wildcard allow anchored", "AnyBot", "/private/public", true},
+		{"wildcard allow anchored mismatch", "AnyBot", "/private/public/a", false},
+		{"wildcard no match", "AnyBot", "/pdf", true},
+		{"agent group ignores wildcard", "SummalyBot", "/private/a", true},
+		{"agent case insensitive", "summalybot", "/a.pdf", false},
+		{"agent pattern", "SummalyBot", "/a.pdf", false},
+		{"agent pattern anchored", "SummalyBot", "/a.pdf?x", true},
+		{"agent query", "SummalyBot", "/search?q=x", false},
+		{"agent longer allow", "SummalyBot", "/search?q=ok", true},
+		{"agent comment stripped", "SummalyBot", "/tmp/a", false},
+		{"shared group", "OtherBot", "/tmp/a", false},
+		{"empty disallow", "EmptyBot", "/private/a", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rules := parseRobots([]byte(robots), tt.agent)
+			if got := robotsAllowed(rules, tt.path); got != tt.want {
+				t.Errorf("robotsAllowed(%q) = %v, want %v", tt.path, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRobotsTransport(t *testing.T) {
+	tests := []struct {
+		name    string
+		status  int
+		robots  string
+		path    string
+		exempt  bool
+		wantErr bool
+	}{
+		{"allowed", http.StatusOK, "User-agent: SummalyBot\nDisallow: /private\n", "/public", false, false},
+		{"disallowed", http.StatusOK, "User-agent: SummalyBot\nDisallow: /private\n", "/private", false, true},
+		{"exempt", http.StatusOK, "User-agent: SummalyBot\nDisallow: /\n", "/private", true, false},
+		{"not found", http.StatusNotFound, "", "/private", false, false},
+		{"server error", http.StatusInternalServerError, "", "/public", false, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var robotsRequests atomic.Int32
+			ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.URL.Path == "/robots.txt" {
+					robotsRequests.Add(1)
+					w.WriteHeader(tt.status)
+					w.Write([]byte(tt.robots))
+					return
+				}
+				w.Header().Set("Content-Type", "text/html")
+			}))
+			defer ts.Close()
+
+			u, _ := url.Parse(ts.URL + tt.path)
+			opts := &RobotsOpts{Agent: "SummalyBot"}
+			if tt.exempt {
+				opts.Exempt = []string{u.Hostname()}
+			}
+			c := mustClient(t, ClientOpts{AllowPrivateIP: true, Robots: opts})
+
+			for range 2 {
+				_, err := c.NewRequest(u).Do()
+				if re := new(RobotsError); errors.As(err, &re) != tt.wantErr {
+					t.Fatalf("err = %v, wantErr %v", err, tt.wantErr)
+				} else if err != nil && !tt.wantErr {
+					t.Fatal(err)
+				}
+			}
+
+			want := int32(1)
+			if tt.exempt {
+				want = 0
+			}
+			if got := robotsRequests.Load(); got != want {
+				t.Errorf("robots.txt requests = %d, want %d", got, want)
+			}
+		})
+	}
+}
@@ -0,0 +1,346 @@
+package fetch
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/netip"
+	"strings"
+	"time"
+
+	"code.dny.dev/ssrf"
+)
+
+// SSRFPolicy は接続先の制限
+//
+// 拒否するホスト、許可するホスト、許可する IP、拒否する IP の順に確認する
+type SSRFPolicy struct {
+	// DenyPrefixes は既定に加えて拒否する IP の範囲
+	DenyPrefixes []netip.Prefix
+	// AllowPrefixes は既定で拒否される範囲でも許可する IP の範囲 (社内 wiki など)
+	AllowPrefixes []netip.Prefix
+	// AllowHosts のホストは IP を確認しない。 "*.example.com" でサブドメインにも適用する
+	AllowHosts []string
+	// DenyHosts のホストには接続しない。 "*.example.com" でサブドメインにも適用する
+	DenyHosts []string
+}
+
+// DeniedHostError は SSRFPolicy.DenyHosts により接続しなかったことを示す
+type DeniedHostError struct {
+	Host string
+}
+
+func (e *DeniedHostError) Error() string {
+	return fmt.Sprintf("denied host: %s", e.Host)
+}
+
+// iana-ipv4/6-special-registry に記載のあるものを一律拒否
+// TODO: 不要なものがあるかも
+// Default:
+// https://github.com/daenney/ssrf/blob/main/ssrf_gen.go
+var (
+	deniedV4Prefixes = []netip.Prefix{
+		// https://www.iana.org/assignments/iana-ipv4-special-registry/iana-ipv4-special-registry.xhtml
+		netip.MustParsePrefix("0.0.0.0/32"),         // "This host on this network" (RFC 1122, Section 3.2.1.3)
+		netip.MustParsePrefix("192.0.0.0/29"),       // IPv4 Service Continuity Prefix (RFC 7335)
+		netip.MustParsePrefix("192.0.0.8/32"),       // IPv4 dummy address (RFC 7600)
+		netip.MustParsePrefix("192.0.0.9/32"),       // Port Control Protocol Anycast (RFC 7723)
+		netip.MustParsePrefix("192.0.0.10/32"),      // Traversal Using Relays around NAT Anycast (RFC 8155)
+		netip.MustParsePrefix("192.0.0.170/32"),     // NAT64/DNS64 Discovery (RFC 8880, RFC 7050, Section 2.2)
+		netip.MustParsePrefix("192.0.0.171/32"),     // NAT64/DNS64 Discovery (RFC 8880, RFC 7050, Section 2.2)
+		netip.MustParsePrefix("192.0.2.0/24"),       // Documentation (TEST-NET-1) (RFC 5737)
+		netip.MustParsePrefix("255.255.255.255/32"), // Limited Broadcast (RFC 8190, RFC 919, Section 7)
+	}
+	deniedV6Prefixes = []netip.Prefix{
+		// https://www.iana.org/assignments/iana-ipv6-special-registry/iana-ipv6-special-registry.xhtml
+		netip.MustParsePrefix("::1/128"),         // Loopback Address (RFC 4291)
+		netip.MustParsePrefix("::/128"),          // Unspecified Address (RFC 4291)
+		netip.MustParsePrefix("::ffff:0:0/96"),   // IPv4-mapped Address (RFC 4291)
+		ssrf.IPv6NAT64Prefix,                     // IPv4-IPv6 Translat. (RFC 6052)
+		netip.MustParsePrefix("64:ff9b:1::/48"),  // IPv4-IPv6 Translat. (RFC 8215)
+		netip.MustParsePrefix("100::/64"),        // Discard-Only Address Block (RFC 6666)
+		netip.MustParsePrefix("2001::/32"),       // TEREDO (RFC4380, RFC8190)
+		netip.MustParsePrefix("2001:1::1/128"),   // Port Control Protocol Anycast (RFC 7723)
+		netip.MustParsePrefix("2001:1::2/128"),   // Traversal Using Relays around NAT Anycast (RFC 8155)
+		netip.MustParsePrefix("2001:1::3/128"),   // DNS-SD Service Registration Protocol Anycast Address (RFC-ietf-dnssd-srp-25)
+		netip.MustParsePrefix("2001:2::/48"),     // Benchmarking (RFC 5180, RFC Errata 1752)
+		netip.MustParsePrefix("2001:3::/32"),     // AMT (RFC 7450)
+		netip.MustParsePrefix("2001:4:112::/48"), // AS112-v6 (RFC 7535)
+		netip.MustParsePrefix("2001:10::/28"),    // Deprecated (previously ORCHID) (RFC 4843)
+		netip.MustParsePrefix("2001:20::/28"),    // ORCHIDv2 (RFC 7343)
+		netip.MustParsePrefix("2001:30::/28"),    // Drone Remote ID Protocol Entity Tags (DETs) Prefix (RFC 9374)
+		netip.MustParsePrefix("5f00::/16"),       // Segment Routing (SRv6) SIDs (RFC-ietf-6man-sids-06)
+		netip.MustParsePrefix("fc00::/7"),        // Unique-Local (RFC 4193, RFC 8190)
+		netip.MustParsePrefix("fe80::/10"),       // Link-Local Unicast (RFC 4291)
+		// https://www.rfc-editor.org/rfc/rfc4291.html
+		netip.MustParsePrefix("ff00::/8"), // Multicast
+	}
+)
+
+type ssrfPolicy struct {
+	guard      *ssrf.Guardian // nil は IP を確認しない
+	resolver   *dnsResolver
+	allowHosts map[string]bool
+	denyHosts  map[string]bool
+}
+
+// newSSRFPolicy は p から *ssrfPolicy を作る
+//
+// checkIP が false なら IP は確認せず、ホストの規則だけを使う
+func newSSRFPolicy(p SSRFPolicy, checkIP bool, resolver *dnsResolver) *ssrfPolicy {
+	policy := &ssrfPolicy{
+		resolver:   resolver,
+		allowHosts: make(map[string]bool, len(p.AllowHosts)),
+		denyHosts:  make(map[string]bool, len(p.DenyHosts)),
+	}
+	for _, h := range p.AllowHosts {
+		policy.allowHosts[strings.ToLower(h)] = true
+	}
+	for _, h := range p.DenyHosts {
+		policy.denyHosts[strings.ToLower(h)] = true
+	}
+	if checkIP {
+		policy.guard = newGuardian(p)
+	}
+	return policy
+}
+
+// newGuardian は SSRF を防ぐために接続先を確認する *ssrf.Guardian を返す
+func newGuardian(p SSRFPolicy) *ssrf.Guardian {
+	denyV4, denyV6 := splitPrefixes(p.DenyPrefixes)
+	allowV4, allowV6 := splitPrefixes(p.AllowPrefixes)
+	return ssrf.New(
+		ssrf.WithDeniedV4Prefixes(append(denyV4, deniedV4Prefixes...)...),
+		ssrf.WithDeniedV6Prefixes(append(denyV6, deniedV6Prefixes...)...),
+		ssrf.WithAllowedV4Prefixes(allowV4...),
+		ssrf.WithAllowedV6Prefixes(allowV6...),
+	)
+}
+
+// splitPrefixes は prefixes を IPv4 と IPv6 に分ける
+func splitPrefixes(prefixes []netip.Prefix) (v4, v6 []netip.Prefix) {
+	for _, p := range prefixes {
+		if p.Addr().Is4() {
+			v4 = append(v4, p)
+		} else {
+			v6 = append(v6, p)
+		}
+	}
+	return v4, v6
+}
+
+// checkHost は host に接続してよいかと、 IP の確認を省けるかを返す
+func (p *ssrfPolicy) checkHost(host string) (skipIP bool, err error) {
+	host = strings.ToLower(host)
+	if _, ok := matchHost(p.denyHosts, host); ok {
+		return false, &DeniedHostError{Host: host}
+	}
+	_, ok := matchHost(p.allowHosts, host)
+	return ok || p.guard == nil, nil
+}
+
+// dialContext はホストの規則を確認してから d で接続する
+//
+// 名前解決は resolver で行い、 IP は net.Dialer.Control で確認する
+// context に pins があれば最初に接続できた IP をそのホストに固定する
+func (p *ssrfPolicy) dialContext(d *net.Dialer) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	guarded := *d
+	if p.guard != nil {
+		guarded.Control = p.guard.Safe
+	}
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		host, port, err := net.SplitHostPort(addr)
+		if err != nil {
+			return nil, err
+		}
+		skipIP, err := p.checkHost(host)
+		if err != nil {
+			return nil, err
+		}
+		dialer := &guarded
+		if skipIP {
+			dialer = d
+		}
+		if _, err := netip.ParseAddr(host); err == nil {
+			return dialer.DialContext(ctx, network, addr)
+		}
+
+		ips, err := p.lookup(ctx, host)
+		if err != nil {
+			return nil, err
+		}
+		var primary, fallback []netip.Addr
+		for _, ip := range ips {
+			switch {
+			case (network == "tcp4" && !ip.Is4()) || (network == "tcp6" && !ip.Is6()):
+			case len(primary) == 0 || ip.Is4() == primary[0].Is4():
+				primary = append(primary, ip)
+			default:
+				fallback = append(fallback, ip)
+			}
+		}
+		if len(primary) == 0 {
+			return nil, fmt.Errorf("no addresses for %s: %s", network, host)
+		}
+		conn, ip, err := dialParallel(ctx, dialer.DialContext, network, port, primary, fallback, fallbackDelay(dialer))
+		if err != nil {
+			return nil, err
+		}
+		pinsFrom(ctx).set(host, ip)
+		return conn, nil
+	}
+}
+
+type dialFunc func(ctx context.Context, network, addr string) (net.Conn, error)
+
+// fallbackDelay は net.Dialer.FallbackDelay と同じく、もう一方の IP の種類を試すまでの時間を返す
+func fallbackDelay(d *net.Dialer) time.Duration {
+	if d.FallbackDelay == 0 {
+		return 300 * time.Millisecond
+	}
+	return d.FallbackDelay
+}
+
+// dialParallel は net.Dialer の Happy Eyeballs (RFC 6555) と同じように、
+// primary を delay だけ先に始め、失敗するか delay が過ぎたら fallback も試して先に接続できたものを返す
+//
+// IPv6 に経路がないホストなどで、 primary の接続がタイムアウトするまで待たないようにする
+func dialParallel(ctx context.Context, dial dialFunc, network, port string, primary, fallback []netip.Addr, delay time.Duration) (net.Conn, netip.Addr, error) {
+	if len(fallback) == 0 || delay < 0 {
+		return dialSerial(ctx, dial, network, port, append(primary, fallback...))
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	type result struct {
+		conn net.Conn
+		ip   netip.Addr
+		err  error
+	}
+	results := make(chan result, 2)
+	start := func(ips []netip.Addr) {
+		go func() {
+			conn, ip, err := dialSerial(ctx, dial, network, port, ips)
+			results <- result{conn, ip, err}
+		}()
+	}
+	start(primary)
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	var firstErr error
+	pending, fallbackStarted := 1, false
+	for {
+		select {
+		case <-timer.C:
+			if !fallbackStarted {
+				fallbackStarted = true
+				pending++
+				start(fallback)
+			}
+		case r := <-results:
+			pending--
+			if r.err == nil {
+				if pending > 0 {
+					// 後から接続できたものは閉じる
+					go func() {
+						if r := <-results; r.conn != nil {
+							r.conn.Close()
+						}
+					}()
+				}
+				return r.conn, r.ip, nil
+			}
+			if firstErr == nil {
+				firstErr = r.err
+			}
+			if !fallbackStarted {
+				fallbackStarted = true
+				pending++
+				start(fallback)
+			} else if pending == 0 {
+				return nil, netip.Addr{}, firstErr
+			}
+		}
+	}
+}
+
+// dialSerial は ips に順に接続する
+//
+// net.Dialer と同じく残りの時間を残りの IP で分け、1つの IP で時間を使い切らないようにする
+func dialSerial(ctx context.Context, dial dialFunc, network, port string, ips []netip.Addr) (net.Conn, netip.Addr, error) {
+	var firstErr error
+	for i, ip := range ips {
+		dctx := ctx
+		if deadline, ok := ctx.Deadline(); ok && i < len(ips)-1 {
+			var cancel context.CancelFunc
+			dctx, cancel = context.WithDeadline(ctx, partialDeadline(deadline, len(ips)-i))
+			defer cancel()
+		}
+		conn, err := dial(dctx, network, net.JoinHostPort(ip.String(), port))
+		if err == nil {
+			return conn, ip, nil
+		}
+		if firstErr == nil {
+			firstErr = err
+		}
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	return nil, netip.Addr{}, firstErr
+}
+
+// partialDeadline は deadline までの時間を remaining 個の IP で分けたときの1つ目の期限を返す
+func partialDeadline(deadline time.Time, remaining int) time.Time {
+	const minTimeout = 2 * time.Second
+	left := time.Until(deadline)
+	timeout := left / time.Duration(remaining)
+	if timeout < minTimeout {
+		timeout = min(minTimeout, left)
+	}
+	return time.Now().Add(timeout)
+}
+
+// lookup は host の IP を返す。固定されていればその IP だけを返す
+func (p *ssrfPolicy) lookup(ctx context.Context, host string) ([]netip.Addr, error) {
+	if ip, ok := pinsFrom(ctx).get(host); ok {
+		return []netip.Addr{ip}, nil
+	}
+	return p.resolver.lookup(ctx, host)
+}
+
+// resolve は addr を名前解決してすべての IP を確認し、最初の IP の host:port を返す
+//
+// IP を確認しない場合は addr をそのまま返す
+func (p *ssrfPolicy) resolve(ctx context.Context, addr string) (string, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "", err
+	}
+	skipIP, err := p.checkHost(host)
+	if err != nil {
+		return "", err
+	}
+	if skipIP {
+		return addr, nil
+	}
+
+	ips := []netip.Addr{}
+	if ip, err := netip.ParseAddr(host); err == nil {
+		ips = append(ips, ip.Unmap())
+	} else if ips, err = p.lookup(ctx, host); err != nil {
+		return "", err
+	}
+	for _, ip := range ips {
+		network := "tcp4"
+		if ip.Is6() {
+			network = "tcp6"
+		}
+		if err := p.guard.Safe(network, net.JoinHostPort(ip.String(), port), nil); err != nil {
+			return "", err
+		}
+	}
+	pinsFrom(ctx).set(host, ips[0])
+	return net.JoinHostPort(ips[0].String(), port), nil
+}
@@ -0,0 +1,246 @@
+package fetch
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"net/url"
+	"testing"
+	"time"
+
+	"code.dny.dev/ssrf"
+)
+
+func TestSSRFPolicy_Resolve(t *testing.T) {
+	prefixes := func(s ...string) []netip.Prefix {
+		var p []netip.Prefix
+		for _, v := range s {
+			p = append(p, netip.MustParsePrefix(v))
+		}
+		return p
+	}
+
+	tests := []struct {
+		name    string
+		policy  SSRFPolicy
+		checkIP bool
+		addr    string
+		want    string
+		wantErr error
+	}{
+		// 既定
+		{name: "public v4", checkIP: true, addr: "93.184.215.14:443", want: "93.184.215.14:443"},
+		{name: "public v6", checkIP: true, addr: "[2606:2800:21f:cb07:6820:80da:af6b:8b2c]:443", want: "[2606:2800:21f:cb07:6820:80da:af6b:8b2c]:443"},
+		{name: "loopback", checkIP: true, addr: "127.0.0.1:80", wantErr: ssrf.ErrProhibitedIP},
+		{name: "private", checkIP: true, addr: "10.0.0.1:80", wantErr: ssrf.ErrProhibitedIP},
+		{name: "loopback v6", checkIP: true, addr: "[::1]:443", wantErr: ssrf.ErrProhibitedIP},
+		{name: "port", checkIP: true, addr: "93.184.215.14:22", wantErr: ssrf.ErrProhibitedPort},
+		// DenyPrefixes
+		{
+			name:    "deny prefix v4",
+			policy:  SSRFPolicy{DenyPrefixes: prefixes("93.184.0.0/16")},
+			checkIP: true,
+			addr:    "93.184.215.14:443",
+			wantErr: ssrf.ErrProhibitedIP,
+		},
+		{
+			name:    "deny prefix v6",
+			policy:  SSRFPolicy{DenyPrefixes: prefixes("2606:2800::/32")},
+			checkIP: true,
+			addr:    "[2606:2800:21f:cb07:6820:80da:af6b:8b2c]:443",
+			wantErr: ssrf.ErrProhibitedIP,
+		},
+		{
+			name:    "deny prefix other",
+			policy:  SSRFPolicy{DenyPrefixes: prefixes("93.184.0.0/16")},
+			checkIP: true,
+			addr:    "1.1.1.1:443",
+			want:    "1.1.1.1:443",
+		},
+		// AllowPrefixes
+		{
+			name:    "allow prefix v4",
+			policy:  SSRFPolicy{AllowPrefixes: prefixes("10.0.0.0/8")},
+			checkIP: true,
+			addr:    "10.1.2.3:80",
+			want:    "10.1.2.3:80",
+		},
+		{
+			name:    "allow prefix v6",
+			policy:  SSRFPolicy{AllowPrefixes: prefixes("fd00::/8")},
+			checkIP: true,
+			addr:    "[fd00::1]:443",
+			want:    "[fd00::1]:443",
+		},
+		{
+			name:    "allow prefix other",
+			policy:  SSRFPolicy{AllowPrefixes: prefixes("10.0.0.0/8")},
+			checkIP: true,
+			addr:    "192.168.0.1:80",
+			wantErr: ssrf.ErrProhibitedIP,
+		},
+		// AllowHosts
+		{
+			name:    "allow host",
+			policy:  SSRFPolicy{AllowHosts: []string{"wiki.internal"}},
+			checkIP: true,
+			addr:    "wiki.internal:8080",
+			want:    "wiki.internal:8080",
+		},
+		{
+			name:    "allow host wildcard",
+			policy:  SSRFPolicy{AllowHosts: []string{"*.internal"}},
+			checkIP: true,
+			addr:    "WIKI.internal:80",
+			want:    "WIKI.internal:80",
+		},
+		// DenyHosts
+		{
+			name:    "deny host",
+			policy:  SSRFPolicy{DenyHosts: []string{"example.com"}},
+			checkIP: true,
+			addr:    "example.com:443",
+			wantErr: &DeniedHostError{},
+		},
+		{
+			name:    "deny host wildcard",
+			policy:  SSRFPolicy{DenyHosts: []string{"*.example.com"}},
+			checkIP: true,
+			addr:    "www.example.com:443",
+			wantErr: &DeniedHostError{},
+		},
+		{
+			name:    "deny host over allow host",
+			policy:  SSRFPolicy{AllowHosts: []string{"*.example.com"}, DenyHosts: []string{"www.example.com"}},
+			checkIP: true,
+			addr:    "www.example.com:443",
+			wantErr: &DeniedHostError{},
+		},
+		// AllowPrivateIP
+		{name: "private allowed", addr: "127.0.0.1:8080", want: "127.0.0.1:8080"},
+		{
+			name:    "deny host with private allowed",
+			policy:  SSRFPolicy{DenyHosts: []string{"127.0.0.1"}},
+			addr:    "127.0.0.1:8080",
+			wantErr: &DeniedHostError{},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := newSSRFPolicy(tt.policy, tt.checkIP, newDNSResolver(nil))
+			got, err := p.resolve(context.Background(), tt.addr)
+			switch want := tt.wantErr.(type) {
+			case nil:
+				if err != nil {
+					t.Fatalf("err = %v, want nil", err)
+				}
+			case *DeniedHostError:
+				if !errors.As(err, &want) {
+					t.Fatalf("err = %v, want DeniedHostError", err)
+				}
+			default:
+				if !errors.Is(err, want) {
+					t.Fatalf("err = %v, want %v", err, want)
+				}
+			}
+			if got != tt.want {
+				t.Errorf("resolve() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNewClient_SSRF(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+	}))
+	defer ts.Close()
+	u, _ := url.Parse(ts.URL)
+
+	tests := []struct {
+		name           string
+		allowPrivateIP bool
+		policy         SSRFPolicy
+		wantErr        bool
+	}{
+		{name: "denied", wantErr: true},
+		{name: "allow host", policy: SSRFPolicy{AllowHosts: []string{"127.0.0.1"}}},
+		{name: "private allowed", allowPrivateIP: true},
+		{name: "deny host", allowPrivateIP: true, policy: SSRFPolicy{DenyHosts: []string{"127.0.0.1"}}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := mustClient(t, ClientOpts{
+				AllowPrivateIP: tt.allowPrivateIP,
+				Timeout:        time.Second,
+				SSRF:           tt.policy,
+			})
+			if c.HTTPClient.Timeout != time.Second {
+				t.Errorf("Timeout = %s, want %s", c.HTTPClient.Timeout, time.Second)
+			}
+			_, err := c.NewRequest(u).Do()
+			if (err != nil) != tt.wantErr {
+				t.Errorf("err = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestDialParallel(t *testing.T) {
+	v6, v4 := netip.MustParseAddr("2001:db8::1"), netip.MustParseAddr("192.0.2.1")
+	// never は応答しない IP 、 fail はすぐに失敗する IP
+	dial := func(never, fail netip.Addr) dialFunc {
+		return func(ctx context.Context, network, addr string) (net.Conn, error) {
+			ip := netip.MustParseAddrPort(addr).Addr()
+			switch ip {
+			case never:
+				<-ctx.Done()
+				return nil, ctx.Err()
+			case fail:
+				return nil, errors.New("connection refused")
+			}
+			c1, c2 := net.Pipe()
+			c2.Close()
+			return c1, nil
+		}
+	}
+
+	tests := []struct {
+		name    string
+		dial    dialFunc
+		delay   time.Duration
+		want    netip.Addr
+		wantErr bool
+	}{
+		{name: "primary", dial: dial(netip.Addr{}, netip.Addr{}), delay: 10 * time.Second, want: v6},
+		{name: "primary never answers", dial: dial(v6, netip.Addr{}), delay: 50 * time.Millisecond, want: v4},
+		{name: "primary fails", dial: dial(netip.Addr{}, v6), delay: 10 * time.Second, want: v4},
+		{name: "fallback fails", dial: dial(netip.Addr{}, v4), delay: 0, want: v6},
+		{name: "all fail", dial: dial(v4, v6), delay: 50 * time.Millisecond, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+			defer cancel()
+			start := time.Now()
+			conn, got, err := dialParallel(ctx, tt.dial, "tcp", "80", []netip.Addr{v6}, []netip.Addr{v4}, tt.delay)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			conn.Close()
+			if got != tt.want {
+				t.Errorf("ip = %s, want %s", got, tt.want)
+			}
+			// もう一方の接続がタイムアウトするまで待たない
+			if d := time.Since(start); d > 500*time.Millisecond {
+				t.Errorf("took %v", d)
+			}
+		})
+	}
+}
@@ -0,0 +1,42 @@
+package fetch
+
+import (
+	"io"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+var tracer = otel.Tracer("github.com/yulog/go-summaly/fetch")
+
+// bytesReadKey は Body から読んだバイト数
+const bytesReadKey = attribute.Key("summaly.bytes_read")
+
+// tracedBody は読んだバイト数を数え、 Close で span を終える
+type tracedBody struct {
+	io.ReadCloser
+	span trace.Span
+	n    int64
+}
+
+func (b *tracedBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.n += int64(n)
+	return n, err
+}
+
+func (b *tracedBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.span.SetAttributes(bytesReadKey.Int64(b.n))
+	b.span.End()
+	return err
+}
+
+// endSpan は err を記録して span を終える
+func endSpan(span trace.Span, err error) {
+	span.RecordError(err)
+	span.SetStatus(codes.Error, err.Error())
+	span.End()
+}
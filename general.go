@@ -3,7 +3,6 @@ package summaly
 import (
 	"cmp"
 	"html"
-	"log"
 	"net/url"
 	"slices"
 	"strconv"
@@ -12,13 +11,14 @@ import (
 	"github.com/PuerkitoBio/goquery"
 	"github.com/otiai10/opengraph/v2"
 	"github.com/yulog/go-favicon"
+	"go.opentelemetry.io/otel/attribute"
 	xhtml "golang.org/x/net/html"
 )
 
 type General struct{}
 
-func (*General) test() bool {
-	return true
+func (*General) test(s *Summaly) bool {
+	return s.Node != nil
 }
 
 func (*General) summarize(s *Summaly) (Summary, error) {
@@ -34,17 +34,32 @@ func (*General) summarize(s *Summaly) (Summary, error) {
 	var m = &info{}
 	m.walk(s.Node)
 
+	var manifest *Manifest
+	if m.Manifest != "" {
+		manifest, err = GetManifest(s.Client, s.URL, m.Manifest, s.UserAgent)
+		if err != nil {
+			// manifestが取得できなくてもエラーにしない
+			s.Logger.Warn("manifest", "err", err)
+		}
+	}
+
 	title := cmp.Or(ogp.Title, m.Twitter.Title, m.Title)
 	title = Clip(html.UnescapeString(title), 100)
 
+	iconCtx, iconSpan := tracer.Start(s.Context, "icon")
 	icons, err := favicon.New(favicon.NopSort, favicon.IgnoreWellKnown).FindGoQueryDocument(doc, s.URL.String())
 	if err != nil {
 		// iconが取得できなくてもエラーにしない
-		log.Println(err)
+		s.Logger.Warn("icon", "err", err)
+		recordError(iconSpan, err)
 	}
 	// for _, i := range icons {
 	// 	fmt.Printf("%dx%d\t%s\t%s\n", i.Width, i.Height, i.FileExt, i.URL)
 	// }
+	if len(icons) == 0 && manifest != nil {
+		// <link rel="icon"> がないときは manifest の icons を使う
+		icons = manifest.Favicons()
+	}
 	icon := ""
 	if len(icons) > 0 {
 		// sort.Slice(icons, func(i, j int) bool {
@@ -72,6 +87,15 @@ func (*General) summarize(s *Summaly) (Summary, error) {
 		// }
 		icon = icons[0].URL
 	}
+	if s.IconVerifier != nil {
+		// 実在する icon を探す。なければルートの /favicon.ico
+		icon = s.IconVerifier.Resolve(s.Client.WithContext(iconCtx), s.URL, icons, s.UserAgent)
+	}
+	iconSpan.SetAttributes(
+		attribute.Int("summaly.icon.candidates", len(icons)),
+		attribute.String("summaly.icon.url", icon),
+	)
+	iconSpan.End()
 
 	description := cmp.Or(ogp.Description, m.Twitter.Description, m.MetaInfo.Description)
 	description = Clip(html.UnescapeString(description), 300)
@@ -91,14 +115,27 @@ func (*General) summarize(s *Summaly) (Summary, error) {
 		u, err := url.Parse(image)
 		if err != nil {
 			// url.Parseできないなら空にする
-			log.Println(err)
+			s.Logger.Warn("thumbnail", "err", err)
 			image = ""
 		} else {
 			image = s.URL.ResolveReference(u).String()
 		}
 	}
 
-	sitename := cmp.Or(ogp.SiteName, m.MetaInfo.ApplicationName, s.URL.Host)
+	var thumbnailInfo *ThumbnailInfo
+	if s.Placeholder && image != "" {
+		thumbnailInfo, err = GetThumbnailInfo(s.Client, image, s.UserAgent)
+		if err != nil {
+			// placeholderが作れなくてもエラーにしない
+			s.Logger.Warn("placeholder", "err", err)
+		}
+	}
+
+	var manifestName string
+	if manifest != nil {
+		manifestName = cmp.Or(manifest.Name, manifest.ShortName)
+	}
+	sitename := cmp.Or(ogp.SiteName, m.MetaInfo.ApplicationName, manifestName, s.URL.Host)
 	sitename = html.UnescapeString(strings.TrimSpace(sitename))
 
 	title = CleanupTitle(title, sitename)
@@ -107,31 +144,37 @@ func (*General) summarize(s *Summaly) (Summary, error) {
 	// sensitive := doc.Find(".tweet").AttrOr("data-possibly-sensitive", "") == "true"
 	sensitive := cmp.Or(m.Rating.MixiContentRating == "1", m.Rating.Rating == "adult", m.Rating.Rating == "RTA-5042-1996-1400-1577-RTA")
 
+	themeColor := getThemeColor(m, manifest)
+
 	player, err := GetOembedPlayer(s.Client, doc, s.UserAgent)
 	if err != nil {
-		log.Println(err)
+		s.Logger.Debug("oembed", "err", err)
 		// oEmbedを優先、ないときにはほかを使う
 		player = getPlayer(m, ogp)
 	}
 
 	return Summary{
-		Title:       title,
-		Icon:        icon,
-		Description: description,
-		Thumbnail:   image,
-		Player:      player,
-		Sitename:    sitename,
-		Sensitive:   sensitive,
-		URL:         s.URL.String(),
+		Title:         title,
+		Icon:          icon,
+		Description:   description,
+		Thumbnail:     image,
+		ThumbnailInfo: thumbnailInfo,
+		Player:        player,
+		Sitename:      sitename,
+		Sensitive:     sensitive,
+		ThemeColor:    themeColor,
+		URL:           s.URL.String(),
 	}, nil
 }
 
 type info struct {
-	Title     string
-	MetaInfo  metaInfo
-	Twitter   twitter
-	LinkImage linkImage
-	Rating    rating
+	Title      string
+	MetaInfo   metaInfo
+	Twitter    twitter
+	LinkImage  linkImage
+	Rating     rating
+	ThemeColor themeColor
+	Manifest   string
 }
 
 type linkImage struct {
@@ -175,12 +218,17 @@ func (m *info) walk(n *xhtml.Node) {
 				m.LinkImage.AppleTouchIcon = link.Href
 			case "apple-touch-icon image_src":
 				m.LinkImage.AppleTouchIconImageSrc = link.Href
+			case "manifest":
+				if m.Manifest == "" {
+					m.Manifest = link.Href
+				}
 			}
 		case "meta":
 			meta := opengraph.MetaTag(n)
 			prop := cmp.Or(meta.Property, meta.Name)
 			if prop != "" && meta.Content != "" {
-				switch prop {
+				// name の大文字小文字は区別しない (msapplication-TileColor など)
+				switch strings.ToLower(prop) {
 				case "twitter:title":
 					if m.Twitter.Title == "" {
 						m.Twitter.Title = meta.Content
@@ -225,6 +273,12 @@ func (m *info) walk(n *xhtml.Node) {
 					if m.Rating.Rating == "" {
 						m.Rating.Rating = meta.Content
 					}
+				case "theme-color":
+					m.ThemeColor.set(meta.Content, attr(n, "media"))
+				case "msapplication-tilecolor":
+					if m.ThemeColor.Tile == "" {
+						m.ThemeColor.Tile = meta.Content
+					}
 				}
 			}
 		}
@@ -235,6 +289,58 @@ func (m *info) walk(n *xhtml.Node) {
 	}
 }
 
+// hasHeadSummary は n にタイトル (title, og:title, twitter:title) と、
+// 説明 (og:description など) か画像 (og:image など) のどちらかがあるかを返す
+func hasHeadSummary(n *xhtml.Node) bool {
+	var title, other bool
+	var walk func(*xhtml.Node) bool
+	walk = func(n *xhtml.Node) bool {
+		if n.Type == xhtml.ElementNode {
+			switch n.Data {
+			case "title":
+				if opengraph.TitleTag(n).Text != "" {
+					title = true
+				}
+			case "link":
+				switch opengraph.LinkTag(n).Rel {
+				case "image_src", "apple-touch-icon", "apple-touch-icon image_src":
+					other = true
+				}
+			case "meta":
+				meta := opengraph.MetaTag(n)
+				if meta.Content != "" {
+					switch strings.ToLower(cmp.Or(meta.Property, meta.Name)) {
+					case "og:title", "twitter:title":
+						title = true
+					case "og:description", "twitter:description", "description", "og:image", "twitter:image":
+						other = true
+					}
+				}
+			}
+			if title && other {
+				return true
+			}
+		}
+		for child := n.FirstChild; child != nil; child = child.NextSibling {
+			if walk(child) {
+				return true
+			}
+		}
+		return false
+	}
+	return walk(n)
+}
+
+// attr は n の属性 key の値を返す
+func attr(n *xhtml.Node, key string) string {
+	for _, a := range n.Attr {
+		if a.Key == key {
+			return a.Val
+		}
+	}
+	return ""
+}
+
 // getPlayer は Twitter/X, OGP の *Player を返す
 func getPlayer(m *info, ogp *opengraph.OpenGraph) *Player {
 	var playerUrl string
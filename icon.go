@@ -0,0 +1,158 @@
+package summaly
+
+import (
+	"container/list"
+	"errors"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/yulog/go-favicon"
+	"github.com/yulog/go-summaly/fetch"
+)
+
+var iconAllowType = []string{
+	"image/svg+xml",
+	"image/png",
+	"image/x-icon",
+	"image/vnd.microsoft.icon",
+	"image/jpeg",
+	"image/gif",
+	"image/webp",
+	"image/avif",
+}
+
+// IconVerifier は icon の URL が実在するかを確認する
+//
+// 確認結果は URL ごと (/favicon.ico はホストごと) に TTL の間キャッシュする
+// MaxEntries を超えたら最も使われていないものから捨てる
+// 見つからなかったことは 404, 410 のときだけキャッシュし、通信のエラーは次に確認し直す
+type IconVerifier struct {
+	TTL        time.Duration
+	MaxEntries int
+	// MaxChecks は1回の Resolve で送るリクエストの上限。0 のときは iconMaxChecks
+	MaxChecks int
+
+	mu    sync.Mutex
+	ll    *list.List
+	cache map[string]*list.Element
+}
+
+const (
+	// MaxEntries の既定値
+	iconCacheMaxEntries = 1024
+	// MaxChecks の既定値
+	iconMaxChecks = 4
+)
+
+type iconCheck struct {
+	key     string
+	ok      bool
+	expires time.Time
+}
+
+func NewIconVerifier(ttl time.Duration) *IconVerifier {
+	return &IconVerifier{
+		TTL:        ttl,
+		MaxEntries: iconCacheMaxEntries,
+		ll:         list.New(),
+		cache:      make(map[string]*list.Element),
+	}
+}
+
+// Resolve は icons を順に確認し、最初に画像を返したものの URL を返す
+//
+// icons がない、またはすべて確認できなかった場合はルートの /favicon.ico を確認する
+// キャッシュになかったものの確認が MaxChecks を超えたらそこでやめる
+func (v *IconVerifier) Resolve(client *fetch.Client, base *url.URL, icons []*favicon.Icon, ua string) string {
+	budget := v.MaxChecks
+	if budget <= 0 {
+		budget = iconMaxChecks
+	}
+	for _, i := range icons {
+		u, err := url.Parse(i.URL)
+		if err != nil {
+			continue
+		}
+		if v.check(client, u, ua, &budget) {
+			return i.URL
+		}
+	}
+
+	root := base.ResolveReference(&url.URL{Path: "/favicon.ico"})
+	if v.check(client, root, ua, &budget) {
+		return root.String()
+	}
+	return ""
+}
+
+// check は u が画像を返すかを確認する。リクエストを送ったら budget を減らす
+func (v *IconVerifier) check(client *fetch.Client, u *url.URL, ua string, budget *int) bool {
+	key := u.String()
+
+	if ok, cached := v.load(key); cached {
+		return ok
+	}
+	if *budget <= 0 {
+		return false
+	}
+	*budget--
+
+	err := client.NewRequest(u,
+		fetch.WithMethod(http.MethodHead),
+		fetch.WithAccept("image/*"),
+		fetch.WithAllowType(iconAllowType),
+		fetch.WithUserAgent(ua),
+	).Check()
+	if err != nil {
+		client.Logger().Debug("icon", "url", key, "err", err)
+	}
+
+	// タイムアウトなど一時的な失敗は覚えない
+	var status *fetch.StatusError
+	if err == nil || (errors.As(err, &status) && (status.StatusCode == http.StatusNotFound || status.StatusCode == http.StatusGone)) {
+		v.store(key, err == nil)
+	}
+	return err == nil
+}
+
+// load は key の期限内の確認結果を返す
+func (v *IconVerifier) load(key string) (ok, cached bool) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	el, found := v.cache[key]
+	if !found {
+		return false, false
+	}
+	c := el.Value.(*iconCheck)
+	if time.Now().After(c.expires) {
+		v.ll.Remove(el)
+		delete(v.cache, key)
+		return false, false
+	}
+	v.ll.MoveToFront(el)
+	return c.ok, true
+}
+
+func (v *IconVerifier) store(key string, ok bool) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	// NewIconVerifier を使わずに作られたときのため
+	if v.cache == nil {
+		v.ll = list.New()
+		v.cache = make(map[string]*list.Element)
+	}
+	c := &iconCheck{key: key, ok: ok, expires: time.Now().Add(v.TTL)}
+	if el, found := v.cache[key]; found {
+		el.Value = c
+		v.ll.MoveToFront(el)
+		return
+	}
+	v.cache[key] = v.ll.PushFront(c)
+	if v.MaxEntries > 0 && v.ll.Len() > v.MaxEntries {
+		el := v.ll.Back()
+		v.ll.Remove(el)
+		delete(v.cache, el.Value.(*iconCheck).key)
+	}
+}
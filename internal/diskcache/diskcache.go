@@ -0,0 +1,108 @@
+// Package diskcache はディスクに保存するキャッシュの掃除を扱う
+package diskcache
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"time"
+)
+
+// SweepInterval は Sweeper が Sweep する最短の間隔
+const SweepInterval = time.Minute
+
+// Sweep は dir 以下のファイルのうち maxAge より長く更新されていないものを消し、
+// 合計が maxSize バイトを超えていれば更新が古いものから消す
+//
+// maxSize, maxAge が 0 以下ならその制限はしない
+func Sweep(dir string, maxSize int64, maxAge time.Duration) error {
+	type file struct {
+		path string
+		size int64
+		mod  time.Time
+	}
+	var (
+		files []file
+		total int64
+	)
+	err := filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			// まだ作られていないか、掃除中に消されたもの
+			if errors.Is(err, fs.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+		if d.IsDir() {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return nil
+		}
+		if Expired(info.ModTime(), maxAge) {
+			os.Remove(p)
+			return nil
+		}
+		files = append(files, file{path: p, size: info.Size(), mod: info.ModTime()})
+		total += info.Size()
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if maxSize <= 0 || total <= maxSize {
+		return nil
+	}
+
+	slices.SortFunc(files, func(a, b file) int {
+		return a.mod.Compare(b.mod)
+	})
+	for _, f := range files {
+		if total <= maxSize {
+			break
+		}
+		if err := os.Remove(f.path); err == nil || errors.Is(err, fs.ErrNotExist) {
+			total -= f.size
+		}
+	}
+	return nil
+}
+
+// Expired は mod から maxAge より長く経っているかを返す。 maxAge が 0 以下なら false
+func Expired(mod time.Time, maxAge time.Duration) bool {
+	return maxAge > 0 && time.Since(mod) > maxAge
+}
+
+// Touch は p の更新時刻を今にして、 Sweep で最近使われたものとして扱わせる
+func Touch(p string) {
+	now := time.Now()
+	os.Chtimes(p, now, now)
+}
+
+// Sweeper は Sweep を SweepInterval 以上の間隔をあけてバックグラウンドで実行する
+type Sweeper struct {
+	mu      sync.Mutex
+	last    time.Time
+	running bool
+}
+
+// Trigger は前回から SweepInterval 経っていて実行中でなければ、 f を別の goroutine で実行する
+func (s *Sweeper) Trigger(f func()) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.running || time.Since(s.last) < SweepInterval {
+		return
+	}
+	s.running = true
+	go func() {
+		f()
+		s.mu.Lock()
+		s.running = false
+		s.last = time.Now()
+		s.mu.Unlock()
+	}()
+}
@@ -0,0 +1,71 @@
+package diskcache
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestSweep(t *testing.T) {
+	now := time.Now()
+	files := []struct {
+		name string
+		size int
+		age  time.Duration
+	}{
+		{"a/old", 10, 3 * time.Hour},
+		{"a/older", 10, 2 * time.Hour},
+		{"b/old", 10, time.Hour},
+		{"b/new", 10, time.Minute},
+	}
+	tests := []struct {
+		name    string
+		maxSize int64
+		maxAge  time.Duration
+		want    []string
+	}{
+		{"unlimited", 0, 0, []string{"a/old", "a/older", "b/new", "b/old"}},
+		{"max age", 0, 90 * time.Minute, []string{"b/new", "b/old"}},
+		{"max size", 25, 0, []string{"b/new", "b/old"}},
+		{"max size exact", 40, 0, []string{"a/old", "a/older", "b/new", "b/old"}},
+		{"both", 15, 150 * time.Minute, []string{"b/new"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			for _, f := range files {
+				p := filepath.Join(dir, f.name)
+				os.MkdirAll(filepath.Dir(p), 0o755)
+				if err := os.WriteFile(p, make([]byte, f.size), 0o644); err != nil {
+					t.Fatal(err)
+				}
+				os.Chtimes(p, now.Add(-f.age), now.Add(-f.age))
+			}
+
+			if err := Sweep(dir, tt.maxSize, tt.maxAge); err != nil {
+				t.Fatal(err)
+			}
+
+			var got []string
+			filepath.WalkDir(dir, func(p string, d os.DirEntry, err error) error {
+				if err == nil && !d.IsDir() {
+					rel, _ := filepath.Rel(dir, p)
+					got = append(got, filepath.ToSlash(rel))
+				}
+				return nil
+			})
+			slices.Sort(got)
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("files = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSweep_NotExist(t *testing.T) {
+	if err := Sweep(filepath.Join(t.TempDir(), "none"), 1, time.Hour); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,118 @@
+package summaly
+
+import (
+	"mime"
+	"net/url"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/yulog/go-favicon"
+	"github.com/yulog/go-summaly/fetch"
+)
+
+// https://developer.mozilla.org/en-US/docs/Web/Manifest
+type Manifest struct {
+	Name       string         `json:"name"`
+	ShortName  string         `json:"short_name"`
+	ThemeColor string         `json:"theme_color"`
+	Icons      []ManifestIcon `json:"icons"`
+
+	url *url.URL // icons の src の基準
+}
+
+type ManifestIcon struct {
+	Src     string `json:"src"`
+	Sizes   string `json:"sizes"`
+	Type    string `json:"type"`
+	Purpose string `json:"purpose"`
+}
+
+var manifestAllowType = []string{"application/manifest+json", "application/json"}
+
+// GetManifest は href の Web App Manifest を取得する
+func GetManifest(client *fetch.Client, base *url.URL, href, ua string) (*Manifest, error) {
+	u, err := url.Parse(href)
+	if err != nil {
+		return nil, err
+	}
+	u = base.ResolveReference(u)
+
+	var manifest Manifest
+	err = client.NewRequest(u,
+		fetch.WithAccept("application/manifest+json, application/json"),
+		fetch.WithAllowType(manifestAllowType),
+		fetch.WithLimit(100<<10), // 100KiB
+		fetch.WithUserAgent(ua),
+	).GetJSON(&manifest)
+	if err != nil {
+		return nil, err
+	}
+	manifest.url = u
+
+	return &manifest, nil
+}
+
+// Favicons は icons を *favicon.Icon に変換する
+//
+// src は manifest の URL を基準に解決する
+// purpose が monochrome のみのものは除外する
+func (m *Manifest) Favicons() []*favicon.Icon {
+	var icons []*favicon.Icon
+	for _, v := range m.Icons {
+		if v.Src == "" {
+			continue
+		}
+		if purpose := strings.Fields(v.Purpose); len(purpose) > 0 && !slices.ContainsFunc(purpose, func(p string) bool {
+			return p != "monochrome"
+		}) {
+			continue
+		}
+		u, err := url.Parse(v.Src)
+		if err != nil {
+			continue
+		}
+		if m.url != nil {
+			u = m.url.ResolveReference(u)
+		}
+
+		ext := strings.ToLower(strings.TrimPrefix(path.Ext(u.Path), "."))
+		mimeType := v.Type
+		if mimeType == "" && ext != "" {
+			mimeType, _, _ = mime.ParseMediaType(mime.TypeByExtension("." + ext))
+		}
+		width, height := parseIconSizes(v.Sizes)
+
+		icons = append(icons, &favicon.Icon{
+			URL:      u.String(),
+			MimeType: mimeType,
+			FileExt:  ext,
+			Width:    width,
+			Height:   height,
+		})
+	}
+	return icons
+}
+
+// parseIconSizes は sizes ("48x48 96x96" など) のうち最大のものを返す
+func parseIconSizes(sizes string) (width, height int) {
+	for _, size := range strings.Fields(strings.ToLower(sizes)) {
+		w, h, ok := strings.Cut(size, "x")
+		if !ok {
+			continue
+		}
+		wi, err := strconv.Atoi(w)
+		if err != nil {
+			continue
+		}
+		hi, err := strconv.Atoi(h)
+		if err != nil {
+			continue
+		}
+		if wi > width {
+			width, height = wi, hi
+		}
+	}
+	return width, height
+}
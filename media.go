@@ -0,0 +1,67 @@
+package summaly
+
+import (
+	"bytes"
+	"cmp"
+	"image"
+	"net/url"
+	"path"
+	"strings"
+
+	_ "image/gif"
+	_ "image/jpeg"
+	_ "image/png"
+
+	_ "golang.org/x/image/webp"
+)
+
+// Media は画像、動画、音声、PDF に直接リンクされたときの Summarizer
+type Media struct{}
+
+func (*Media) test(s *Summaly) bool {
+	return strings.HasPrefix(s.MediaType, "image/") ||
+		strings.HasPrefix(s.MediaType, "video/") ||
+		strings.HasPrefix(s.MediaType, "audio/") ||
+		s.MediaType == "application/pdf"
+}
+
+func (*Media) summarize(s *Summaly) (Summary, error) {
+	summary := Summary{
+		Title:     fileName(s.URL),
+		Sitename:  s.URL.Host,
+		MediaType: s.MediaType,
+		URL:       s.URL.String(),
+	}
+
+	switch {
+	case strings.HasPrefix(s.MediaType, "image/"):
+		summary.Thumbnail = s.URL.String()
+		// 先頭部分からわかる範囲で大きさを調べる
+		if cfg, _, err := image.DecodeConfig(bytes.NewReader(s.Body)); err == nil {
+			summary.ThumbnailInfo = &ThumbnailInfo{
+				Width:  cfg.Width,
+				Height: cfg.Height,
+			}
+		} else {
+			s.Logger.Debug("image size", "err", err)
+		}
+	case s.MediaType == "application/pdf":
+		info := parsePDFInfo(s.Body)
+		if info == (pdfInfo{}) && s.BodyTruncated {
+			info = s.pdfTailInfo()
+		}
+		summary.Title = Clip(cmp.Or(info.Title, summary.Title), 100)
+		summary.Author = Clip(info.Author, 100)
+	}
+
+	return summary, nil
+}
+
+// fileName は u のファイル名を返す。なければホスト名を返す
+func fileName(u *url.URL) string {
+	name := path.Base(u.Path)
+	if name == "/" || name == "." {
+		return u.Host
+	}
+	return name
+}
@@ -11,6 +11,7 @@ import (
 	"github.com/samber/lo"
 	"github.com/yulog/go-summaly/fetch"
 	"github.com/yulog/go-summaly/oembed"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
 )
 
 var safeList = []string{
@@ -28,12 +29,19 @@ var ignoredList = []string{
 	"", // 空の値も除去する
 }
 
-func GetOembedPlayer(client *fetch.Client, doc *goquery.Document, ua string) (*Player, error) {
-	oc := &oembed.Client{Client: client, UserAgent: ua}
+func GetOembedPlayer(client *fetch.Client, doc *goquery.Document, ua string) (_ *Player, err error) {
+	ctx, span := tracer.Start(client.Context(), "oembed")
+	defer func() {
+		recordError(span, err)
+		span.End()
+	}()
+
+	oc := &oembed.Client{Client: client.WithContext(ctx), UserAgent: ua}
 	u, err := oc.Find(doc)
 	if err != nil {
 		return nil, err
 	}
+	span.SetAttributes(semconv.URLFull(u.String()))
 	var o oembed.Oembed
 	err = oc.Fetch(u, &o)
 	if err != nil {
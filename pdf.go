@@ -0,0 +1,184 @@
+package summaly
+
+import (
+	"bytes"
+	"encoding/hex"
+	"regexp"
+	"slices"
+	"strconv"
+	"unicode/utf16"
+
+	"github.com/yulog/go-summaly/fetch"
+)
+
+type pdfInfo struct {
+	Title  string
+	Author string
+}
+
+var (
+	pdfInfoRef  = regexp.MustCompile(`/Info\s+(\d+)\s+(\d+)\s+R`)
+	pdfInfoKeys = regexp.MustCompile(`/(Title|Author)\s*([(<])`)
+)
+
+// Body に Info 辞書がないときに取得する末尾の大きさ
+const pdfTailSize = 1 << 20 // 1MiB
+
+// pdfTailInfo は PDF の末尾を取得し、先頭部分と合わせて Info 辞書を探す
+//
+// trailer は末尾にあるため、大きい PDF では先頭部分だけでは見つからない
+func (s *Summaly) pdfTailInfo() pdfInfo {
+	options := append(s.requestOptions(),
+		fetch.WithAccept("application/pdf"),
+		fetch.WithAllowType([]string{"application/pdf"}),
+	)
+	tail, err := s.Client.NewRequest(s.URL, options...).GetTail(pdfTailSize)
+	if err != nil {
+		s.Logger.Debug("pdf tail", "err", err)
+		return pdfInfo{}
+	}
+	return parsePDFInfo(append(slices.Clip(s.Body), tail...))
+}
+
+// parsePDFInfo は PDF の Info 辞書から Title, Author を取り出す
+//
+// data に Info 辞書が平文で含まれている場合だけ対応する
+// (オブジェクトストリーム内にある場合や data の外にある場合は空になる)
+func parsePDFInfo(data []byte) pdfInfo {
+	var info pdfInfo
+
+	refs := pdfInfoRef.FindAllSubmatch(data, -1)
+	if len(refs) == 0 {
+		return info
+	}
+	// 増分更新されている場合は最後の trailer が有効
+	ref := refs[len(refs)-1]
+	obj := regexp.MustCompile(`(?:^|\s)` + string(ref[1]) + `\s+` + string(ref[2]) + `\s+obj\s*<<`)
+	loc := obj.FindIndex(data)
+	if loc == nil {
+		return info
+	}
+	dict := data[loc[1]:]
+	if end := bytes.Index(dict, []byte("endobj")); end >= 0 {
+		dict = dict[:end]
+	}
+
+	for _, m := range pdfInfoKeys.FindAllSubmatchIndex(dict, -1) {
+		key := string(dict[m[2]:m[3]])
+		var s string
+		if dict[m[4]] == '(' {
+			s = decodePDFText(parsePDFLiteral(dict[m[5]:]))
+		} else {
+			s = decodePDFText(parsePDFHex(dict[m[5]:]))
+		}
+		switch key {
+		case "Title":
+			if info.Title == "" {
+				info.Title = s
+			}
+		case "Author":
+			if info.Author == "" {
+				info.Author = s
+			}
+		}
+	}
+	return info
+}
+
+// parsePDFLiteral は "(...)" の文字列の中身を返す
+//
+// b は "(" の次から始まる
+func parsePDFLiteral(b []byte) []byte {
+	var out []byte
+	depth := 0
+	for i := 0; i < len(b); i++ {
+		c := b[i]
+		switch c {
+		case '(':
+			depth++
+		case ')':
+			if depth == 0 {
+				return out
+			}
+			depth--
+		case '\\':
+			i++
+			if i >= len(b) {
+				return out
+			}
+			switch e := b[i]; e {
+			case 'n':
+				c = '\n'
+			case 'r':
+				c = '\r'
+			case 't':
+				c = '\t'
+			case 'b':
+				c = '\b'
+			case 'f':
+				c = '\f'
+			case '\r', '\n':
+				// 行継続
+				if e == '\r' && i+1 < len(b) && b[i+1] == '\n' {
+					i++
+				}
+				continue
+			case '0', '1', '2', '3', '4', '5', '6', '7':
+				j := i
+				for j < len(b) && j < i+3 && b[j] >= '0' && b[j] <= '7' {
+					j++
+				}
+				v, _ := strconv.ParseUint(string(b[i:j]), 8, 8)
+				c = byte(v)
+				i = j - 1
+			default:
+				c = e
+			}
+		}
+		out = append(out, c)
+	}
+	return out
+}
+
+// parsePDFHex は "<...>" の文字列の中身を返す
+//
+// b は "<" の次から始まる
+func parsePDFHex(b []byte) []byte {
+	end := bytes.IndexByte(b, '>')
+	if end < 0 {
+		return nil
+	}
+	h := make([]byte, 0, end+1)
+	for _, c := range b[:end] {
+		if (c >= '0' && c <= '9') || (c >= 'a' && c <= 'f') || (c >= 'A' && c <= 'F') {
+			h = append(h, c)
+		}
+	}
+	if len(h)%2 == 1 {
+		h = append(h, '0')
+	}
+	out, _ := hex.DecodeString(string(h))
+	return out
+}
+
+// decodePDFText は PDF のテキスト文字列を UTF-8 にする
+//
+// UTF-16BE (BOM 付き), UTF-8 (BOM 付き), それ以外は PDFDocEncoding を Latin-1 とみなす
+func decodePDFText(b []byte) string {
+	switch {
+	case bytes.HasPrefix(b, []byte{0xfe, 0xff}):
+		b = b[2:]
+		u := make([]uint16, 0, len(b)/2)
+		for i := 0; i+1 < len(b); i += 2 {
+			u = append(u, uint16(b[i])<<8|uint16(b[i+1]))
+		}
+		return string(utf16.Decode(u))
+	case bytes.HasPrefix(b, []byte{0xef, 0xbb, 0xbf}):
+		return string(b[3:])
+	}
+	r := make([]rune, len(b))
+	for i, c := range b {
+		r[i] = rune(c)
+	}
+	return string(r)
+}
@@ -0,0 +1,51 @@
+package summaly
+
+import (
+	"net/url"
+
+	"github.com/yulog/go-summaly/fetch"
+	"github.com/yulog/go-summaly/thumbnail"
+)
+
+// ThumbnailInfo は thumbnail の読み込み中に表示するための情報
+type ThumbnailInfo struct {
+	Width    int    `json:"width,omitempty"`
+	Height   int    `json:"height,omitempty"`
+	Blurhash string `json:"blurhash,omitempty"`
+	Color    string `json:"color,omitempty"`
+}
+
+const (
+	placeholderLimit     = 5 << 20 // 5MiB
+	placeholderMaxPixels = 50_000_000
+)
+
+// GetThumbnailInfo は thumbnail を取得し、 blurhash, 代表色, 大きさを返す
+func GetThumbnailInfo(client *fetch.Client, thumbnailURL, ua string) (*ThumbnailInfo, error) {
+	u, err := url.Parse(thumbnailURL)
+	if err != nil {
+		return nil, err
+	}
+
+	body, _, err := client.NewRequest(u,
+		fetch.WithAccept("image/*"),
+		fetch.WithAllowType(thumbnail.AllowType),
+		fetch.WithLimit(placeholderLimit),
+		fetch.WithUserAgent(ua),
+	).GetRaw()
+	if err != nil {
+		return nil, err
+	}
+
+	p, err := thumbnail.NewPlaceholder(body, placeholderMaxPixels)
+	if err != nil {
+		return nil, err
+	}
+
+	return &ThumbnailInfo{
+		Width:    p.Width,
+		Height:   p.Height,
+		Blurhash: p.Blurhash,
+		Color:    p.Color,
+	}, nil
+}
@@ -0,0 +1,214 @@
+package summaly
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"github.com/goccy/go-json"
+	"gopkg.in/yaml.v3"
+)
+
+// Profile はホストごとのリクエストの設定
+type Profile struct {
+	// Host はホストのパターン
+	//
+	//   - "example.com" は完全一致
+	//   - ".example.com" は example.com とそのサブドメイン
+	//   - "*.example.com" などはワイルドカード (path.Match)
+	//   - "/^(www\.)?example\.com$/" はスラッシュで囲むと正規表現
+	Host string `json:"host" yaml:"host" toml:"host"`
+	// UserAgent を指定するとこれを使う
+	UserAgent string `json:"userAgent" yaml:"userAgent" toml:"userAgent"`
+	// NonBot は UserAgent がないときに NonBotUserAgent を使う
+	NonBot bool `json:"nonBot" yaml:"nonBot" toml:"nonBot"`
+	// AcceptLanguage を指定するとリクエストの lang の代わりに使う
+	AcceptLanguage string            `json:"acceptLanguage" yaml:"acceptLanguage" toml:"acceptLanguage"`
+	Headers        map[string]string `json:"headers" yaml:"headers" toml:"headers"`
+	Cookies        map[string]string `json:"cookies" yaml:"cookies" toml:"cookies"`
+
+	match func(host string) bool
+}
+
+// Profiles は Profile の一覧
+//
+// 先に書かれたものから順に照合する
+type Profiles struct {
+	Profiles []*Profile `json:"profiles" yaml:"profiles" toml:"profiles"`
+}
+
+// LoadProfiles は JSON, YAML, TOML のファイルから *Profiles を読み込む
+//
+// 形式は拡張子で決め、 .yaml, .yml, .toml 以外は JSON とみなす
+func LoadProfiles(name string) (*Profiles, error) {
+	b, err := os.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	var p Profiles
+	switch strings.ToLower(filepath.Ext(name)) {
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(b, &p)
+	case ".toml":
+		err = toml.Unmarshal(b, &p)
+	default:
+		err = json.Unmarshal(b, &p)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := p.compile(); err != nil {
+		return nil, err
+	}
+	return &p, nil
+}
+
+func (p *Profiles) compile() error {
+	for _, v := range p.Profiles {
+		pattern := strings.ToLower(v.Host)
+		switch {
+		case pattern == "":
+			return fmt.Errorf("profile: empty host")
+		case len(pattern) > 2 && strings.HasPrefix(pattern, "/") && strings.HasSuffix(pattern, "/"):
+			re, err := regexp.Compile(v.Host[1 : len(v.Host)-1])
+			if err != nil {
+				return fmt.Errorf("profile %s: %w", v.Host, err)
+			}
+			v.match = func(host string) bool {
+				return re.MatchString(host)
+			}
+		case strings.HasPrefix(pattern, "."):
+			v.match = func(host string) bool {
+				return host == pattern[1:] || strings.HasSuffix(host, pattern)
+			}
+		case strings.ContainsAny(pattern, "*?["):
+			if _, err := path.Match(pattern, ""); err != nil {
+				return fmt.Errorf("profile %s: %w", v.Host, err)
+			}
+			v.match = func(host string) bool {
+				ok, _ := path.Match(pattern, host)
+				return ok
+			}
+		default:
+			v.match = func(host string) bool {
+				return host == pattern
+			}
+		}
+	}
+	return nil
+}
+
+// Matches は host が p のパターンに一致するかを返す
+func (p *Profile) Matches(host string) bool {
+	return p.match != nil && p.match(strings.ToLower(host))
+}
+
+// Match は host に一致する最初の *Profile を返す
+func (p *Profiles) Match(host string) *Profile {
+	if p == nil {
+		return nil
+	}
+	host = strings.ToLower(host)
+	for _, v := range p.Profiles {
+		if v.match != nil && v.match(host) {
+			return v
+		}
+	}
+	return nil
+}
+
+// ProfileWatcher はファイルの更新を確認して Profiles を読み込み直す
+type ProfileWatcher struct {
+	Name     string
+	Interval time.Duration
+
+	profiles atomic.Pointer[Profiles]
+
+	mu      sync.Mutex
+	modTime time.Time
+	done    chan struct{}
+}
+
+// NewProfileWatcher は name を読み込み、 Interval ごとに更新を確認する *ProfileWatcher を返す
+func NewProfileWatcher(name string, interval time.Duration) (*ProfileWatcher, error) {
+	w := &ProfileWatcher{Name: name, Interval: interval, done: make(chan struct{})}
+	if err := w.Reload(); err != nil {
+		return nil, err
+	}
+	if interval > 0 {
+		go w.watch()
+	}
+	return w, nil
+}
+
+// Profiles は最後に読み込んだ *Profiles を返す
+func (w *ProfileWatcher) Profiles() *Profiles {
+	return w.profiles.Load()
+}
+
+// Reload はファイルを読み込み直す
+//
+// 読み込めなかった場合は前の内容のままにする
+func (w *ProfileWatcher) Reload() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	fi, err := os.Stat(w.Name)
+	if err != nil {
+		return err
+	}
+	p, err := LoadProfiles(w.Name)
+	if err != nil {
+		return err
+	}
+	w.profiles.Store(p)
+	w.modTime = fi.ModTime()
+	return nil
+}
+
+// Close は更新の確認をやめる
+func (w *ProfileWatcher) Close() {
+	close(w.done)
+}
+
+func (w *ProfileWatcher) watch() {
+	t := time.NewTicker(w.Interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-w.done:
+			return
+		case <-t.C:
+		}
+
+		fi, err := os.Stat(w.Name)
+		if err != nil {
+			slog.Warn("profiles", "file", w.Name, "err", err)
+			continue
+		}
+		w.mu.Lock()
+		changed := !fi.ModTime().Equal(w.modTime)
+		w.mu.Unlock()
+		if !changed {
+			continue
+		}
+		// 読み込めなくても前の内容で続ける
+		if err := w.Reload(); err != nil {
+			slog.Error("profiles", "file", w.Name, "err", err)
+			// 同じ内容で何度もエラーにしない
+			w.mu.Lock()
+			w.modTime = fi.ModTime()
+			w.mu.Unlock()
+			continue
+		}
+		slog.Info("reloaded profiles", "file", w.Name)
+	}
+}
@@ -0,0 +1,278 @@
+package server
+
+import (
+	"container/list"
+	"crypto/subtle"
+	"fmt"
+	"math"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"golang.org/x/time/rate"
+)
+
+// accessLimit はリクエストの頻度 (1秒あたり) と一度に許す数
+type accessLimit struct {
+	Rate  float64 // 0 は無制限
+	Burst int
+}
+
+// accessOpts は API キーとクライアントごとのレート制限の設定
+type accessOpts struct {
+	Keys   map[string]accessLimit // 空なら API キーなしで受け付ける
+	Header string
+	Query  string
+
+	Client         accessLimit // API キーがないリクエストに IP ごとに適用する
+	TrustedProxies []netip.Prefix
+	ProxyHeader    string
+}
+
+// access は API キーを確かめ、 API キーか IP ごとにリクエストを制限する
+type access struct {
+	opts accessOpts
+
+	mu   sync.Mutex
+	keys map[string]*rate.Limiter // 設定された API キーの数までしか増えない
+	// clients は IP ごとの制限。 accessLimiterMaxEntries を超えたら最も使われていないものから捨てる
+	ll      *list.List
+	clients map[string]*list.Element
+}
+
+type accessLimiter struct {
+	name    string
+	limiter *rate.Limiter
+}
+
+// 覚えておくクライアントの数
+const accessLimiterMaxEntries = 10000
+
+// accessOpts は APIKeys, ClientRateLimit*, TrustedProxies から accessOpts を作る
+func (c *Config) accessOpts() (accessOpts, error) {
+	opts := accessOpts{
+		Keys:   make(map[string]accessLimit, len(c.APIKeys)),
+		Header: c.APIKeyHeader,
+		Query:  c.APIKeyQuery,
+		Client: accessLimit{
+			Rate:  c.ClientRateLimit,
+			Burst: c.ClientRateLimitBurst,
+		},
+		TrustedProxies: c.TrustedProxies,
+		ProxyHeader:    c.TrustedProxyHeader,
+	}
+	for _, v := range c.APIKeys {
+		key, l := v, accessLimit{Rate: c.APIKeyRateLimit, Burst: c.APIKeyRateLimitBurst}
+		// base64 の = と区別するため、最後の = の後に : があるときだけ制限とみなす
+		if i := strings.LastIndex(v, "="); i >= 0 && strings.Contains(v[i+1:], ":") {
+			key = v[:i]
+			r, burst, _ := strings.Cut(v[i+1:], ":")
+			var err error
+			if l.Rate, err = strconv.ParseFloat(r, 64); err != nil {
+				return accessOpts{}, fmt.Errorf("invalid API_KEYS: %w", err)
+			}
+			if l.Burst, err = strconv.Atoi(burst); err != nil {
+				return accessOpts{}, fmt.Errorf("invalid API_KEYS: %w", err)
+			}
+		}
+		if key == "" {
+			return accessOpts{}, fmt.Errorf("invalid API_KEYS: empty key")
+		}
+		opts.Keys[key] = l
+	}
+	switch http.CanonicalHeaderKey(opts.ProxyHeader) {
+	case echo.HeaderXForwardedFor, echo.HeaderXRealIP:
+	default:
+		return accessOpts{}, fmt.Errorf("unsupported TRUSTED_PROXY_HEADER: %s", opts.ProxyHeader)
+	}
+	return opts, nil
+}
+
+func newAccess(opts accessOpts) *access {
+	return &access{
+		opts:    opts,
+		keys:    make(map[string]*rate.Limiter, len(opts.Keys)),
+		ll:      list.New(),
+		clients: make(map[string]*list.Element),
+	}
+}
+
+// key はリクエストの API キーを返す
+//
+// ヘッダー、 Authorization: Bearer 、クエリの順に探す。
+// クエリにあればログに残らないよう取り除く
+func (a *access) key(c echo.Context) string {
+	req := c.Request()
+	if a.opts.Header != "" {
+		if v := req.Header.Get(a.opts.Header); v != "" {
+			return v
+		}
+	}
+	if v, ok := strings.CutPrefix(req.Header.Get(echo.HeaderAuthorization), "Bearer "); ok {
+		return v
+	}
+	if a.opts.Query == "" {
+		return ""
+	}
+	q := req.URL.Query()
+	v := q.Get(a.opts.Query)
+	if v != "" {
+		q.Del(a.opts.Query)
+		req.URL.RawQuery = q.Encode()
+		req.RequestURI = req.URL.RequestURI()
+	}
+	return v
+}
+
+// lookup は key が設定されていればその accessLimit を返す
+func (a *access) lookup(key string) (accessLimit, bool) {
+	var (
+		found bool
+		limit accessLimit
+	)
+	// 時間で一致した位置がわからないよう全部比べる
+	for k, l := range a.opts.Keys {
+		if subtle.ConstantTimeCompare([]byte(k), []byte(key)) == 1 {
+			found, limit = true, l
+		}
+	}
+	return limit, found
+}
+
+// clientIP はリクエスト元の IP を返す
+//
+// 信頼するプロキシからのときだけ ProxyHeader を見る。
+// X-Forwarded-For は右から信頼しないアドレスが出てくるまでたどる。
+// ログや trace と同じ IP になるよう echo.Echo.IPExtractor にも使う
+func (a *access) clientIP(req *http.Request) string {
+	remote, err := netip.ParseAddrPort(req.RemoteAddr)
+	if err != nil {
+		return req.RemoteAddr
+	}
+	ip := remote.Addr().Unmap()
+	if !a.trusted(ip) {
+		return ip.String()
+	}
+	if http.CanonicalHeaderKey(a.opts.ProxyHeader) == echo.HeaderXRealIP {
+		if v, err := netip.ParseAddr(strings.TrimSpace(req.Header.Get(echo.HeaderXRealIP))); err == nil {
+			return v.Unmap().String()
+		}
+		return ip.String()
+	}
+	hops := strings.Split(strings.Join(req.Header.Values(echo.HeaderXForwardedFor), ","), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		v, err := netip.ParseAddr(strings.TrimSpace(hops[i]))
+		if err != nil {
+			break
+		}
+		ip = v.Unmap()
+		if !a.trusted(ip) {
+			break
+		}
+	}
+	return ip.String()
+}
+
+// clientKey は clientIP をレート制限のキーにする
+//
+// IPv6 は1つの利用者が /64 をまとめて持つことが多いので /64 ごとにする
+func clientKey(ip string) string {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil || !addr.Is6() {
+		return ip
+	}
+	return netip.PrefixFrom(addr, 64).Masked().String()
+}
+
+func (a *access) trusted(ip netip.Addr) bool {
+	for _, p := range a.opts.TrustedProxies {
+		if p.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// keyLimiter は API キーの制限を返す
+func (a *access) keyLimiter(key string, l accessLimit) *rate.Limiter {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	limiter, ok := a.keys[key]
+	if !ok {
+		limiter = rate.NewLimiter(rate.Limit(l.Rate), max(l.Burst, 1))
+		a.keys[key] = limiter
+	}
+	return limiter
+}
+
+// clientLimiter は clientKey ごとの制限を返す
+func (a *access) clientLimiter(name string, l accessLimit) *rate.Limiter {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if el, ok := a.clients[name]; ok {
+		a.ll.MoveToFront(el)
+		return el.Value.(*accessLimiter).limiter
+	}
+	limiter := rate.NewLimiter(rate.Limit(l.Rate), max(l.Burst, 1))
+	a.clients[name] = a.ll.PushFront(&accessLimiter{name: name, limiter: limiter})
+	for a.ll.Len() > accessLimiterMaxEntries {
+		el := a.ll.Back()
+		a.ll.Remove(el)
+		delete(a.clients, el.Value.(*accessLimiter).name)
+	}
+	return limiter
+}
+
+// allow はリクエストを受け付けられるかと、受け付けられないときに待つ時間を返す
+func allow(limiter *rate.Limiter) (bool, time.Duration) {
+	now := time.Now()
+	r := limiter.ReserveN(now, 1)
+	if !r.OK() {
+		return false, time.Second
+	}
+	if d := r.DelayFrom(now); d > 0 {
+		r.CancelAt(now)
+		return false, d
+	}
+	return true, 0
+}
+
+// accessControl は API キーとレート制限を確かめる middleware
+//
+// 有効な API キーがあればキーごとに、なければ IP ごとに制限する。
+// API キーが設定されていれば、キーがないリクエストは 401 にする
+func (srv *Server) accessControl() echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			a := srv.current().access
+
+			key := a.key(c)
+			limit, authorized := a.lookup(key)
+			if !authorized {
+				limit = a.opts.Client
+			}
+			if limit.Rate > 0 {
+				var limiter *rate.Limiter
+				if authorized {
+					limiter = a.keyLimiter(key, limit)
+				} else {
+					limiter = a.clientLimiter(clientKey(c.RealIP()), limit)
+				}
+				if ok, wait := allow(limiter); !ok {
+					c.Response().Header().Set(echo.HeaderRetryAfter, strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+					return echo.NewHTTPError(http.StatusTooManyRequests)
+				}
+			}
+
+			if len(a.opts.Keys) > 0 && !authorized {
+				c.Response().Header().Set(echo.HeaderWWWAuthenticate, "Bearer")
+				return echo.NewHTTPError(http.StatusUnauthorized)
+			}
+			return next(c)
+		}
+	}
+}
@@ -0,0 +1,321 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/labstack/echo/v4"
+)
+
+func TestAccess_ClientIP(t *testing.T) {
+	trusted := []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8")}
+	tests := []struct {
+		name   string
+		header string
+		remote string
+		values map[string][]string
+		want   string
+	}{
+		{name: "no header", remote: "203.0.113.1:1234", want: "203.0.113.1"},
+		{
+			name:   "spoofed from untrusted peer",
+			remote: "203.0.113.1:1234",
+			values: map[string][]string{"X-Forwarded-For": {"198.51.100.1"}},
+			want:   "203.0.113.1",
+		},
+		{
+			name:   "trusted peer",
+			remote: "10.0.0.1:1234",
+			values: map[string][]string{"X-Forwarded-For": {"198.51.100.1"}},
+			want:   "198.51.100.1",
+		},
+		{
+			name:   "chained trusted hops",
+			remote: "10.0.0.1:1234",
+			values: map[string][]string{"X-Forwarded-For": {"198.51.100.1, 10.0.0.3, 10.0.0.2"}},
+			want:   "198.51.100.1",
+		},
+		{
+			name:   "spoofed before client",
+			remote: "10.0.0.1:1234",
+			values: map[string][]string{"X-Forwarded-For": {"192.0.2.1, 198.51.100.1, 10.0.0.2"}},
+			want:   "198.51.100.1",
+		},
+		{
+			name:   "multiple headers",
+			remote: "10.0.0.1:1234",
+			values: map[string][]string{"X-Forwarded-For": {"192.0.2.1", "198.51.100.1"}},
+			want:   "198.51.100.1",
+		},
+		{
+			name:   "invalid hop",
+			remote: "10.0.0.1:1234",
+			values: map[string][]string{"X-Forwarded-For": {"unknown, 10.0.0.2"}},
+			want:   "10.0.0.2",
+		},
+		{
+			name:   "ipv4-mapped peer",
+			remote: "[::ffff:10.0.0.1]:1234",
+			values: map[string][]string{"X-Forwarded-For": {"198.51.100.1"}},
+			want:   "198.51.100.1",
+		},
+		{
+			name:   "x-real-ip",
+			header: "X-Real-IP",
+			remote: "10.0.0.1:1234",
+			values: map[string][]string{"X-Real-Ip": {"2001:db8::1"}, "X-Forwarded-For": {"198.51.100.1"}},
+			want:   "2001:db8::1",
+		},
+		{
+			name:   "x-real-ip from untrusted peer",
+			header: "X-Real-IP",
+			remote: "203.0.113.1:1234",
+			values: map[string][]string{"X-Real-Ip": {"198.51.100.1"}},
+			want:   "203.0.113.1",
+		},
+		{
+			name:   "invalid x-real-ip",
+			header: "X-Real-IP",
+			remote: "10.0.0.1:1234",
+			values: map[string][]string{"X-Real-Ip": {"unknown"}},
+			want:   "10.0.0.1",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			header := tt.header
+			if header == "" {
+				header = echo.HeaderXForwardedFor
+			}
+			a := newAccess(accessOpts{TrustedProxies: trusted, ProxyHeader: header})
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.RemoteAddr = tt.remote
+			for k, v := range tt.values {
+				req.Header[k] = v
+			}
+			if got := a.clientIP(req); got != tt.want {
+				t.Errorf("clientIP() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestClientKey(t *testing.T) {
+	tests := []struct {
+		ip   string
+		want string
+	}{
+		{ip: "198.51.100.1", want: "198.51.100.1"},
+		{ip: "2001:db8:1:2:3:4:5:6", want: "2001:db8:1:2::/64"},
+		{ip: "2001:db8:1:2::ffff", want: "2001:db8:1:2::/64"},
+		{ip: "unknown", want: "unknown"},
+	}
+	for _, tt := range tests {
+		if got := clientKey(tt.ip); got != tt.want {
+			t.Errorf("clientKey(%q) = %q, want %q", tt.ip, got, tt.want)
+		}
+	}
+}
+
+func TestConfig_AccessOpts(t *testing.T) {
+	tests := []struct {
+		name    string
+		keys    []string
+		header  string
+		want    map[string]accessLimit
+		wantErr bool
+	}{
+		{
+			name: "default limit",
+			keys: []string{"key1"},
+			want: map[string]accessLimit{"key1": {Rate: 1, Burst: 10}},
+		},
+		{
+			name: "per key limit",
+			keys: []string{"key1=5:20", "key2=0.5:1"},
+			want: map[string]accessLimit{"key1": {Rate: 5, Burst: 20}, "key2": {Rate: 0.5, Burst: 1}},
+		},
+		{
+			name: "base64 padding",
+			keys: []string{"c2VjcmV0MQ==", "c2VjcmV0Mg===2:3", "a=b"},
+			want: map[string]accessLimit{
+				"c2VjcmV0MQ==": {Rate: 1, Burst: 10},
+				"c2VjcmV0Mg==": {Rate: 2, Burst: 3},
+				"a=b":          {Rate: 1, Burst: 10},
+			},
+		},
+		{name: "invalid rate", keys: []string{"key1=x:1"}, wantErr: true},
+		{name: "invalid burst", keys: []string{"key1=1:x"}, wantErr: true},
+		{name: "empty key", keys: []string{"=1:1"}, wantErr: true},
+		{name: "unsupported header", header: "Forwarded", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := Config{
+				APIKeys:              tt.keys,
+				APIKeyRateLimit:      1,
+				APIKeyRateLimitBurst: 10,
+				TrustedProxyHeader:   tt.header,
+			}
+			if c.TrustedProxyHeader == "" {
+				c.TrustedProxyHeader = echo.HeaderXForwardedFor
+			}
+			got, err := c.accessOpts()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if diff := cmp.Diff(tt.want, got.Keys); diff != "" {
+				t.Errorf("Keys mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestAccess_MaxEntries(t *testing.T) {
+	a := newAccess(accessOpts{Keys: map[string]accessLimit{"secret": {Rate: 1, Burst: 1}}})
+	l := accessLimit{Rate: 1, Burst: 1}
+	key := a.keyLimiter("secret", l)
+	if ok, _ := allow(key); !ok {
+		t.Fatal("first request with the key should be allowed")
+	}
+	for i := range accessLimiterMaxEntries + 10 {
+		a.clientLimiter(fmt.Sprint(i), l)
+	}
+	if got := len(a.clients); got != accessLimiterMaxEntries {
+		t.Errorf("len(clients) = %d, want %d", got, accessLimiterMaxEntries)
+	}
+	// 最も古いものから捨てる
+	if _, ok := a.clients["0"]; ok {
+		t.Error("oldest limiter not evicted")
+	}
+	if _, ok := a.clients[fmt.Sprint(accessLimiterMaxEntries+9)]; !ok {
+		t.Error("newest limiter evicted")
+	}
+	// IP が増えても API キーの制限は消えない
+	if a.keyLimiter("secret", l) != key {
+		t.Error("key limiter evicted by clients")
+	}
+}
+
+func TestAccessControl(t *testing.T) {
+	type request struct {
+		header map[string]string
+		remote string
+		want   int
+	}
+	tests := []struct {
+		name     string
+		environ  map[string]string
+		requests []request
+	}{
+		{
+			name:    "api key",
+			environ: map[string]string{"API_KEYS": "secret=1:1"},
+			requests: []request{
+				{want: http.StatusUnauthorized},
+				{header: map[string]string{"X-API-Key": "wrong"}, want: http.StatusUnauthorized},
+				{header: map[string]string{"X-API-Key": "secret"}, want: http.StatusOK},
+				{header: map[string]string{"Authorization": "Bearer secret"}, want: http.StatusTooManyRequests},
+			},
+		},
+		{
+			name:    "client rate limit",
+			environ: map[string]string{"CLIENT_RATE_LIMIT": "1", "CLIENT_RATE_LIMIT_BURST": "1"},
+			requests: []request{
+				{remote: "198.51.100.1:1", want: http.StatusOK},
+				{remote: "198.51.100.1:2", want: http.StatusTooManyRequests},
+				{remote: "198.51.100.2:1", want: http.StatusOK},
+				// IPv6 は /64 ごと
+				{remote: "[2001:db8:1:2::1]:1", want: http.StatusOK},
+				{remote: "[2001:db8:1:2::2]:1", want: http.StatusTooManyRequests},
+				{remote: "[2001:db8:1:3::1]:1", want: http.StatusOK},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := newTestServer(t, tt.environ)
+			e := srv.newEcho()
+			e.GET("/test", func(c echo.Context) error { return c.NoContent(http.StatusOK) }, srv.accessControl())
+			for i, r := range tt.requests {
+				req := httptest.NewRequest(http.MethodGet, "/test", nil)
+				if r.remote != "" {
+					req.RemoteAddr = r.remote
+				}
+				for k, v := range r.header {
+					req.Header.Set(k, v)
+				}
+				rec := httptest.NewRecorder()
+				e.ServeHTTP(rec, req)
+				if rec.Code != r.want {
+					t.Fatalf("requests[%d]: status = %d, want %d", i, rec.Code, r.want)
+				}
+				switch rec.Code {
+				case http.StatusUnauthorized:
+					if got := rec.Header().Get(echo.HeaderWWWAuthenticate); got != "Bearer" {
+						t.Errorf("requests[%d]: WWW-Authenticate = %q, want %q", i, got, "Bearer")
+					}
+				case http.StatusTooManyRequests:
+					if got := rec.Header().Get(echo.HeaderRetryAfter); got != "1" {
+						t.Errorf("requests[%d]: Retry-After = %q, want %q", i, got, "1")
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestAccessControl_QueryKey(t *testing.T) {
+	srv := newTestServer(t, map[string]string{"API_KEYS": "secret"})
+	e := srv.newEcho()
+	var uri, query string
+	e.GET("/test", func(c echo.Context) error {
+		uri, query = c.Request().RequestURI, c.Request().URL.RawQuery
+		return c.NoContent(http.StatusOK)
+	}, srv.accessControl())
+
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/test?url=https%3A%2F%2Fexample.com%2F&api_key=secret", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d, want %d", rec.Code, http.StatusOK)
+	}
+	// ログに残らないようクエリの API キーを取り除く
+	if want := "/test?url=https%3A%2F%2Fexample.com%2F"; uri != want {
+		t.Errorf("RequestURI = %q, want %q", uri, want)
+	}
+	if want := "url=https%3A%2F%2Fexample.com%2F"; query != want {
+		t.Errorf("RawQuery = %q, want %q", query, want)
+	}
+}
+
+func TestNewEcho_IPExtractor(t *testing.T) {
+	srv := newTestServer(t, map[string]string{"TRUSTED_PROXIES": "10.0.0.0/8"})
+	e := srv.newEcho()
+	var got string
+	e.GET("/test", func(c echo.Context) error {
+		got = c.RealIP()
+		return c.NoContent(http.StatusOK)
+	})
+
+	// ログや trace の IP もレート制限と同じにする
+	req := httptest.NewRequest(http.MethodGet, "/test", nil)
+	req.RemoteAddr = "203.0.113.1:1234"
+	req.Header.Set(echo.HeaderXForwardedFor, "198.51.100.1")
+	e.ServeHTTP(httptest.NewRecorder(), req)
+	if got != "203.0.113.1" {
+		t.Errorf("RealIP() = %q, want %q", got, "203.0.113.1")
+	}
+
+	req.RemoteAddr = "10.0.0.1:1234"
+	e.ServeHTTP(httptest.NewRecorder(), req)
+	if got != "198.51.100.1" {
+		t.Errorf("RealIP() = %q, want %q", got, "198.51.100.1")
+	}
+}
@@ -1,11 +1,22 @@
 package server
 
 import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strconv"
+	"strings"
 	"time"
+
+	"github.com/yulog/go-summaly/fetch"
 )
 
 //go:generate go run github.com/g4s8/envdoc@latest -output ../environments.md -type Config
 type Config struct {
+	// ConfigFile in YAML or TOML with the same keys as these variables. Environment variables take precedence. Also set by --config
+	ConfigFile string `env:"CONFIG_FILE"`
 	// Port to listen for incoming connections
 	Port int `env:"PORT" envDefault:"1323"`
 	// Timeout for outgoing http requests
@@ -18,8 +29,253 @@ type Config struct {
 	RequireNonBotUAFile string `env:"REQUIRE_NON_BOT_UA_FILE" envDefault:"./nonbot.txt"`
 	// RequireNonBotUA
 	RequireNonBotUA []string `env:"REQUIRE_NON_BOT_UA,file,expand" envDefault:"${REQUIRE_NON_BOT_UA_FILE}"`
+	// ProfilesFile of per host user agent, headers, accept-language and cookies (JSON, YAML or TOML). Takes precedence over RequireNonBotUA
+	ProfilesFile string `env:"PROFILES_FILE"`
+	// ProfilesReloadInterval to check ProfilesFile for changes. 0 to disable
+	ProfilesReloadInterval time.Duration `env:"PROFILES_RELOAD_INTERVAL" envDefault:"10s"`
+	// ConfigReloadInterval to check ConfigFile and RequireNonBotUAFile for changes and reload the config. 0 to disable. SIGHUP always reloads
+	ConfigReloadInterval time.Duration `env:"CONFIG_RELOAD_INTERVAL" envDefault:"10s"`
+	// ShutdownDrain to keep serving with /readyz failing after SIGTERM or SIGINT, before shutting down
+	ShutdownDrain time.Duration `env:"SHUTDOWN_DRAIN" envDefault:"0s"`
+	// ShutdownTimeout to wait for in-flight requests after the drain
+	ShutdownTimeout time.Duration `env:"SHUTDOWN_TIMEOUT" envDefault:"10s"`
+	// LogLevel (debug, info, warn, error). debug includes each outgoing request and summarize stage
+	LogLevel slog.Level `env:"LOG_LEVEL" envDefault:"info"`
+	// TracesExporter for OpenTelemetry (none, otlp, stdout). otlp sends over HTTP, configured by OTEL_EXPORTER_OTLP_* (default: http://localhost:4318)
+	TracesExporter string `env:"OTEL_TRACES_EXPORTER" envDefault:"none"`
+	// ServiceName for OpenTelemetry
+	ServiceName string `env:"OTEL_SERVICE_NAME" envDefault:"summaly"`
+	// APIKeys required for / and /debug/fetch, in X-API-Key, Authorization: Bearer or ?api_key= (key=rate:burst overrides APIKeyRateLimit). Empty to allow anyone
+	APIKeys []string `env:"API_KEYS"`
+	// APIKeyHeader to read the API key from
+	APIKeyHeader string `env:"API_KEY_HEADER" envDefault:"X-API-Key"`
+	// APIKeyQuery parameter to read the API key from. Empty to disable
+	APIKeyQuery string `env:"API_KEY_QUERY" envDefault:"api_key"`
+	// APIKeyRateLimit per API key for incoming requests (requests per second). 0 for unlimited
+	APIKeyRateLimit float64 `env:"API_KEY_RATE_LIMIT" envDefault:"0"`
+	// APIKeyRateLimitBurst per API key for incoming requests
+	APIKeyRateLimitBurst int `env:"API_KEY_RATE_LIMIT_BURST" envDefault:"10"`
+	// ClientRateLimit per client ip (/64 for IPv6) for incoming requests without a valid API key (requests per second). 0 for unlimited
+	ClientRateLimit float64 `env:"CLIENT_RATE_LIMIT" envDefault:"0"`
+	// ClientRateLimitBurst per client ip for incoming requests
+	ClientRateLimitBurst int `env:"CLIENT_RATE_LIMIT_BURST" envDefault:"10"`
+	// TrustedProxies to read the client ip from TrustedProxyHeader (CIDR). Empty to use the remote address
+	TrustedProxies []netip.Prefix `env:"TRUSTED_PROXIES"`
+	// TrustedProxyHeader of the client ip (X-Forwarded-For, X-Real-IP)
+	TrustedProxyHeader string `env:"TRUSTED_PROXY_HEADER" envDefault:"X-Forwarded-For"`
 	// HideBanner to hide startup banner
 	HideBanner bool `env:"HIDE_BANNER" envDefault:"false"`
 	// AllowPrivateIP to connect private ip for test
 	AllowPrivateIP bool `env:"ALLOW_PRIVATE_IP" envDefault:"false"`
+	// SSRFDenyPrefixes to deny in addition to the built-in special-purpose ranges (CIDR)
+	SSRFDenyPrefixes []netip.Prefix `env:"SSRF_DENY_PREFIXES"`
+	// SSRFAllowPrefixes to allow even if denied by default, e.g. an internal wiki (CIDR)
+	SSRFAllowPrefixes []netip.Prefix `env:"SSRF_ALLOW_PREFIXES"`
+	// SSRFAllowHosts to connect without checking the ip (host,*.example.com)
+	SSRFAllowHosts []string `env:"SSRF_ALLOW_HOSTS"`
+	// SSRFDenyHosts to never connect, even with AllowPrivateIP (host,*.example.com)
+	SSRFDenyHosts []string `env:"SSRF_DENY_HOSTS"`
+	// DNSServer to resolve hosts (host:port). Empty to use the system resolver
+	DNSServer string `env:"DNS_SERVER"`
+	// DNSDoH endpoint to resolve hosts with DNS over HTTPS. Takes precedence over DNSServer
+	DNSDoH string `env:"DNS_DOH"`
+	// DNSCacheTTL caps how long resolved addresses are cached. 0 for the record TTL only (DoH). Negative to disable
+	DNSCacheTTL time.Duration `env:"DNS_CACHE_TTL" envDefault:"0s"`
+	// Proxy for outgoing requests (http://, https://, socks5://, socks5h://). Empty to connect directly
+	Proxy string `env:"PROXY"`
+	// ProxyHosts overrides per host (host=proxy url or direct,*.example.com=...)
+	ProxyHosts map[string]string `env:"PROXY_HOSTS" envKeyValSeparator:"="`
+	// RateLimit per host for outgoing requests (requests per second). 0 for unlimited
+	RateLimit float64 `env:"RATE_LIMIT" envDefault:"0"`
+	// RateLimitBurst per host for outgoing requests
+	RateLimitBurst int `env:"RATE_LIMIT_BURST" envDefault:"5"`
+	// RateLimitConcurrency per host for outgoing requests. 0 for unlimited
+	RateLimitConcurrency int `env:"RATE_LIMIT_CONCURRENCY" envDefault:"0"`
+	// RateLimitMaxWait to queue outgoing requests before failing
+	RateLimitMaxWait time.Duration `env:"RATE_LIMIT_MAX_WAIT" envDefault:"10s"`
+	// RateLimitHosts overrides per host (host=rate:burst:concurrency,*.example.com=...)
+	RateLimitHosts map[string]string `env:"RATE_LIMIT_HOSTS" envKeyValSeparator:"="`
+	// RetryMax for transient failures of outgoing GET requests. 0 to disable
+	RetryMax int `env:"RETRY_MAX" envDefault:"2"`
+	// RetryBaseDelay for exponential backoff with jitter
+	RetryBaseDelay time.Duration `env:"RETRY_BASE_DELAY" envDefault:"200ms"`
+	// RetryMaxDelay to wait before a retry. Longer Retry-After is not retried
+	RetryMaxDelay time.Duration `env:"RETRY_MAX_DELAY" envDefault:"5s"`
+	// BreakerThreshold of consecutive failures to stop requesting the host for a while. 0 to disable
+	BreakerThreshold int `env:"BREAKER_THRESHOLD" envDefault:"5"`
+	// BreakerOpenDuration before trying the host again
+	BreakerOpenDuration time.Duration `env:"BREAKER_OPEN_DURATION" envDefault:"30s"`
+	// ReadyCheckURL to fetch (HEAD) from /readyz. Empty to skip
+	ReadyCheckURL string `env:"READY_CHECK_URL"`
+	// ReadyCheckTTL to reuse the result of ReadyCheckURL
+	ReadyCheckTTL time.Duration `env:"READY_CHECK_TTL" envDefault:"30s"`
+	// ReadyCheckTimeout for fetching ReadyCheckURL
+	ReadyCheckTimeout time.Duration `env:"READY_CHECK_TIMEOUT" envDefault:"5s"`
+	// DebugEndpoint to enable /debug/fetch showing circuit breaker states and retry counts
+	DebugEndpoint bool `env:"DEBUG_ENDPOINT" envDefault:"false"`
+	// RobotsTxt to respect robots.txt for the bot user agent. Hosts in RequireNonBotUA are exempt
+	RobotsTxt bool `env:"ROBOTS_TXT" envDefault:"false"`
+	// RobotsTxtAgent is the user-agent token matched against robots.txt
+	RobotsTxtAgent string `env:"ROBOTS_TXT_AGENT" envDefault:"SummalyBot"`
+	// RobotsTxtCacheTTL for fetched robots.txt
+	RobotsTxtCacheTTL time.Duration `env:"ROBOTS_TXT_CACHE_TTL" envDefault:"24h"`
+	// CookieJar to send back cookies set by sites within one summary
+	CookieJar bool `env:"COOKIE_JAR" envDefault:"false"`
+	// ConsentCookies to retry with when redirected to a consent page (host=name=value; name=value,*.example.com=...). Enables a cookie jar
+	ConsentCookies []string `env:"CONSENT_COOKIES"`
+	// ConsentHosts of consent pages. Defaults to known ones (consent.youtube.com, consent.google.com, ...)
+	ConsentHosts []string `env:"CONSENT_HOSTS"`
+	// HTTPCache for outgoing requests (memory, disk). Empty to disable
+	HTTPCache string `env:"HTTP_CACHE"`
+	// HTTPCacheMaxEntries for the memory cache
+	HTTPCacheMaxEntries int `env:"HTTP_CACHE_MAX_ENTRIES" envDefault:"1000"`
+	// HTTPCacheMaxSize in bytes for the memory or disk cache. Least recently used ones are removed. 0 for unlimited
+	HTTPCacheMaxSize int64 `env:"HTTP_CACHE_MAX_SIZE" envDefault:"67108864"`
+	// HTTPCacheMaxAge to keep unused entries in the disk cache. 0 for unlimited
+	HTTPCacheMaxAge time.Duration `env:"HTTP_CACHE_MAX_AGE" envDefault:"168h"`
+	// HTTPCacheDir for the disk cache. Defaults to a directory under os.TempDir
+	HTTPCacheDir string `env:"HTTP_CACHE_DIR"`
+	// HTTPCacheMaxBodySize in bytes to cache
+	HTTPCacheMaxBodySize int64 `env:"HTTP_CACHE_MAX_BODY_SIZE" envDefault:"10485760"`
+	// HeadOnlyThreshold to parse html only up to </head> (or the first body element after this many bytes). 0 to parse the whole document
+	HeadOnlyThreshold int64 `env:"HEAD_ONLY_THRESHOLD" envDefault:"65536"`
+	// VerifyIcon to check the icon exists and fall back to /favicon.ico
+	VerifyIcon bool `env:"VERIFY_ICON" envDefault:"false"`
+	// VerifyIconCacheTTL for icon check results
+	VerifyIconCacheTTL time.Duration `env:"VERIFY_ICON_CACHE_TTL" envDefault:"1h"`
+	// ImageProxySecret to sign image proxy urls. /proxy/image is enabled when set
+	ImageProxySecret string `env:"IMAGE_PROXY_SECRET"`
+	// ImageProxyRewrite to rewrite thumbnail and icon urls to the image proxy
+	ImageProxyRewrite bool `env:"IMAGE_PROXY_REWRITE" envDefault:"false"`
+	// ImageProxyBaseURL is the public url of this server used for rewritten urls
+	ImageProxyBaseURL string `env:"IMAGE_PROXY_BASE_URL"`
+	// ImageProxyMaxSize in bytes for proxied images
+	ImageProxyMaxSize int64 `env:"IMAGE_PROXY_MAX_SIZE" envDefault:"10485760"`
+	// ImageProxyMaxAge for Cache-Control of proxied images
+	ImageProxyMaxAge time.Duration `env:"IMAGE_PROXY_MAX_AGE" envDefault:"720h"`
+	// ThumbnailRewrite to rewrite thumbnail urls to resized renditions (/proxy/thumbnail)
+	ThumbnailRewrite bool `env:"THUMBNAIL_REWRITE" envDefault:"false"`
+	// ThumbnailMaxWidth of resized thumbnails
+	ThumbnailMaxWidth int `env:"THUMBNAIL_MAX_WIDTH" envDefault:"640"`
+	// ThumbnailMaxHeight of resized thumbnails
+	ThumbnailMaxHeight int `env:"THUMBNAIL_MAX_HEIGHT" envDefault:"640"`
+	// ThumbnailQuality for JPEG encoding
+	ThumbnailQuality int `env:"THUMBNAIL_QUALITY" envDefault:"80"`
+	// ThumbnailMaxPixels to refuse decoding larger images
+	ThumbnailMaxPixels int `env:"THUMBNAIL_MAX_PIXELS" envDefault:"50000000"`
+	// ThumbnailPlaceholder to add blurhash, dominant color and size of the thumbnail
+	ThumbnailPlaceholder bool `env:"THUMBNAIL_PLACEHOLDER" envDefault:"false"`
+	// ThumbnailCacheDir to store resized thumbnails. Defaults to a directory under os.TempDir
+	ThumbnailCacheDir string `env:"THUMBNAIL_CACHE_DIR"`
+	// ThumbnailCacheMaxSize in bytes of ThumbnailCacheDir. Least recently used ones are removed. 0 for unlimited
+	ThumbnailCacheMaxSize int64 `env:"THUMBNAIL_CACHE_MAX_SIZE" envDefault:"1073741824"`
+	// ThumbnailCacheMaxAge to keep unused thumbnails. 0 for unlimited
+	ThumbnailCacheMaxAge time.Duration `env:"THUMBNAIL_CACHE_MAX_AGE" envDefault:"720h"`
+}
+
+// proxyOpts は Proxy, ProxyHosts から *fetch.ProxyOpts を作る
+//
+// どちらも指定がなければ nil を返す
+func (c *Config) proxyOpts() (*fetch.ProxyOpts, error) {
+	if c.Proxy == "" && len(c.ProxyHosts) == 0 {
+		return nil, nil
+	}
+	parse := func(s string) (*url.URL, error) {
+		if s == "" || s == "direct" {
+			return nil, nil
+		}
+		u, err := url.Parse(s)
+		if err != nil {
+			return nil, err
+		}
+		switch u.Scheme {
+		case "http", "https", "socks5", "socks5h":
+		default:
+			return nil, fmt.Errorf("unsupported proxy scheme: %s", u.Scheme)
+		}
+		return u, nil
+	}
+
+	def, err := parse(c.Proxy)
+	if err != nil {
+		return nil, fmt.Errorf("invalid PROXY: %w", err)
+	}
+	opts := &fetch.ProxyOpts{
+		Default: def,
+		Hosts:   make(map[string]*url.URL, len(c.ProxyHosts)),
+	}
+	for host, v := range c.ProxyHosts {
+		u, err := parse(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid PROXY_HOSTS for %s: %w", host, err)
+		}
+		opts.Hosts[strings.ToLower(host)] = u
+	}
+	return opts, nil
+}
+
+// consentOpts は ConsentCookies, ConsentHosts から *fetch.ConsentOpts を作る
+//
+// ConsentCookies の指定がなければ nil を返す
+func (c *Config) consentOpts() (*fetch.ConsentOpts, error) {
+	if len(c.ConsentCookies) == 0 {
+		return nil, nil
+	}
+	opts := &fetch.ConsentOpts{
+		Cookies: make(map[string][]*http.Cookie, len(c.ConsentCookies)),
+		Hosts:   c.ConsentHosts,
+	}
+	for _, v := range c.ConsentCookies {
+		host, line, ok := strings.Cut(v, "=")
+		if !ok || host == "" {
+			return nil, fmt.Errorf("invalid CONSENT_COOKIES: %s", v)
+		}
+		cookies, err := http.ParseCookie(line)
+		if err != nil {
+			return nil, fmt.Errorf("invalid CONSENT_COOKIES for %s: %w", host, err)
+		}
+		opts.Cookies[strings.ToLower(host)] = cookies
+	}
+	return opts, nil
+}
+
+// rateLimitOpts は RateLimit* から *fetch.RateLimitOpts を作る
+func (c *Config) rateLimitOpts() (*fetch.RateLimitOpts, error) {
+	// 何も指定がなければ制限しない
+	if c.RateLimit <= 0 && c.RateLimitConcurrency <= 0 && len(c.RateLimitHosts) == 0 {
+		return nil, nil
+	}
+	opts := &fetch.RateLimitOpts{
+		Default: fetch.HostLimit{
+			Rate:           c.RateLimit,
+			Burst:          c.RateLimitBurst,
+			MaxConcurrency: c.RateLimitConcurrency,
+		},
+		Hosts:   make(map[string]fetch.HostLimit, len(c.RateLimitHosts)),
+		MaxWait: c.RateLimitMaxWait,
+	}
+	for host, v := range c.RateLimitHosts {
+		parts := strings.Split(v, ":")
+		if len(parts) != 3 {
+			return nil, fmt.Errorf("invalid RATE_LIMIT_HOSTS for %s: %s", host, v)
+		}
+		r, err := strconv.ParseFloat(parts[0], 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid RATE_LIMIT_HOSTS for %s: %w", host, err)
+		}
+		burst, err := strconv.Atoi(parts[1])
+		if err != nil {
+			return nil, fmt.Errorf("invalid RATE_LIMIT_HOSTS for %s: %w", host, err)
+		}
+		concurrency, err := strconv.Atoi(parts[2])
+		if err != nil {
+			return nil, fmt.Errorf("invalid RATE_LIMIT_HOSTS for %s: %w", host, err)
+		}
+		opts.Hosts[strings.ToLower(host)] = fetch.HostLimit{
+			Rate:           r,
+			Burst:          burst,
+			MaxConcurrency: concurrency,
+		}
+	}
+	return opts, nil
 }
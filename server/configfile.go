@@ -0,0 +1,125 @@
+package server
+
+import (
+	"fmt"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"github.com/caarlos0/env/v11"
+	"gopkg.in/yaml.v3"
+)
+
+// readConfigFile は YAML か TOML の設定ファイルを環境変数の名前と値にする
+//
+// キーは環境変数の名前 (大文字小文字は区別しない) で、
+// 配列はカンマ区切り、表は key=value のカンマ区切りにする
+//
+//	rate_limit: 1
+//	require_non_bot_ua_file: ./nonbot.txt
+//	ssrf_deny_hosts: [metadata.internal, "*.corp.example"]
+//	proxy_hosts:
+//	  example.com: socks5://127.0.0.1:1080
+func readConfigFile(name string) (map[string]string, error) {
+	b, err := os.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	raw := map[string]any{}
+	switch ext := strings.ToLower(filepath.Ext(name)); ext {
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(b, &raw)
+	case ".toml":
+		err = toml.Unmarshal(b, &raw)
+	default:
+		return nil, fmt.Errorf("unsupported config file extension: %s (.yaml, .yml, .toml)", ext)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	params, err := env.GetFieldParams(&Config{})
+	if err != nil {
+		return nil, err
+	}
+	known := make(map[string]bool, len(params))
+	for _, p := range params {
+		known[p.Key] = true
+	}
+
+	values := make(map[string]string, len(raw))
+	var errs []string
+	for _, k := range slices.Sorted(maps.Keys(raw)) {
+		key := strings.ToUpper(k)
+		if !known[key] || key == "CONFIG_FILE" {
+			errs = append(errs, fmt.Sprintf("unknown key: %s", k))
+			continue
+		}
+		v, err := configValue(raw[k])
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %v", k, err))
+			continue
+		}
+		values[key] = v
+	}
+	if len(errs) > 0 {
+		return nil, fmt.Errorf("%s", strings.Join(errs, "; "))
+	}
+	return values, nil
+}
+
+// configValue は設定ファイルの値を環境変数と同じ書き方の文字列にする
+func configValue(v any) (string, error) {
+	switch v := v.(type) {
+	case nil:
+		return "", nil
+	case string:
+		return v, nil
+	case bool, int, int64, uint64, float64:
+		return fmt.Sprint(v), nil
+	case []any:
+		s := make([]string, 0, len(v))
+		for _, e := range v {
+			e, err := configScalar(e)
+			if err != nil {
+				return "", err
+			}
+			s = append(s, e)
+		}
+		return strings.Join(s, ","), nil
+	case map[string]any:
+		s := make([]string, 0, len(v))
+		for _, k := range slices.Sorted(maps.Keys(v)) {
+			e, err := configScalar(v[k])
+			if err != nil {
+				return "", err
+			}
+			if strings.ContainsAny(k, ",=") {
+				return "", fmt.Errorf("key must not contain ',' or '=': %s", k)
+			}
+			s = append(s, k+"="+e)
+		}
+		return strings.Join(s, ","), nil
+	default:
+		return "", fmt.Errorf("unsupported value: %v", v)
+	}
+}
+
+// configScalar は配列や表の要素を文字列にする。区切りのカンマは含められない
+func configScalar(v any) (string, error) {
+	switch v.(type) {
+	case []any, map[string]any:
+		return "", fmt.Errorf("nested value is not supported: %v", v)
+	}
+	s, err := configValue(v)
+	if err != nil {
+		return "", err
+	}
+	if strings.Contains(s, ",") {
+		return "", fmt.Errorf("value must not contain ',': %s", s)
+	}
+	return s, nil
+}
@@ -0,0 +1,114 @@
+package server
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestReadConfigFile(t *testing.T) {
+	valid := map[string]string{
+		"RATE_LIMIT":       "1",
+		"TIMEOUT":          "30s",
+		"ALLOW_PRIVATE_IP": "true",
+		"SSRF_DENY_HOSTS":  "metadata.internal,*.corp.example",
+		"PROXY_HOSTS":      "*.example.org=direct,example.com=socks5://127.0.0.1:1080",
+	}
+	tests := []struct {
+		name    string
+		want    map[string]string
+		wantErr string
+	}{
+		{name: "valid.yaml", want: valid},
+		{name: "valid.toml", want: valid},
+		{name: "unknown.yaml", wantErr: "unknown key: config_file; unknown key: no_such_key"},
+		{name: "comma.yaml", wantErr: "value must not contain ','"},
+		{name: "comma_key.toml", wantErr: "key must not contain ',' or '='"},
+		{name: "nested.yaml", wantErr: "nested value is not supported"},
+		{name: "config.json", wantErr: "unsupported config file extension"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := readConfigFile(filepath.Join("testdata/config", tt.name))
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("err = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if diff := cmp.Diff(tt.want, got); diff != "" {
+				t.Errorf("readConfigFile() mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestConfigValue(t *testing.T) {
+	tests := []struct {
+		name    string
+		v       any
+		want    string
+		wantErr bool
+	}{
+		{name: "nil", v: nil, want: ""},
+		{name: "string", v: "a", want: "a"},
+		{name: "bool", v: true, want: "true"},
+		{name: "int", v: 10, want: "10"},
+		{name: "int64", v: int64(10), want: "10"},
+		{name: "float", v: 1.5, want: "1.5"},
+		{name: "array", v: []any{"a", 1, true}, want: "a,1,true"},
+		{name: "map", v: map[string]any{"b": 2, "a": "x"}, want: "a=x,b=2"},
+		{name: "comma in array", v: []any{"a,b"}, wantErr: true},
+		{name: "comma in map value", v: map[string]any{"a": "x,y"}, wantErr: true},
+		{name: "equal in map key", v: map[string]any{"a=b": "x"}, wantErr: true},
+		{name: "nested", v: []any{map[string]any{"a": 1}}, wantErr: true},
+		{name: "unsupported", v: struct{}{}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := configValue(tt.v)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("configValue() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLoadConfig(t *testing.T) {
+	t.Setenv("REQUIRE_NON_BOT_UA_FILE", os.DevNull)
+	// 環境変数が設定ファイルより優先される
+	t.Setenv("RATE_LIMIT", "5")
+	c, err := loadConfig("testdata/config/valid.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.RateLimit != 5 {
+		t.Errorf("RateLimit = %v, want 5", c.RateLimit)
+	}
+	if c.Timeout != 30*time.Second {
+		t.Errorf("Timeout = %v, want 30s", c.Timeout)
+	}
+	if want := []string{"metadata.internal", "*.corp.example"}; !cmp.Equal(c.SSRFDenyHosts, want) {
+		t.Errorf("SSRFDenyHosts = %v, want %v", c.SSRFDenyHosts, want)
+	}
+	if got := c.ProxyHosts["example.com"]; got != "socks5://127.0.0.1:1080" {
+		t.Errorf("ProxyHosts[example.com] = %q", got)
+	}
+	if c.ConfigFile != "testdata/config/valid.yaml" {
+		t.Errorf("ConfigFile = %q", c.ConfigFile)
+	}
+
+	if _, err := loadConfig("testdata/config/unknown.yaml"); err == nil {
+		t.Error("loadConfig(unknown.yaml) = nil, want error")
+	}
+}
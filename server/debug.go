@@ -0,0 +1,22 @@
+package server
+
+import (
+	"net/http"
+
+	"github.com/labstack/echo/v4"
+	"github.com/yulog/go-summaly/fetch"
+)
+
+type DebugFetch struct {
+	Retry    fetch.RetryStats     `json:"retry"`
+	Breakers []fetch.BreakerState `json:"breakers"`
+}
+
+// getDebugFetch は fetch.Client の状態を返す
+func (srv *Server) getDebugFetch(c echo.Context) error {
+	client := srv.getClient()
+	return c.JSON(http.StatusOK, DebugFetch{
+		Retry:    client.RetryStats(),
+		Breakers: client.BreakerStates(),
+	})
+}
@@ -0,0 +1,135 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/yulog/go-summaly/fetch"
+)
+
+const (
+	HealthOK          = "ok"
+	HealthUnavailable = "unavailable"
+)
+
+type Health struct {
+	Status string            `json:"status"`
+	Checks map[string]string `json:"checks,omitempty"` // 確認した項目ごとの結果
+}
+
+type Version struct {
+	Version  string `json:"version"`
+	Revision string `json:"revision"`
+}
+
+// readyCheck は ReadyCheckURL の確認結果を ReadyCheckTTL の間覚えておく
+type readyCheck struct {
+	mu   sync.Mutex
+	url  string
+	at   time.Time
+	err  error
+	wait chan struct{} // 確認中なら終わると閉じる
+}
+
+// getHealthz はプロセスが動いていることを返す
+func (srv *Server) getHealthz(c echo.Context) error {
+	return c.JSON(http.StatusOK, Health{Status: HealthOK})
+}
+
+// getReadyz は終了前でなく、設定を読み込み、 fetch.Client を作れていて、
+// ReadyCheckURL があればそれを取得できることを返す
+func (srv *Server) getReadyz(c echo.Context) error {
+	h := Health{Status: HealthOK, Checks: map[string]string{}}
+	fail := func(name, msg string) {
+		h.Status = HealthUnavailable
+		h.Checks[name] = msg
+	}
+
+	if srv.draining.Load() {
+		fail("shutdown", "draining")
+	}
+
+	live := srv.current()
+	switch {
+	case live == nil:
+		fail("config", "not loaded")
+	case live.client == nil:
+		h.Checks["config"] = HealthOK
+		fail("client", "not built")
+	default:
+		h.Checks["config"] = HealthOK
+		h.Checks["client"] = HealthOK
+		if live.config.ReadyCheckURL != "" {
+			if err := srv.checkReadyURL(c.Request().Context(), live); err != nil {
+				logger(c).Warn("ready check", "err", err)
+				fail("url", err.Error())
+			} else {
+				h.Checks["url"] = HealthOK
+			}
+		}
+	}
+
+	if h.Status != HealthOK {
+		return c.JSON(http.StatusServiceUnavailable, h)
+	}
+	return c.JSON(http.StatusOK, h)
+}
+
+// checkReadyURL は ReadyCheckURL を取得できるかを確認する
+//
+// プローブのたびに外へリクエストしないように、結果を ReadyCheckTTL の間使い回す。
+// 確認中に来たプローブは同じ結果を待ち、ロックを持ったまま外へリクエストしない
+func (srv *Server) checkReadyURL(ctx context.Context, live *live) error {
+	r := &srv.ready
+	raw := live.config.ReadyCheckURL
+
+	r.mu.Lock()
+	for r.wait != nil {
+		wait := r.wait
+		r.mu.Unlock()
+		select {
+		case <-wait:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		r.mu.Lock()
+	}
+	if r.url == raw && time.Since(r.at) < live.config.ReadyCheckTTL {
+		err := r.err
+		r.mu.Unlock()
+		return err
+	}
+	wait := make(chan struct{})
+	r.wait = wait
+	r.mu.Unlock()
+
+	// 待っている他のプローブのため、呼び出し元がキャンセルしても ReadyCheckTimeout までは続ける
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), live.config.ReadyCheckTimeout)
+	defer cancel()
+	u, err := url.Parse(raw)
+	if err == nil {
+		err = live.client.WithContext(ctx).NewRequest(u,
+			fetch.WithMethod(http.MethodHead),
+			fetch.WithAllowType([]string{"*"}),
+			fetch.WithUserAgent(live.config.BotUA),
+		).Check()
+	}
+
+	r.mu.Lock()
+	r.url, r.at, r.err, r.wait = raw, time.Now(), err, nil
+	r.mu.Unlock()
+	close(wait)
+	return err
+}
+
+// getVersion はバージョンとビルドしたリビジョンを返す
+func (srv *Server) getVersion(c echo.Context) error {
+	return c.JSON(http.StatusOK, Version{
+		Version:  srv.version,
+		Revision: srv.revision,
+	})
+}
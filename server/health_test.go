@@ -0,0 +1,165 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestHealthz(t *testing.T) {
+	srv := newTestServer(t, nil)
+	rec := serve(srv, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d, want %d", rec.Code, http.StatusOK)
+	}
+	var got Health
+	if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(Health{Status: HealthOK}, got); diff != "" {
+		t.Errorf("body mismatch (-want +got):\n%s", diff)
+	}
+}
+
+func TestVersion(t *testing.T) {
+	srv := newTestServer(t, nil).SetVersion("v1.2.3").SetRevision("abc")
+	rec := serve(srv, httptest.NewRequest(http.MethodGet, "/version", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d, want %d", rec.Code, http.StatusOK)
+	}
+	var got Version
+	if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(Version{Version: "v1.2.3", Revision: "abc"}, got); diff != "" {
+		t.Errorf("body mismatch (-want +got):\n%s", diff)
+	}
+}
+
+func TestReadyz(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		if r.URL.Path != "/ok" {
+			http.NotFound(w, r)
+		}
+	}))
+	defer ts.Close()
+
+	tests := []struct {
+		name     string
+		environ  map[string]string
+		draining bool
+		want     Health
+		wantCode int
+	}{
+		{
+			name:     "ok",
+			want:     Health{Status: HealthOK, Checks: map[string]string{"config": HealthOK, "client": HealthOK}},
+			wantCode: http.StatusOK,
+		},
+		{
+			name:     "draining",
+			draining: true,
+			want:     Health{Status: HealthUnavailable, Checks: map[string]string{"shutdown": "draining", "config": HealthOK, "client": HealthOK}},
+			wantCode: http.StatusServiceUnavailable,
+		},
+		{
+			name:     "url ok",
+			environ:  map[string]string{"READY_CHECK_URL": ts.URL + "/ok"},
+			want:     Health{Status: HealthOK, Checks: map[string]string{"config": HealthOK, "client": HealthOK, "url": HealthOK}},
+			wantCode: http.StatusOK,
+		},
+		{
+			name:     "url not found",
+			environ:  map[string]string{"READY_CHECK_URL": ts.URL + "/missing"},
+			want:     Health{Status: HealthUnavailable, Checks: map[string]string{"config": HealthOK, "client": HealthOK, "url": "unexpected status: 404 Not Found"}},
+			wantCode: http.StatusServiceUnavailable,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := newTestServer(t, tt.environ)
+			srv.draining.Store(tt.draining)
+			rec := serve(srv, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+			if rec.Code != tt.wantCode {
+				t.Errorf("status = %d, want %d", rec.Code, tt.wantCode)
+			}
+			var got Health
+			if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil {
+				t.Fatal(err)
+			}
+			if diff := cmp.Diff(tt.want, got); diff != "" {
+				t.Errorf("body mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestReadyz_CheckOnce(t *testing.T) {
+	var hits atomic.Int32
+	release := make(chan struct{})
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		<-release
+		w.Header().Set("Content-Type", "text/plain")
+	}))
+	defer ts.Close()
+
+	srv := newTestServer(t, map[string]string{"READY_CHECK_URL": ts.URL, "READY_CHECK_TTL": "1m"})
+	e := srv.newEcho()
+
+	// 確認中に来たプローブは同じ結果を待つ
+	var wg sync.WaitGroup
+	codes := make([]int, 5)
+	for i := range codes {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			rec := httptest.NewRecorder()
+			e.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+			codes[i] = rec.Code
+		}()
+	}
+	for hits.Load() == 0 {
+		runtime.Gosched()
+	}
+	close(release)
+	wg.Wait()
+
+	for i, code := range codes {
+		if code != http.StatusOK {
+			t.Errorf("codes[%d] = %d, want %d", i, code, http.StatusOK)
+		}
+	}
+	// TTL の間は結果を使い回す
+	if rec := serve(srv, httptest.NewRequest(http.MethodGet, "/readyz", nil)); rec.Code != http.StatusOK {
+		t.Errorf("status = %d, want %d", rec.Code, http.StatusOK)
+	}
+	if got := hits.Load(); got != 1 {
+		t.Errorf("hits = %d, want 1", got)
+	}
+}
+
+func TestReadyz_Timeout(t *testing.T) {
+	done := make(chan struct{})
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-done:
+		case <-r.Context().Done():
+		}
+	}))
+	defer ts.Close()
+	defer close(done)
+
+	srv := newTestServer(t, map[string]string{"READY_CHECK_URL": ts.URL, "READY_CHECK_TIMEOUT": "50ms", "RETRY_MAX": "0"})
+	rec := serve(srv, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("status = %d, want %d", rec.Code, http.StatusServiceUnavailable)
+	}
+}
@@ -0,0 +1,52 @@
+package server
+
+import (
+	"log/slog"
+
+	"github.com/labstack/echo/v4"
+	"github.com/labstack/echo/v4/middleware"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// logger は c のリクエスト ID と、あれば trace ID を付けた *slog.Logger を返す
+func logger(c echo.Context) *slog.Logger {
+	l := slog.Default().With("request_id", c.Response().Header().Get(echo.HeaderXRequestID))
+	if sc := trace.SpanContextFromContext(c.Request().Context()); sc.IsValid() {
+		l = l.With("trace_id", sc.TraceID().String())
+	}
+	return l
+}
+
+// requestLogger はリクエストごとに1行を slog で出力する middleware
+func requestLogger() echo.MiddlewareFunc {
+	return middleware.RequestLoggerWithConfig(middleware.RequestLoggerConfig{
+		HandleError: true,
+		LogLatency:  true,
+		LogRemoteIP: true,
+		LogMethod:   true,
+		LogURI:      true,
+		LogStatus:   true,
+		LogError:    true,
+		LogValuesFunc: func(c echo.Context, v middleware.RequestLoggerValues) error {
+			level := slog.LevelInfo
+			switch {
+			case v.Status >= 500:
+				level = slog.LevelError
+			case v.Status >= 400:
+				level = slog.LevelWarn
+			}
+			attrs := []slog.Attr{
+				slog.String("remote_ip", v.RemoteIP),
+				slog.String("method", v.Method),
+				slog.String("uri", v.URI),
+				slog.Int("status", v.Status),
+				slog.Duration("latency", v.Latency),
+			}
+			if v.Error != nil {
+				attrs = append(attrs, slog.String("err", v.Error.Error()))
+			}
+			logger(c).LogAttrs(c.Request().Context(), level, "request", attrs...)
+			return nil
+		},
+	})
+}
@@ -0,0 +1,128 @@
+package server
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/url"
+
+	"github.com/labstack/echo/v4"
+	"github.com/yulog/go-summaly"
+	"github.com/yulog/go-summaly/fetch"
+)
+
+var imageAllowType = []string{
+	"image/svg+xml",
+	"image/png",
+	"image/x-icon",
+	"image/vnd.microsoft.icon",
+	"image/jpeg",
+	"image/gif",
+	"image/webp",
+	"image/avif",
+}
+
+type ImageQuery struct {
+	URL string `query:"url" validate:"required,http_url"`
+	Sig string `query:"sig" validate:"required,hexadecimal"`
+}
+
+// sign は raw の HMAC-SHA256 署名を返す
+func (srv *Server) sign(raw string) string {
+	mac := hmac.New(sha256.New, []byte(srv.config.ImageProxySecret))
+	mac.Write([]byte(raw))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// verify は sig が raw の署名と一致するかを確認する
+func (srv *Server) verify(raw, sig string) bool {
+	want, err := hex.DecodeString(sig)
+	if err != nil {
+		return false
+	}
+	mac := hmac.New(sha256.New, []byte(srv.config.ImageProxySecret))
+	mac.Write([]byte(raw))
+	return hmac.Equal(mac.Sum(nil), want)
+}
+
+// proxyURL は raw を path の画像プロキシ経由の URL に書き換える
+func (srv *Server) proxyURL(path, raw string) string {
+	if raw == "" {
+		return ""
+	}
+	q := url.Values{}
+	q.Set("url", raw)
+	q.Set("sig", srv.sign(raw))
+	return srv.current().config.ImageProxyBaseURL + path + "?" + q.Encode()
+}
+
+// rewriteImages は Summary の画像 URL を画像プロキシ経由にする
+func (srv *Server) rewriteImages(s *summaly.Summary) {
+	thumbnail := s.Thumbnail
+	config := &srv.current().config
+	if config.ImageProxyRewrite {
+		s.Thumbnail = srv.proxyURL("/proxy/image", thumbnail)
+		s.Icon = srv.proxyURL("/proxy/image", s.Icon)
+	}
+	if config.ThumbnailRewrite {
+		s.Thumbnail = srv.proxyURL("/proxy/thumbnail", thumbnail)
+	}
+}
+
+// setImageHeaders はプロキシした画像のレスポンスヘッダを設定する
+func (srv *Server) setImageHeaders(c echo.Context) {
+	h := c.Response().Header()
+	h.Set("Cache-Control", fmt.Sprintf("public, max-age=%d, immutable", int(srv.current().config.ImageProxyMaxAge.Seconds())))
+	h.Set("X-Content-Type-Options", "nosniff")
+	// SVG 内のスクリプトを実行させない
+	h.Set("Content-Security-Policy", "default-src 'none'; style-src 'unsafe-inline'; sandbox")
+}
+
+// bindImageQuery は ImageQuery を検証し、署名済みの URL を返す
+func (srv *Server) bindImageQuery(c echo.Context) (*url.URL, error) {
+	q := new(ImageQuery)
+	if err := c.Bind(q); err != nil {
+		return nil, echo.NewHTTPError(http.StatusBadRequest)
+	}
+	if err := c.Validate(q); err != nil {
+		logger(c).Debug("validate", "err", err)
+		return nil, echo.NewHTTPError(http.StatusBadRequest)
+	}
+	if !srv.verify(q.URL, q.Sig) {
+		return nil, echo.NewHTTPError(http.StatusForbidden)
+	}
+	u, err := url.Parse(q.URL)
+	if err != nil {
+		return nil, echo.NewHTTPError(http.StatusBadRequest)
+	}
+	return u, nil
+}
+
+// requestClient は c のリクエストのログ (request_id) と context (キャンセル、 trace) を引き継ぐ *fetch.Client を返す
+func requestClient(c echo.Context, client *fetch.Client) *fetch.Client {
+	return client.WithLogger(logger(c)).WithContext(c.Request().Context())
+}
+
+func (srv *Server) getImageProxy(c echo.Context) error {
+	u, err := srv.bindImageQuery(c)
+	if err != nil {
+		return err
+	}
+
+	live := srv.current()
+	body, contentType, err := requestClient(c, live.client).NewRequest(u,
+		fetch.WithAccept("image/*"),
+		fetch.WithAllowType(imageAllowType),
+		fetch.WithLimit(live.config.ImageProxyMaxSize),
+		fetch.WithUserAgent(live.config.BotUA),
+	).GetRaw()
+	if err != nil {
+		logger(c).Warn("image proxy", "url", u.String(), "err", err)
+		return echo.NewHTTPError(http.StatusBadGateway)
+	}
+
+	srv.setImageHeaders(c)
+	return c.Blob(http.StatusOK, contentType, body)
+}
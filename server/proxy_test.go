@@ -0,0 +1,137 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"image"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
+	"testing"
+)
+
+func TestImageProxy(t *testing.T) {
+	var buf bytes.Buffer
+	png.Encode(&buf, image.NewRGBA(image.Rect(0, 0, 1, 1)))
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/a.png":
+			w.Header().Set("Content-Type", "image/png")
+			w.Write(buf.Bytes())
+		default:
+			w.Header().Set("Content-Type", "text/html")
+			w.Write([]byte("<html></html>"))
+		}
+	}))
+	defer upstream.Close()
+
+	srv := newTestServer(t, map[string]string{
+		"IMAGE_PROXY_SECRET":  "secret",
+		"IMAGE_PROXY_MAX_AGE": "1h",
+	})
+	imageURL := upstream.URL + "/a.png"
+	pageURL := upstream.URL + "/page"
+
+	tests := []struct {
+		name   string
+		url    string
+		sig    string
+		status int
+	}{
+		{"valid", imageURL, srv.sign(imageURL), http.StatusOK},
+		{"tampered url", imageURL + "?x", srv.sign(imageURL), http.StatusForbidden},
+		{"tampered sig", imageURL, srv.sign(pageURL), http.StatusForbidden},
+		{"invalid sig", imageURL, "zz", http.StatusBadRequest},
+		{"not image", pageURL, srv.sign(pageURL), http.StatusBadGateway},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q := url.Values{"url": {tt.url}, "sig": {tt.sig}}
+			rec := serve(srv, httptest.NewRequest(http.MethodGet, "/proxy/image?"+q.Encode(), nil))
+			if rec.Code != tt.status {
+				t.Fatalf("status = %d, want %d", rec.Code, tt.status)
+			}
+			if tt.status != http.StatusOK {
+				return
+			}
+			if !bytes.Equal(rec.Body.Bytes(), buf.Bytes()) {
+				t.Error("body differs from upstream")
+			}
+			want := map[string]string{
+				"Content-Type":           "image/png",
+				"Cache-Control":          "public, max-age=3600, immutable",
+				"X-Content-Type-Options": "nosniff",
+			}
+			for k, v := range want {
+				if got := rec.Header().Get(k); got != v {
+					t.Errorf("%s = %q, want %q", k, got, v)
+				}
+			}
+			if rec.Header().Get("Content-Security-Policy") == "" {
+				t.Error("Content-Security-Policy is not set")
+			}
+		})
+	}
+}
+
+func TestProxyURL(t *testing.T) {
+	srv := newTestServer(t, map[string]string{
+		"IMAGE_PROXY_SECRET":   "secret",
+		"IMAGE_PROXY_BASE_URL": "https://summaly.example",
+	})
+	raw := "https://example.com/a.png?b=c&d"
+	got, err := url.Parse(srv.proxyURL("/proxy/image", raw))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Host != "summaly.example" || got.Path != "/proxy/image" {
+		t.Errorf("proxyURL = %s", got)
+	}
+	if q := got.Query(); q.Get("url") != raw || !srv.verify(raw, q.Get("sig")) {
+		t.Errorf("query = %v", q)
+	}
+	if srv.proxyURL("/proxy/image", "") != "" {
+		t.Error("empty url should stay empty")
+	}
+}
+
+func TestImageProxy_AccessControl(t *testing.T) {
+	srv := newTestServer(t, map[string]string{
+		"IMAGE_PROXY_SECRET": "secret",
+		"API_KEYS":           "key",
+	})
+	imageURL := "http://127.0.0.1/a.png"
+	q := url.Values{"url": {imageURL}, "sig": {srv.sign(imageURL)}}
+	for _, path := range []string{"/proxy/image", "/proxy/thumbnail"} {
+		rec := serve(srv, httptest.NewRequest(http.MethodGet, path+"?"+q.Encode(), nil))
+		if rec.Code != http.StatusUnauthorized {
+			t.Errorf("%s: status = %d, want %d", path, rec.Code, http.StatusUnauthorized)
+		}
+	}
+}
+
+func TestImageProxy_Canceled(t *testing.T) {
+	var hits atomic.Int32
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+	}))
+	defer upstream.Close()
+
+	srv := newTestServer(t, map[string]string{"IMAGE_PROXY_SECRET": "secret"})
+	imageURL := upstream.URL + "/a.png"
+	q := url.Values{"url": {imageURL}, "sig": {srv.sign(imageURL)}}
+	for _, path := range []string{"/proxy/image", "/proxy/thumbnail"} {
+		// クライアントが切断したリクエストは取得しない
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		req := httptest.NewRequest(http.MethodGet, path+"?"+q.Encode(), nil).WithContext(ctx)
+		if rec := serve(srv, req); rec.Code != http.StatusBadGateway {
+			t.Errorf("%s: status = %d, want %d", path, rec.Code, http.StatusBadGateway)
+		}
+	}
+	if got := hits.Load(); got != 0 {
+		t.Errorf("upstream hits = %d, want 0", got)
+	}
+}
@@ -0,0 +1,271 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"maps"
+	"os"
+	"os/signal"
+	"reflect"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/caarlos0/env/v11"
+	"github.com/yulog/go-summaly/fetch"
+)
+
+// live は再読み込みで入れ替える設定と、それから作った *fetch.Client と *access
+type live struct {
+	config Config
+	opts   fetch.ClientOpts
+	client *fetch.Client
+	access *access
+}
+
+// current は今の設定を返す
+func (srv *Server) current() *live {
+	return srv.live.Load()
+}
+
+// loadConfig は環境変数と、 name があれば設定ファイルから Config を読み込む
+//
+// 環境変数を設定ファイルより優先する
+func loadConfig(name string) (Config, error) {
+	environ := env.ToMap(os.Environ())
+	if name != "" {
+		values, err := readConfigFile(name)
+		if err != nil {
+			return Config{}, fmt.Errorf("config file %s: %w", name, err)
+		}
+		for k, v := range values {
+			if _, ok := environ[k]; !ok {
+				environ[k] = v
+			}
+		}
+	}
+
+	var config Config
+	if err := env.ParseWithOptions(&config, env.Options{Environment: environ}); err != nil {
+		return Config{}, fmt.Errorf("invalid config: %w", err)
+	}
+	config.ConfigFile = name
+	return config, nil
+}
+
+// newLive は config から *live を作る
+//
+// fetch.ClientOpts が prev と同じなら *fetch.Client を使い回し、
+// レート制限やサーキットの状態を引き継ぐ。 *access も同じように引き継ぐ
+func (srv *Server) newLive(config Config, prev *live) (*live, error) {
+	opts, err := srv.clientOpts(&config)
+	if err != nil {
+		return nil, err
+	}
+	accessOpts, err := config.accessOpts()
+	if err != nil {
+		return nil, err
+	}
+	l := &live{config: config, opts: opts}
+	if prev != nil && reflect.DeepEqual(accessOpts, prev.access.opts) {
+		l.access = prev.access
+	} else {
+		l.access = newAccess(accessOpts)
+	}
+	if prev != nil && sameClientOpts(opts, prev.opts) {
+		l.client = prev.client
+		return l, nil
+	}
+	if l.client, err = fetch.NewClient(opts); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// sameClientOpts は a と b が同じ *fetch.Client になるかを返す
+func sameClientOpts(a, b fetch.ClientOpts) bool {
+	// Cache は起動時に作ったものを共有していて、中身は比べない
+	if a.Cache != b.Cache {
+		return false
+	}
+	a.Cache, b.Cache = nil, nil
+	return reflect.DeepEqual(a, b)
+}
+
+// clientOpts は c から fetch.ClientOpts を作る
+func (srv *Server) clientOpts(c *Config) (fetch.ClientOpts, error) {
+	proxy, err := c.proxyOpts()
+	if err != nil {
+		return fetch.ClientOpts{}, err
+	}
+	consent, err := c.consentOpts()
+	if err != nil {
+		return fetch.ClientOpts{}, err
+	}
+	rateLimit, err := c.rateLimitOpts()
+	if err != nil {
+		return fetch.ClientOpts{}, err
+	}
+	opts := fetch.ClientOpts{
+		AllowPrivateIP: c.AllowPrivateIP,
+		Timeout:        c.Timeout,
+		SSRF: fetch.SSRFPolicy{
+			DenyPrefixes:  c.SSRFDenyPrefixes,
+			AllowPrefixes: c.SSRFAllowPrefixes,
+			AllowHosts:    c.SSRFAllowHosts,
+			DenyHosts:     c.SSRFDenyHosts,
+		},
+		DNS: &fetch.DNSOpts{
+			Server:   c.DNSServer,
+			DoH:      c.DNSDoH,
+			CacheTTL: c.DNSCacheTTL,
+		},
+		Proxy:            proxy,
+		Cache:            srv.httpCache,
+		CacheMaxBodySize: c.HTTPCacheMaxBodySize,
+		RateLimit:        rateLimit,
+		CookieJar:        c.CookieJar,
+		Consent:          consent,
+	}
+	if c.RetryMax > 0 {
+		opts.Retry = &fetch.RetryOpts{
+			MaxRetries: c.RetryMax,
+			BaseDelay:  c.RetryBaseDelay,
+			MaxDelay:   c.RetryMaxDelay,
+		}
+	}
+	if c.BreakerThreshold > 0 {
+		opts.Breaker = &fetch.BreakerOpts{
+			Threshold:    c.BreakerThreshold,
+			OpenDuration: c.BreakerOpenDuration,
+		}
+	}
+	if c.RobotsTxt {
+		opts.Robots = &fetch.RobotsOpts{
+			Agent:  c.RobotsTxtAgent,
+			Exempt: c.RequireNonBotUA,
+			TTL:    c.RobotsTxtCacheTTL,
+		}
+	}
+	return opts, nil
+}
+
+// keepRestartOnly は起動時にしか反映しない設定を old の値に戻し、変わっていたものの名前を返す
+func (c *Config) keepRestartOnly(old *Config) []string {
+	var changed []string
+	keep(&changed, "PORT", &c.Port, old.Port)
+	keep(&changed, "HIDE_BANNER", &c.HideBanner, old.HideBanner)
+	keep(&changed, "PROFILES_FILE", &c.ProfilesFile, old.ProfilesFile)
+	keep(&changed, "PROFILES_RELOAD_INTERVAL", &c.ProfilesReloadInterval, old.ProfilesReloadInterval)
+	keep(&changed, "CONFIG_RELOAD_INTERVAL", &c.ConfigReloadInterval, old.ConfigReloadInterval)
+	keep(&changed, "DEBUG_ENDPOINT", &c.DebugEndpoint, old.DebugEndpoint)
+	keep(&changed, "OTEL_TRACES_EXPORTER", &c.TracesExporter, old.TracesExporter)
+	keep(&changed, "OTEL_SERVICE_NAME", &c.ServiceName, old.ServiceName)
+	keep(&changed, "HTTP_CACHE", &c.HTTPCache, old.HTTPCache)
+	keep(&changed, "HTTP_CACHE_MAX_ENTRIES", &c.HTTPCacheMaxEntries, old.HTTPCacheMaxEntries)
+	keep(&changed, "HTTP_CACHE_MAX_SIZE", &c.HTTPCacheMaxSize, old.HTTPCacheMaxSize)
+	keep(&changed, "HTTP_CACHE_MAX_AGE", &c.HTTPCacheMaxAge, old.HTTPCacheMaxAge)
+	keep(&changed, "HTTP_CACHE_DIR", &c.HTTPCacheDir, old.HTTPCacheDir)
+	keep(&changed, "VERIFY_ICON", &c.VerifyIcon, old.VerifyIcon)
+	keep(&changed, "VERIFY_ICON_CACHE_TTL", &c.VerifyIconCacheTTL, old.VerifyIconCacheTTL)
+	keep(&changed, "IMAGE_PROXY_SECRET", &c.ImageProxySecret, old.ImageProxySecret)
+	keep(&changed, "THUMBNAIL_CACHE_DIR", &c.ThumbnailCacheDir, old.ThumbnailCacheDir)
+	keep(&changed, "THUMBNAIL_CACHE_MAX_SIZE", &c.ThumbnailCacheMaxSize, old.ThumbnailCacheMaxSize)
+	keep(&changed, "THUMBNAIL_CACHE_MAX_AGE", &c.ThumbnailCacheMaxAge, old.ThumbnailCacheMaxAge)
+	return changed
+}
+
+func keep[T comparable](changed *[]string, name string, v *T, old T) {
+	if *v != old {
+		*changed = append(*changed, name)
+		*v = old
+	}
+}
+
+// Reload は設定を読み直し、実行中に変えられるものを反映する
+//
+// 処理中のリクエストは前の設定と *fetch.Client のまま続ける
+func (srv *Server) Reload() error {
+	config, err := loadConfig(srv.configFile)
+	if err != nil {
+		return err
+	}
+	if changed := config.keepRestartOnly(&srv.config); len(changed) > 0 {
+		slog.Warn("restart required to apply", "keys", strings.Join(changed, ", "))
+	}
+	l, err := srv.newLive(config, srv.current())
+	if err != nil {
+		return err
+	}
+	srv.live.Store(l)
+	srv.setLogLevel(config.LogLevel)
+
+	if srv.profiles != nil {
+		if err := srv.profiles.Reload(); err != nil {
+			return err
+		}
+	}
+	slog.Info("reloaded config")
+	return nil
+}
+
+func (srv *Server) setLogLevel(level slog.Level) {
+	if srv.logLevel != nil {
+		srv.logLevel.Set(level)
+	}
+}
+
+// watchedFiles は更新を確認するファイル
+func (srv *Server) watchedFiles() []string {
+	names := []string{srv.current().config.RequireNonBotUAFile}
+	if srv.configFile != "" {
+		names = append(names, srv.configFile)
+	}
+	return names
+}
+
+func modTimes(names []string) map[string]time.Time {
+	m := make(map[string]time.Time, len(names))
+	for _, name := range names {
+		// ないファイルはゼロ値にして、作られたら更新とみなす
+		if fi, err := os.Stat(name); err == nil {
+			m[name] = fi.ModTime()
+		} else {
+			m[name] = time.Time{}
+		}
+	}
+	return m
+}
+
+// watchReload は SIGHUP を受け取るか、 ConfigReloadInterval ごとに確認してファイルが更新されていたら Reload する
+func (srv *Server) watchReload(ctx context.Context) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+	var tick <-chan time.Time
+	if d := srv.config.ConfigReloadInterval; d > 0 {
+		t := time.NewTicker(d)
+		defer t.Stop()
+		tick = t.C
+	}
+
+	last := modTimes(srv.watchedFiles())
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hup:
+		case <-tick:
+			if maps.Equal(modTimes(srv.watchedFiles()), last) {
+				continue
+			}
+		}
+		if err := srv.Reload(); err != nil {
+			// 読み込めなくても前の設定で続ける
+			slog.Error("reload config", "err", err)
+		}
+		last = modTimes(srv.watchedFiles())
+	}
+}
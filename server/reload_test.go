@@ -0,0 +1,75 @@
+package server
+
+import (
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestConfig_KeepRestartOnly(t *testing.T) {
+	old := Config{Port: 1323, Timeout: time.Minute}
+	c := Config{Port: 8080, Timeout: time.Second}
+	changed := c.keepRestartOnly(&old)
+	if !slices.Equal(changed, []string{"PORT"}) {
+		t.Errorf("changed = %v, want [PORT]", changed)
+	}
+	if c.Port != 1323 {
+		t.Errorf("Port = %d, want 1323", c.Port)
+	}
+	// 実行中に変えられるものはそのまま
+	if c.Timeout != time.Second {
+		t.Errorf("Timeout = %v, want %v", c.Timeout, time.Second)
+	}
+}
+
+func TestServer_Reload(t *testing.T) {
+	srv := newTestServer(t, map[string]string{"PORT": "1323", "TIMEOUT": "60s"})
+	prev := srv.current()
+
+	t.Run("unchanged", func(t *testing.T) {
+		if err := srv.Reload(); err != nil {
+			t.Fatal(err)
+		}
+		l := srv.current()
+		if l == prev {
+			t.Error("live not replaced")
+		}
+		if l.client != prev.client {
+			t.Error("client not reused for the same ClientOpts")
+		}
+		if l.access != prev.access {
+			t.Error("access not reused for the same accessOpts")
+		}
+		prev = l
+	})
+
+	t.Run("restart only", func(t *testing.T) {
+		t.Setenv("PORT", "8080")
+		t.Setenv("TIMEOUT", "5s")
+		if err := srv.Reload(); err != nil {
+			t.Fatal(err)
+		}
+		l := srv.current()
+		if l.config.Port != 1323 {
+			t.Errorf("Port = %d, want 1323", l.config.Port)
+		}
+		if l.config.Timeout != 5*time.Second {
+			t.Errorf("Timeout = %v, want 5s", l.config.Timeout)
+		}
+		if l.client == prev.client {
+			t.Error("client reused for changed ClientOpts")
+		}
+		prev = l
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		t.Setenv("PROXY", "ftp://127.0.0.1")
+		if err := srv.Reload(); err == nil {
+			t.Fatal("Reload() = nil, want error")
+		}
+		// 読み込めなければ前の設定のまま
+		if srv.current() != prev {
+			t.Error("live replaced after a failed reload")
+		}
+	})
+}
@@ -1,31 +1,47 @@
 package server
 
 import (
+	"cmp"
 	"context"
+	"errors"
 	"fmt"
+	"log/slog"
 	"net/http"
 	"net/url"
 	"os"
 	"os/signal"
+	"path/filepath"
 	"strings"
-	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
-	"github.com/caarlos0/env/v11"
 	"github.com/go-playground/validator/v10"
 	"github.com/labstack/echo/v4"
 	"github.com/labstack/echo/v4/middleware"
 	"github.com/yulog/go-summaly"
 	"github.com/yulog/go-summaly/fetch"
+	"github.com/yulog/go-summaly/thumbnail"
 )
 
 type Server struct {
-	client *fetch.Client
-	once   sync.Once
+	live atomic.Pointer[live]
 
-	config Config
+	iconVerifier   *summaly.IconVerifier
+	profiles       *summaly.ProfileWatcher
+	thumbnailCache *thumbnail.DiskCache
+	httpCache      fetch.Cache
 
-	version string
+	// config は起動時の設定。実行中に変えられるものは current を使う
+	config     Config
+	configFile string
+	logLevel   *slog.LevelVar
+
+	ready    readyCheck
+	draining atomic.Bool // 終了前で新しいリクエストを受けないでほしい
+
+	version  string
+	revision string
 }
 
 type Query struct {
@@ -41,15 +57,74 @@ func (v *Validator) Validate(i interface{}) error {
 	return v.validator.Struct(i)
 }
 
-func New() *Server {
-	var config Config
-	if err := env.Parse(&config); err != nil {
+type Option func(*Server)
+
+// WithConfigFile は設定ファイルを指定する。 CONFIG_FILE より優先する
+func WithConfigFile(name string) Option {
+	return func(srv *Server) {
+		srv.configFile = name
+	}
+}
+
+// WithLogLevel は LOG_LEVEL を level に反映する
+func WithLogLevel(level *slog.LevelVar) Option {
+	return func(srv *Server) {
+		srv.logLevel = level
+	}
+}
+
+func New(options ...Option) *Server {
+	srv := &Server{}
+	for _, opt := range options {
+		opt(srv)
+	}
+	srv.configFile = cmp.Or(srv.configFile, os.Getenv("CONFIG_FILE"))
+
+	config, err := loadConfig(srv.configFile)
+	if err != nil {
 		fmt.Printf("%+v\n", err)
 		panic(err)
 	}
-	return &Server{
-		config: config,
+	srv.config = config
+	srv.setLogLevel(config.LogLevel)
+	srv.thumbnailCache = &thumbnail.DiskCache{
+		Dir:     cmp.Or(config.ThumbnailCacheDir, filepath.Join(os.TempDir(), "summaly-thumbnail")),
+		MaxSize: config.ThumbnailCacheMaxSize,
+		MaxAge:  config.ThumbnailCacheMaxAge,
+	}
+	if config.ProfilesFile != "" {
+		profiles, err := summaly.NewProfileWatcher(config.ProfilesFile, config.ProfilesReloadInterval)
+		if err != nil {
+			fmt.Printf("%+v\n", err)
+			panic(err)
+		}
+		srv.profiles = profiles
+	}
+	if config.VerifyIcon {
+		srv.iconVerifier = summaly.NewIconVerifier(config.VerifyIconCacheTTL)
 	}
+	switch config.HTTPCache {
+	case "":
+	case "memory":
+		srv.httpCache = fetch.NewMemoryCache(config.HTTPCacheMaxEntries, config.HTTPCacheMaxSize)
+	case "disk":
+		srv.httpCache = &fetch.DiskCache{
+			Dir:     cmp.Or(config.HTTPCacheDir, filepath.Join(os.TempDir(), "summaly-http-cache")),
+			MaxSize: config.HTTPCacheMaxSize,
+			MaxAge:  config.HTTPCacheMaxAge,
+		}
+	default:
+		err := fmt.Errorf("unknown HTTP_CACHE: %s", config.HTTPCache)
+		fmt.Printf("%+v\n", err)
+		panic(err)
+	}
+	l, err := srv.newLive(config, nil)
+	if err != nil {
+		fmt.Printf("%+v\n", err)
+		panic(err)
+	}
+	srv.live.Store(l)
+	return srv
 }
 
 func (srv *Server) SetVersion(version string) *Server {
@@ -57,14 +132,13 @@ func (srv *Server) SetVersion(version string) *Server {
 	return srv
 }
 
+func (srv *Server) SetRevision(revision string) *Server {
+	srv.revision = revision
+	return srv
+}
+
 func (srv *Server) getClient() *fetch.Client {
-	srv.once.Do(func() {
-		srv.client = fetch.NewClient(fetch.ClientOpts{
-			AllowPrivateIP: srv.config.AllowPrivateIP,
-			Timeout:        srv.config.Timeout,
-		})
-	})
-	return srv.client
+	return srv.current().client
 }
 
 func (srv *Server) getSummaly(c echo.Context) error {
@@ -73,7 +147,7 @@ func (srv *Server) getSummaly(c echo.Context) error {
 		return echo.NewHTTPError(http.StatusBadRequest)
 	}
 	if err := c.Validate(q); err != nil {
-		c.Logger().Error(err)
+		logger(c).Debug("validate", "err", err)
 		return echo.NewHTTPError(http.StatusBadRequest)
 	}
 	u, err := url.Parse(q.URL)
@@ -87,49 +161,129 @@ func (srv *Server) getSummaly(c echo.Context) error {
 		return echo.NewHTTPError(http.StatusBadRequest)
 	}
 
+	var profiles *summaly.Profiles
+	if srv.profiles != nil {
+		profiles = srv.profiles.Profiles()
+	}
+	live := srv.current()
 	summary, err := summaly.New(
 		u,
-		srv.getClient(),
+		live.client,
 		summaly.WithLang(q.Lang),
-		summaly.WithBotUA(srv.config.BotUA),
-		summaly.WithNonBotUA(srv.config.NonBotUA),
-		summaly.WithRequireNonBot(srv.config.RequireNonBotUA),
+		summaly.WithBotUA(live.config.BotUA),
+		summaly.WithNonBotUA(live.config.NonBotUA),
+		summaly.WithRequireNonBot(live.config.RequireNonBotUA),
+		summaly.WithProfiles(profiles),
+		summaly.WithIconVerifier(srv.iconVerifier),
+		summaly.WithPlaceholder(live.config.ThumbnailPlaceholder),
+		summaly.WithHeadOnly(live.config.HeadOnlyThreshold),
+		summaly.WithLogger(logger(c)),
+		summaly.WithContext(c.Request().Context()),
 	).ResolveUserAgent().Do()
 	if err != nil {
-		c.Logger().Error(err)
+		// Do がホストとともにログに出力している
+		if rle, be := new(fetch.RateLimitError), new(fetch.BreakerError); errors.As(err, &rle) || errors.As(err, &be) {
+			return echo.NewHTTPError(http.StatusServiceUnavailable)
+		}
+		if re := new(fetch.RobotsError); errors.As(err, &re) {
+			return echo.NewHTTPError(http.StatusForbidden)
+		}
 		return echo.NewHTTPError(http.StatusBadRequest)
 	}
+	if srv.config.ImageProxySecret != "" {
+		srv.rewriteImages(&summary)
+	}
 	return c.JSON(http.StatusOK, summary)
 }
 
-func (srv *Server) Start() {
-	if !srv.config.HideBanner {
-		PrintBanner(srv.version)
-	}
+// newEcho は middleware とルートを設定した *echo.Echo を返す
+func (srv *Server) newEcho() *echo.Echo {
 	e := echo.New()
 	e.HideBanner = srv.config.HideBanner
 	e.JSONSerializer = &JSONSerializer{}
-	e.Use(middleware.Logger())
+	// レート制限、ログ、 trace で同じクライアントの IP を使う
+	e.IPExtractor = func(req *http.Request) string {
+		return srv.current().access.clientIP(req)
+	}
+	e.Use(middleware.RequestID())
+	e.Use(tracing())
+	e.Use(requestLogger())
 	// e.Use(middleware.Gzip())
 	e.Use(middleware.Recover())
 	e.Validator = &Validator{validator: validator.New()}
-	e.GET("/", srv.getSummaly)
+	e.GET("/", srv.getSummaly, srv.accessControl())
+	e.GET("/healthz", srv.getHealthz)
+	e.GET("/readyz", srv.getReadyz)
+	e.GET("/version", srv.getVersion)
+	if srv.config.ImageProxySecret != "" {
+		e.GET("/proxy/image", srv.getImageProxy, srv.accessControl())
+		e.GET("/proxy/thumbnail", srv.getThumbnail, srv.accessControl())
+	}
+	if srv.config.DebugEndpoint {
+		e.GET("/debug/fetch", srv.getDebugFetch, srv.accessControl())
+	}
+	return e
+}
+
+func (srv *Server) Start() {
+	if !srv.config.HideBanner {
+		PrintBanner(srv.version)
+	}
+	e := srv.newEcho()
 
 	// https://echo.labstack.com/docs/cookbook/graceful-shutdown
-	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
 	defer stop()
 
+	go srv.watchReload(ctx)
+
+	shutdownTracing, err := setupTracing(ctx, &srv.config, srv.version)
+	if err != nil {
+		slog.Error("tracing", "err", err)
+		os.Exit(1)
+	}
+
 	go func() {
 		if err := e.Start(fmt.Sprintf(":%d", srv.config.Port)); err != nil && err != http.ErrServerClosed {
-			e.Logger.Fatal("shutting down the server")
+			slog.Error("shutting down the server", "err", err)
+			os.Exit(1)
 		}
 	}()
 
 	// Graceful Shutdown
 	<-ctx.Done()
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	// 2回目のシグナルではすぐに終了する
+	stop()
+
+	if err := srv.shutdown(context.Background(), e); err != nil {
+		slog.Error("shutdown", "err", err)
+		os.Exit(1)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), srv.current().config.ShutdownTimeout)
 	defer cancel()
-	if err := e.Shutdown(ctx); err != nil {
-		e.Logger.Fatal(err)
+	if err := shutdownTracing(ctx); err != nil {
+		slog.Error("shutdown tracing", "err", err)
 	}
 }
+
+// shutdown は /readyz を失敗させて ShutdownDrain の間受け付け続けたあと、
+// 処理中のリクエストを ShutdownTimeout まで待って e を止める
+func (srv *Server) shutdown(ctx context.Context, e *echo.Echo) error {
+	config := &srv.current().config
+
+	// ロードバランサーが外すまで /readyz を失敗させながら受け付け続ける
+	srv.draining.Store(true)
+	if config.ShutdownDrain > 0 {
+		slog.Info("draining", "duration", config.ShutdownDrain)
+		t := time.NewTimer(config.ShutdownDrain)
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			t.Stop()
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, config.ShutdownTimeout)
+	defer cancel()
+	return e.Shutdown(ctx)
+}
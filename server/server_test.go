@@ -0,0 +1,110 @@
+package server
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// newTestServer は環境変数 environ を設定して *Server を作る
+func newTestServer(t *testing.T, environ map[string]string) *Server {
+	t.Helper()
+	t.Setenv("REQUIRE_NON_BOT_UA_FILE", os.DevNull)
+	t.Setenv("ALLOW_PRIVATE_IP", "true")
+	t.Setenv("THUMBNAIL_CACHE_DIR", t.TempDir())
+	t.Setenv("CONFIG_RELOAD_INTERVAL", "0s")
+	for k, v := range environ {
+		t.Setenv(k, v)
+	}
+	return New()
+}
+
+// serve は srv のルートに req を送り、レスポンスを返す
+func serve(srv *Server, req *http.Request) *httptest.ResponseRecorder {
+	rec := httptest.NewRecorder()
+	srv.newEcho().ServeHTTP(rec, req)
+	return rec
+}
+
+func TestShutdown_Drain(t *testing.T) {
+	srv := newTestServer(t, map[string]string{"SHUTDOWN_DRAIN": "300ms", "SHUTDOWN_TIMEOUT": "5s"})
+	e := srv.newEcho()
+	e.HideBanner = true
+	e.HidePort = true
+	started := make(chan struct{})
+	release := make(chan struct{})
+	e.GET("/slow", func(c echo.Context) error {
+		close(started)
+		<-release
+		return c.String(http.StatusOK, "done")
+	})
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	e.Listener = ln
+	go e.Start("")
+	base := "http://" + ln.Addr().String()
+
+	type result struct {
+		code int
+		body string
+		err  error
+	}
+	slow := make(chan result, 1)
+	go func() {
+		resp, err := http.Get(base + "/slow")
+		if err != nil {
+			slow <- result{err: err}
+			return
+		}
+		defer resp.Body.Close()
+		b, err := io.ReadAll(resp.Body)
+		slow <- result{resp.StatusCode, string(b), err}
+	}()
+	<-started
+
+	done := make(chan error, 1)
+	go func() { done <- srv.shutdown(context.Background(), e) }()
+
+	// drain 中も新しい接続を受け付け、 /readyz は 503 を返す
+	deadline := time.Now().Add(time.Second)
+	for {
+		resp, err := http.Get(base + "/readyz")
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode == http.StatusServiceUnavailable {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("readyz status = %d, want %d", resp.StatusCode, http.StatusServiceUnavailable)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// 処理中のリクエストが終わるまで shutdown は戻らない
+	select {
+	case err := <-done:
+		t.Fatalf("shutdown returned before the in-flight request finished: %v", err)
+	case <-time.After(500 * time.Millisecond):
+	}
+	close(release)
+	if r := <-slow; r.err != nil || r.code != http.StatusOK || r.body != "done" {
+		t.Errorf("slow = %d %q %v, want 200 \"done\"", r.code, r.body, r.err)
+	}
+	if err := <-done; err != nil {
+		t.Errorf("shutdown: %v", err)
+	}
+	if _, err := http.Get(base + "/readyz"); err == nil {
+		t.Error("server still accepting after shutdown")
+	}
+}
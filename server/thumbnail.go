@@ -0,0 +1,53 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/labstack/echo/v4"
+	"github.com/yulog/go-summaly/fetch"
+	"github.com/yulog/go-summaly/thumbnail"
+)
+
+func (srv *Server) getThumbnail(c echo.Context) error {
+	u, err := srv.bindImageQuery(c)
+	if err != nil {
+		return err
+	}
+
+	live := srv.current()
+	key := fmt.Sprintf("%s %dx%d q%d", u, live.config.ThumbnailMaxWidth, live.config.ThumbnailMaxHeight, live.config.ThumbnailQuality)
+	if body, contentType, ok := srv.thumbnailCache.Get(key); ok {
+		srv.setImageHeaders(c)
+		return c.Blob(http.StatusOK, contentType, body)
+	}
+
+	body, _, err := requestClient(c, live.client).NewRequest(u,
+		fetch.WithAccept("image/*"),
+		fetch.WithAllowType(thumbnail.AllowType),
+		fetch.WithLimit(live.config.ImageProxyMaxSize),
+		fetch.WithUserAgent(live.config.BotUA),
+	).GetRaw()
+	if err != nil {
+		logger(c).Warn("thumbnail", "url", u.String(), "err", err)
+		return echo.NewHTTPError(http.StatusBadGateway)
+	}
+
+	body, contentType, err := thumbnail.Resize(body, thumbnail.Options{
+		MaxWidth:  live.config.ThumbnailMaxWidth,
+		MaxHeight: live.config.ThumbnailMaxHeight,
+		Quality:   live.config.ThumbnailQuality,
+		MaxPixels: live.config.ThumbnailMaxPixels,
+	})
+	if err != nil {
+		logger(c).Warn("thumbnail resize", "url", u.String(), "err", err)
+		return echo.NewHTTPError(http.StatusUnprocessableEntity)
+	}
+	if err := srv.thumbnailCache.Put(key, body, contentType); err != nil {
+		// キャッシュできなくてもエラーにしない
+		logger(c).Error("thumbnail cache", "err", err)
+	}
+
+	srv.setImageHeaders(c)
+	return c.Blob(http.StatusOK, contentType, body)
+}
@@ -1,11 +1,17 @@
 package summaly
 
 import (
+	"cmp"
+	"context"
 	"fmt"
+	"log/slog"
 	"net/url"
 	"slices"
+	"time"
 
 	"github.com/yulog/go-summaly/fetch"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
 	"golang.org/x/net/html"
 )
 
@@ -16,14 +22,25 @@ type Summaly struct {
 	BotUserAgent    string
 	NonBotUserAgent string
 	RequireNonBot   []string
-	Body            []byte
+	Profiles        *Profiles
+	Profile         *Profile // ResolveUserAgent で URL のホストに一致したもの
+	MediaType       string
+	Body            []byte // HTML 以外のときの先頭部分
+	BodyTruncated   bool   // Body が途中までのとき true
 	Node            *html.Node
 
-	Client *fetch.Client
+	Client       *fetch.Client
+	Context      context.Context // nil なら context.Background
+	Logger       *slog.Logger    // nil なら slog.Default
+	IconVerifier *IconVerifier
+	Placeholder  bool
+
+	// 0 より大きいときは HTML を </head> までだけパースする (fetch.ParseHead)
+	HeadThreshold int64
 }
 
 type Summarizer interface {
-	test() bool
+	test(*Summaly) bool
 	summarize(*Summaly) (Summary, error)
 }
 
@@ -70,11 +87,68 @@ func WithRequireNonBot(nonbot []string) func(*Summaly) {
 	}
 }
 
+// WithIconVerifier は icon の実在確認を有効にする
+func WithIconVerifier(v *IconVerifier) func(*Summaly) {
+	return func(s *Summaly) {
+		s.IconVerifier = v
+	}
+}
+
+// WithPlaceholder は thumbnail の blurhash, 代表色, 大きさの取得を有効にする
+func WithPlaceholder(enabled bool) func(*Summaly) {
+	return func(s *Summaly) {
+		s.Placeholder = enabled
+	}
+}
+
+// WithHeadOnly は HTML を </head> までだけパースする
+//
+// </head> がないときは threshold バイト以上読んだ後の最初の body の要素まで読む
+// タイトルと、説明か画像のどちらかが見つからなければ全体をパースし直す
+func WithHeadOnly(threshold int64) func(*Summaly) {
+	return func(s *Summaly) {
+		s.HeadThreshold = threshold
+	}
+}
+
+// WithLogger はログの出力先を指定する。 fetch.Client のログも含む
+func WithLogger(l *slog.Logger) func(*Summaly) {
+	return func(s *Summaly) {
+		s.Logger = l
+	}
+}
+
+// WithContext はリクエストのキャンセルと trace を引き継ぐ context.Context を指定する
+func WithContext(ctx context.Context) func(*Summaly) {
+	return func(s *Summaly) {
+		s.Context = ctx
+	}
+}
+
+// WithProfiles はホストごとの UserAgent, ヘッダーなどを指定する
+//
+// RequireNonBot より優先する
+func WithProfiles(p *Profiles) func(*Summaly) {
+	return func(s *Summaly) {
+		s.Profiles = p
+	}
+}
+
 func (s *Summaly) ResolveUserAgent() *Summaly {
+	if s.Profile == nil {
+		s.Profile = s.Profiles.Match(s.URL.Hostname())
+	}
+	if p := s.Profile; p != nil && p.AcceptLanguage != "" {
+		s.Lang = p.AcceptLanguage
+	}
 	if s.UserAgent != "" {
 		return s
 	}
-	if slices.Contains(s.RequireNonBot, s.URL.Hostname()) {
+	if p := s.Profile; p != nil && p.UserAgent != "" {
+		s.UserAgent = p.UserAgent
+	} else if p != nil && p.NonBot {
+		s.UserAgent = s.NonBotUserAgent
+	} else if slices.Contains(s.RequireNonBot, s.URL.Hostname()) {
 		s.UserAgent = s.NonBotUserAgent
 	} else {
 		s.UserAgent = s.BotUserAgent
@@ -83,37 +157,105 @@ func (s *Summaly) ResolveUserAgent() *Summaly {
 }
 
 // TODO: これ問題ないの？
-var ss = []Summarizer{new(General)}
+var ss = []Summarizer{new(General), new(Media)}
 
-func (s *Summaly) Do() (Summary, error) {
-	var err error
-	s.Node, err = s.Client.NewRequest(s.URL,
-		fetch.WithAcceptLanguage(s.Lang),
-		fetch.WithUserAgent(s.UserAgent),
-	).GetHtmlNode()
+// 直接リンクされたメディアとして受け付ける Content-Type
+var documentAllowType = []string{
+	"text/html",
+	"application/xhtml+xml",
+	"image/*",
+	"video/*",
+	"audio/*",
+	"application/pdf",
+}
+
+func (s *Summaly) Do() (_ Summary, err error) {
+	start := time.Now()
+	if s.Context == nil {
+		s.Context = context.Background()
+	}
+	var span trace.Span
+	s.Context, span = tracer.Start(s.Context, "Summaly.Do", trace.WithAttributes(
+		semconv.URLFull(s.URL.String()),
+		semconv.ServerAddress(s.URL.Hostname()),
+	))
+	defer func() {
+		recordError(span, err)
+		span.End()
+	}()
+
+	s.Logger = cmp.Or(s.Logger, slog.Default()).With("host", s.URL.Hostname())
+	// HTML, oEmbed, icon などで同じホストには同じ IP で接続し、 Cookie を共有する
+	s.Client = s.Client.Session().WithLogger(s.Logger).WithContext(s.Context)
+
+	options := append(s.requestOptions(),
+		fetch.WithAccept("text/html, application/xhtml+xml, */*;q=0.1"),
+		fetch.WithAllowType(documentAllowType),
+	)
+	if s.HeadThreshold > 0 {
+		options = append(options, fetch.WithHeadOnly(s.HeadThreshold, hasHeadSummary))
+	}
+	doc, err := s.Client.NewRequest(s.URL, options...).GetDocument()
 	if err != nil {
+		s.Logger.Warn("document", "err", err)
 		return Summary{}, err
 	}
+	s.MediaType = doc.MediaType
+	s.Node = doc.Node
+	s.Body = doc.Prefix
+	s.BodyTruncated = doc.Truncated
+	s.Logger.Debug("document", "mediaType", doc.MediaType, "duration", time.Since(start))
+	span.SetAttributes(mediaTypeKey.String(doc.MediaType))
 
 	// ss := []Summarizer{new(General)}
 	for _, v := range ss {
-		if v.test() {
-			return v.summarize(s)
+		if v.test(s) {
+			name := fmt.Sprintf("%T", v)
+			span.SetAttributes(summarizerKey.String(name))
+			summary, err := v.summarize(s)
+			if err != nil {
+				s.Logger.Warn("summarize", "summarizer", name, "err", err)
+				return Summary{}, err
+			}
+			s.Logger.Info("summarize", "summarizer", name, "duration", time.Since(start))
+			return summary, nil
 		}
 	}
-	return Summary{}, fmt.Errorf("failed summarize")
+	err = fmt.Errorf("failed summarize")
+	s.Logger.Warn("summarize", "mediaType", s.MediaType, "err", err)
+	return Summary{}, err
+}
+
+// requestOptions は URL 自体を取得するときの UserAgent, Accept-Language, プロファイルのヘッダーなどを返す
+func (s *Summaly) requestOptions() []fetch.Option {
+	options := []fetch.Option{
+		fetch.WithAcceptLanguage(s.Lang),
+		fetch.WithUserAgent(s.UserAgent),
+	}
+	if p := s.Profile; p != nil {
+		options = append(options,
+			fetch.WithHeaders(p.Headers),
+			fetch.WithHeaderHosts(p.Matches),
+			fetch.WithCookies(p.Cookies),
+		)
+	}
+	return options
 }
 
 // TODO: 不要な部分はomitemptyでも良い？nullにしないとダメ？
 type Summary struct {
-	Title       string  `json:"title"`
-	Icon        string  `json:"icon"`
-	Description string  `json:"description"`
-	Thumbnail   string  `json:"thumbnail"`
-	Player      *Player `json:"player,omitempty"`
-	Sitename    string  `json:"sitename"`
-	Sensitive   bool    `json:"sensitive"`
-	URL         string  `json:"url"`
+	Title         string         `json:"title"`
+	Icon          string         `json:"icon"`
+	Description   string         `json:"description"`
+	Thumbnail     string         `json:"thumbnail"`
+	ThumbnailInfo *ThumbnailInfo `json:"thumbnailInfo,omitempty"`
+	Player        *Player        `json:"player,omitempty"`
+	Sitename      string         `json:"sitename"`
+	Sensitive     bool           `json:"sensitive"`
+	MediaType     string         `json:"mediaType,omitempty"`
+	Author        string         `json:"author,omitempty"`
+	ThemeColor    *ThemeColor    `json:"themeColor,omitempty"`
+	URL           string         `json:"url"`
 }
 
 // TODO: 不要な部分はomitemptyでも良い？nullにしないとダメ？
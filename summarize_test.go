@@ -1,17 +1,32 @@
 package summaly
 
 import (
+	"bytes"
 	"html/template"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
 	"io/fs"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
 	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
 	"github.com/google/go-cmp/cmp"
+	"github.com/yulog/go-favicon"
 	"github.com/yulog/go-summaly/fetch"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"golang.org/x/net/html"
 )
 
 func convptr[T any](i T) *any {
@@ -44,10 +59,14 @@ func setupServer(template, file string) (mux *http.ServeMux, serverURL string, t
 }
 
 func testClient(allowPrivateIP bool) *fetch.Client {
-	return fetch.NewClient(fetch.ClientOpts{
+	c, err := fetch.NewClient(fetch.ClientOpts{
 		AllowPrivateIP: allowPrivateIP,
 		Timeout:        60 * time.Second,
 	})
+	if err != nil {
+		panic(err)
+	}
+	return c
 }
 
 // TestSummaly_Do_NoFavicon
@@ -780,6 +799,887 @@ func TestSummaly_Do_oEmbedInvalid(t *testing.T) {
 	}
 }
 
+func TestSummaly_Do_ThemeColor(t *testing.T) {
+	client := testClient(true)
+
+	tests := []struct {
+		name     string
+		s        *Summaly
+		want     Summary
+		wantErr  bool
+		file     string
+		template string
+		manifest string
+	}{
+		{
+			name: "meta theme-color",
+			s: &Summaly{
+				URL:    nil,
+				Client: client,
+			},
+			want: Summary{
+				Title: "Strawberry Pasta",
+				ThemeColor: &ThemeColor{
+					Color: "#4285f4",
+					Light: "#ffffff",
+					Dark:  "#000000",
+				},
+			},
+			file:     "oembed.json",
+			template: "theme-color.html",
+		},
+		{
+			name: "manifest theme_color",
+			s: &Summaly{
+				URL:    nil,
+				Client: client,
+			},
+			want: Summary{
+				Title: "Strawberry Pasta",
+				ThemeColor: &ThemeColor{
+					Color: "#9932cc",
+				},
+			},
+			file:     "oembed.json",
+			template: "manifest.html",
+			manifest: "manifest.webmanifest",
+		},
+		{
+			name: "lowercase msapplication-tilecolor",
+			s: &Summaly{
+				URL:    nil,
+				Client: client,
+			},
+			want: Summary{
+				Title: "Strawberry Pasta",
+				ThemeColor: &ThemeColor{
+					Color: "#da532c",
+				},
+			},
+			file:     "oembed.json",
+			template: "tile-color.html",
+		},
+		{
+			name: "no theme-color",
+			s: &Summaly{
+				URL:    nil,
+				Client: client,
+			},
+			want: Summary{
+				Title:      "Strawberry Pasta",
+				ThemeColor: nil,
+			},
+			file:     "oembed.json",
+			template: "no-favicon.html",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mux, serverURL, teardown := setupServer(tt.template, tt.file)
+			defer teardown()
+			mux.HandleFunc("/manifest.webmanifest", func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "application/manifest+json")
+				http.ServeFile(w, r, "testdata/manifest/"+tt.manifest)
+			})
+
+			u, _ := url.Parse(serverURL)
+			// テスト用サーバのURLをセット。この方法は良くないかも？
+			tt.s.URL = u
+			tt.want.URL = u.String()
+			tt.want.Sitename = u.Host
+
+			got, err := tt.s.Do()
+			if (err != nil) != tt.wantErr {
+				t.Errorf("Summaly.Do() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if diff := cmp.Diff(tt.want, got); diff != "" {
+				t.Errorf("(-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestSummaly_Do_Manifest(t *testing.T) {
+	client := testClient(true)
+
+	tests := []struct {
+		name     string
+		s        *Summaly
+		want     Summary
+		wantErr  bool
+		file     string
+		template string
+		manifest string
+	}{
+		{
+			name: "manifest icons and name",
+			s: &Summaly{
+				URL:    nil,
+				Client: client,
+			},
+			want: Summary{
+				Title:    "Strawberry Pasta",
+				Icon:     "/icons/512.png",
+				Sitename: "Alice's App",
+				ThemeColor: &ThemeColor{
+					Color: "#da532c",
+				},
+			},
+			file:     "oembed.json",
+			template: "manifest.html",
+			manifest: "manifest-icons.webmanifest",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mux, serverURL, teardown := setupServer(tt.template, tt.file)
+			defer teardown()
+			mux.HandleFunc("/manifest.webmanifest", func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "application/manifest+json")
+				http.ServeFile(w, r, "testdata/manifest/"+tt.manifest)
+			})
+
+			u, _ := url.Parse(serverURL)
+			// テスト用サーバのURLをセット。この方法は良くないかも？
+			tt.s.URL = u
+			tt.want.URL = u.String()
+			if tt.want.Icon != "" {
+				tt.want.Icon = u.String() + tt.want.Icon
+			}
+
+			got, err := tt.s.Do()
+			if (err != nil) != tt.wantErr {
+				t.Errorf("Summaly.Do() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if diff := cmp.Diff(tt.want, got); diff != "" {
+				t.Errorf("(-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestSummaly_Do_VerifyIcon(t *testing.T) {
+	client := testClient(true)
+
+	tests := []struct {
+		name     string
+		s        *Summaly
+		want     Summary
+		wantErr  bool
+		file     string
+		template string
+		images   map[string]string // path -> Content-Type
+	}{
+		{
+			name: "root favicon",
+			s: &Summaly{
+				URL:          nil,
+				Client:       client,
+				IconVerifier: NewIconVerifier(time.Minute),
+			},
+			want: Summary{
+				Title: "Strawberry Pasta",
+				Icon:  "/favicon.ico",
+			},
+			file:     "oembed.json",
+			template: "no-favicon.html",
+			images:   map[string]string{"/favicon.ico": "image/x-icon"},
+		},
+		{
+			name: "no root favicon",
+			s: &Summaly{
+				URL:          nil,
+				Client:       client,
+				IconVerifier: NewIconVerifier(time.Minute),
+			},
+			want: Summary{
+				Title: "Strawberry Pasta",
+				Icon:  "",
+			},
+			file:     "oembed.json",
+			template: "no-favicon.html",
+		},
+		{
+			name: "skip dead icon",
+			s: &Summaly{
+				URL:          nil,
+				Client:       client,
+				IconVerifier: NewIconVerifier(time.Minute),
+			},
+			want: Summary{
+				Title: "Strawberry Pasta",
+				Icon:  "/alive.png",
+			},
+			file:     "oembed.json",
+			template: "dead-favicon.html",
+			images: map[string]string{
+				"/alive.png":   "image/png",
+				"/favicon.ico": "image/x-icon",
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mux, serverURL, teardown := setupServer(tt.template, tt.file)
+			defer teardown()
+			for path, ct := range tt.images {
+				mux.HandleFunc(path, func(w http.ResponseWriter, r *http.Request) {
+					w.Header().Set("Content-Type", ct)
+				})
+			}
+
+			u, _ := url.Parse(serverURL)
+			// テスト用サーバのURLをセット。この方法は良くないかも？
+			tt.s.URL = u
+			tt.want.URL = u.String()
+			tt.want.Sitename = u.Host
+			if tt.want.Icon != "" {
+				tt.want.Icon = u.String() + tt.want.Icon
+			}
+
+			got, err := tt.s.Do()
+			if (err != nil) != tt.wantErr {
+				t.Errorf("Summaly.Do() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if diff := cmp.Diff(tt.want, got); diff != "" {
+				t.Errorf("(-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestIconVerifier_MaxEntries(t *testing.T) {
+	v := NewIconVerifier(time.Minute)
+	v.MaxEntries = 2
+
+	v.store("a", true)
+	v.store("b", true)
+	v.load("a") // a を最近使ったことにする
+	v.store("c", false)
+
+	if _, cached := v.load("b"); cached {
+		t.Error("b should be evicted")
+	}
+	for _, key := range []string{"a", "c"} {
+		if _, cached := v.load(key); !cached {
+			t.Errorf("%s should be cached", key)
+		}
+	}
+	if got := len(v.cache); got != 2 {
+		t.Errorf("len = %d, want 2", got)
+	}
+}
+
+func TestIconVerifier_ZeroValue(t *testing.T) {
+	v := &IconVerifier{TTL: time.Minute}
+	if _, cached := v.load("a"); cached {
+		t.Error("a should not be cached")
+	}
+	v.store("a", true)
+	if ok, cached := v.load("a"); !ok || !cached {
+		t.Errorf("load(a) = %v, %v, want true, true", ok, cached)
+	}
+}
+
+func TestIconVerifier_Resolve(t *testing.T) {
+	var mu sync.Mutex
+	hits := map[string]int{}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		hits[r.URL.Path]++
+		mu.Unlock()
+		switch r.URL.Path {
+		case "/gone.png":
+			w.WriteHeader(http.StatusGone)
+		case "/error.png":
+			w.WriteHeader(http.StatusForbidden)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer ts.Close()
+	base, _ := url.Parse(ts.URL)
+	icons := func(paths ...string) []*favicon.Icon {
+		var icons []*favicon.Icon
+		for _, p := range paths {
+			icons = append(icons, &favicon.Icon{URL: ts.URL + p})
+		}
+		return icons
+	}
+
+	t.Run("negative cache", func(t *testing.T) {
+		v := NewIconVerifier(time.Minute)
+		for range 2 {
+			if got := v.Resolve(testClient(true), base, icons("/gone.png", "/error.png"), "UA"); got != "" {
+				t.Errorf("Resolve() = %q, want empty", got)
+			}
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		// 404, 410 だけを覚える
+		want := map[string]int{"/gone.png": 1, "/error.png": 2, "/favicon.ico": 1}
+		if diff := cmp.Diff(want, hits); diff != "" {
+			t.Errorf("hits mismatch (-want +got):\n%s", diff)
+		}
+		clear(hits)
+	})
+
+	t.Run("max checks", func(t *testing.T) {
+		v := NewIconVerifier(time.Minute)
+		v.MaxChecks = 2
+		v.Resolve(testClient(true), base, icons("/1.png", "/2.png", "/3.png"), "UA")
+		mu.Lock()
+		defer mu.Unlock()
+		want := map[string]int{"/1.png": 1, "/2.png": 1}
+		if diff := cmp.Diff(want, hits); diff != "" {
+			t.Errorf("hits mismatch (-want +got):\n%s", diff)
+		}
+		clear(hits)
+	})
+}
+
+func TestSummaly_Do_Placeholder(t *testing.T) {
+	client := testClient(true)
+
+	pngData := testPNG(t, 64, 32, color.RGBA{R: 0xff, A: 0xff})
+
+	tests := []struct {
+		name     string
+		s        *Summaly
+		want     *ThumbnailInfo
+		file     string
+		template string
+	}{
+		{
+			name: "placeholder",
+			s: &Summaly{
+				URL:         nil,
+				Client:      client,
+				Placeholder: true,
+			},
+			want: &ThumbnailInfo{
+				Width:  64,
+				Height: 32,
+				Color:  "#ff0000",
+			},
+			file:     "oembed.json",
+			template: "og-image-local.html",
+		},
+		{
+			name: "disabled",
+			s: &Summaly{
+				URL:    nil,
+				Client: client,
+			},
+			want:     nil,
+			file:     "oembed.json",
+			template: "og-image-local.html",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mux, serverURL, teardown := setupServer(tt.template, tt.file)
+			defer teardown()
+			mux.HandleFunc("/image.png", func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "image/png")
+				w.Write(pngData)
+			})
+
+			u, _ := url.Parse(serverURL)
+			// テスト用サーバのURLをセット。この方法は良くないかも？
+			tt.s.URL = u
+
+			got, err := tt.s.Do()
+			if err != nil {
+				t.Fatalf("Summaly.Do() error = %v", err)
+			}
+			if got.Thumbnail != u.String()+"/image.png" {
+				t.Errorf("Thumbnail = %s", got.Thumbnail)
+			}
+			if got.ThumbnailInfo != nil {
+				if got.ThumbnailInfo.Blurhash == "" {
+					t.Error("Blurhash is empty")
+				}
+				got.ThumbnailInfo.Blurhash = ""
+			}
+			if diff := cmp.Diff(tt.want, got.ThumbnailInfo); diff != "" {
+				t.Errorf("(-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func testPNG(t *testing.T, width, height int, c color.Color) []byte {
+	t.Helper()
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	draw.Draw(img, img.Bounds(), &image.Uniform{c}, image.Point{}, draw.Src)
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestSummaly_Do_Media(t *testing.T) {
+	client := testClient(true)
+
+	pdf, err := os.ReadFile("testdata/media/sample.pdf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// trailer と Info 辞書が先頭 1MiB より後ろにある PDF
+	header, rest, _ := bytes.Cut(pdf, []byte("\n"))
+	largePDF := slices.Concat(header, []byte("\n%"), bytes.Repeat([]byte("x"), 1<<20), []byte("\n"), rest)
+
+	tests := []struct {
+		name        string
+		path        string
+		contentType string
+		body        []byte
+		ranges      bool // Range に対応する
+		want        Summary
+		wantErr     bool
+	}{
+		{
+			name:        "image",
+			path:        "/photo.png",
+			contentType: "image/png",
+			body:        testPNG(t, 120, 80, color.White),
+			want: Summary{
+				Title:     "photo.png",
+				Thumbnail: "WANT_URL",
+				ThumbnailInfo: &ThumbnailInfo{
+					Width:  120,
+					Height: 80,
+				},
+				MediaType: "image/png",
+			},
+		},
+		{
+			name:        "video",
+			path:        "/movie.mp4",
+			contentType: "video/mp4",
+			body:        []byte("\x00\x00\x00\x18ftypmp42"),
+			want: Summary{
+				Title:     "movie.mp4",
+				MediaType: "video/mp4",
+			},
+		},
+		{
+			name:        "audio",
+			path:        "/sound",
+			contentType: "audio/mpeg",
+			body:        []byte("ID3"),
+			want: Summary{
+				Title:     "sound",
+				MediaType: "audio/mpeg",
+			},
+		},
+		{
+			name:        "pdf",
+			path:        "/docs/recipe.pdf",
+			contentType: "application/pdf",
+			body:        pdf,
+			want: Summary{
+				Title:     "Strawberry (Pasta) Recipe",
+				Author:    "Alice アリス",
+				MediaType: "application/pdf",
+			},
+		},
+		{
+			name:        "large pdf",
+			path:        "/docs/recipe.pdf",
+			contentType: "application/pdf",
+			body:        largePDF,
+			ranges:      true,
+			want: Summary{
+				Title:     "Strawberry (Pasta) Recipe",
+				Author:    "Alice アリス",
+				MediaType: "application/pdf",
+			},
+		},
+		{
+			name:        "large pdf without range",
+			path:        "/docs/recipe.pdf",
+			contentType: "application/pdf",
+			body:        largePDF,
+			want: Summary{
+				Title:     "Strawberry (Pasta) Recipe",
+				Author:    "Alice アリス",
+				MediaType: "application/pdf",
+			},
+		},
+		{
+			name:        "unsupported",
+			path:        "/archive.zip",
+			contentType: "application/zip",
+			body:        []byte("PK"),
+			wantErr:     true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mux, serverURL, teardown := setupServer("no-favicon.html", "oembed.json")
+			defer teardown()
+			mux.HandleFunc(tt.path, func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", tt.contentType)
+				if tt.ranges {
+					http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(tt.body))
+					return
+				}
+				w.Write(tt.body)
+			})
+
+			u, _ := url.Parse(serverURL + tt.path)
+			s := &Summaly{
+				URL:    u,
+				Client: client,
+			}
+			if !tt.wantErr {
+				tt.want.URL = u.String()
+				tt.want.Sitename = u.Host
+			}
+			if tt.want.Thumbnail == "WANT_URL" {
+				tt.want.Thumbnail = u.String()
+			}
+
+			got, err := s.Do()
+			if (err != nil) != tt.wantErr {
+				t.Errorf("Summaly.Do() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if diff := cmp.Diff(tt.want, got); diff != "" {
+				t.Errorf("(-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+// TestSummaly_Do_HeadOnly
+// </head> までのパースでも全体をパースしたときと同じ結果になる
+func TestSummaly_Do_HeadOnly(t *testing.T) {
+	client := testClient(true)
+
+	paths, err := fs.Glob(os.DirFS("testdata/htmls"), "*.html")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range paths {
+		t.Run(path, func(t *testing.T) {
+			_, serverURL, teardown := setupServer(path, "oembed.json")
+			defer teardown()
+
+			u, _ := url.Parse(serverURL)
+			want, wantErr := (&Summaly{URL: u, Client: client}).Do()
+			got, err := (&Summaly{URL: u, Client: client, HeadThreshold: 1}).Do()
+			if (err != nil) != (wantErr != nil) {
+				t.Fatalf("Summaly.Do() error = %v, want %v", err, wantErr)
+			}
+			if diff := cmp.Diff(want, got); diff != "" {
+				t.Errorf("(-full +head):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestHasHeadSummary(t *testing.T) {
+	tests := []struct {
+		head string
+		want bool
+	}{
+		{`<title>a</title>`, false},
+		{`<title>a</title><meta name="description" content="b">`, true},
+		{`<meta property="og:title" content="a"><meta property="og:image" content="/i.png">`, true},
+		{`<title>a</title><meta name="Twitter:Image" content="/i.png">`, true},
+		{`<title>a</title><link rel="image_src" href="/i.png">`, true},
+		{`<meta name="description" content="b">`, false},
+		{`<title>a</title><meta property="og:description" content="">`, false},
+	}
+	for _, tt := range tests {
+		n, err := html.Parse(strings.NewReader("<html><head>" + tt.head + "</head></html>"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := hasHeadSummary(n); got != tt.want {
+			t.Errorf("hasHeadSummary(%q) = %v, want %v", tt.head, got, tt.want)
+		}
+	}
+}
+
+func TestProfiles_Match(t *testing.T) {
+	for _, name := range []string{"profiles.json", "profiles.yaml", "profiles.toml"} {
+		t.Run(name, func(t *testing.T) {
+			profiles, err := LoadProfiles(filepath.Join("testdata/profiles", name))
+			if err != nil {
+				t.Fatal(err)
+			}
+			testProfilesMatch(t, profiles)
+		})
+	}
+}
+
+func testProfilesMatch(t *testing.T, profiles *Profiles) {
+	t.Helper()
+	if p := profiles.Match("127.0.0.1"); p == nil || p.Headers["X-Summaly-Test"] != "profile" || p.Cookies["consent"] != "yes" || p.AcceptLanguage != "ja-JP" {
+		t.Errorf("Match(127.0.0.1) = %+v", p)
+	}
+
+	tests := []struct {
+		host string
+		want string // Host
+	}{
+		{host: "exact.example", want: "exact.example"},
+		{host: "EXACT.example", want: "exact.example"},
+		{host: "sub.exact.example", want: ""},
+		{host: "suffix.example", want: ".suffix.example"},
+		{host: "a.b.suffix.example", want: ".suffix.example"},
+		{host: "notsuffix.example", want: ""},
+		{host: "a.wild.example", want: "*.wild.example"},
+		{host: "wild.example", want: ""},
+		{host: "regex.example", want: `/^(www\.)?regex\.example$/`},
+		{host: "www.regex.example", want: `/^(www\.)?regex\.example$/`},
+		{host: "api.regex.example", want: ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.host, func(t *testing.T) {
+			var got string
+			if p := profiles.Match(tt.host); p != nil {
+				got = p.Host
+			}
+			if got != tt.want {
+				t.Errorf("Match(%q) = %q, want %q", tt.host, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSummaly_Do_Profile(t *testing.T) {
+	profiles, err := LoadProfiles("testdata/profiles/profiles.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mux, serverURL, teardown := setupServer("no-favicon.html", "oembed.json")
+	defer teardown()
+	var header http.Header
+	mux.HandleFunc("/profile", func(w http.ResponseWriter, r *http.Request) {
+		header = r.Header.Clone()
+		tmp.ExecuteTemplate(w, "no-favicon.html", serverURL)
+	})
+
+	u, _ := url.Parse(serverURL + "/profile")
+	_, err = New(u, testClient(true),
+		WithLang("en-US"),
+		WithBotUA("SummalyBot"),
+		WithProfiles(profiles),
+	).ResolveUserAgent().Do()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string]string{
+		"User-Agent":      "ProfileBot/1.0",
+		"Accept-Language": "ja-JP",
+		"X-Summaly-Test":  "profile",
+		"Cookie":          "b=2; consent=yes",
+	}
+	for k, v := range want {
+		if got := header.Get(k); got != v {
+			t.Errorf("%s = %q, want %q", k, got, v)
+		}
+	}
+}
+
+func TestSummaly_Do_ProfileRedirect(t *testing.T) {
+	profiles, err := LoadProfiles("testdata/profiles/profiles.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mux, serverURL, teardown := setupServer("no-favicon.html", "oembed.json")
+	defer teardown()
+	u, _ := url.Parse(serverURL + "/redirect")
+	other := "http://localhost:" + u.Port()
+	mux.HandleFunc("/redirect", func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, other+"/profile", http.StatusFound)
+	})
+	var header http.Header
+	mux.HandleFunc("/profile", func(w http.ResponseWriter, r *http.Request) {
+		header = r.Header.Clone()
+		tmp.ExecuteTemplate(w, "no-favicon.html", other)
+	})
+
+	_, err = New(u, testClient(true), WithProfiles(profiles)).ResolveUserAgent().Do()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if header == nil {
+		t.Fatal("redirect target not requested")
+	}
+	// プロファイルに一致しないホストにはヘッダーを送らない
+	if got := header.Get("X-Summaly-Test"); got != "" {
+		t.Errorf("X-Summaly-Test = %q, want empty", got)
+	}
+}
+
+func TestSummaly_Do_Trace(t *testing.T) {
+	sr := tracetest.NewSpanRecorder()
+	prev := otel.GetTracerProvider()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(sr)))
+	defer otel.SetTracerProvider(prev)
+
+	_, serverURL, teardown := setupServer("oembed.html", "oembed.json")
+	defer teardown()
+
+	u, _ := url.Parse(serverURL)
+	if _, err := New(u, testClient(true)).Do(); err != nil {
+		t.Fatal(err)
+	}
+
+	spans := map[string]sdktrace.ReadOnlySpan{}
+	for _, span := range sr.Ended() {
+		spans[span.Name()] = span
+	}
+	for _, name := range []string{"Summaly.Do", "fetch GET", "oembed", "icon"} {
+		if _, ok := spans[name]; !ok {
+			t.Errorf("span %q not recorded", name)
+		}
+	}
+
+	attrs := func(span sdktrace.ReadOnlySpan) map[attribute.Key]attribute.Value {
+		m := map[attribute.Key]attribute.Value{}
+		for _, kv := range span.Attributes() {
+			m[kv.Key] = kv.Value
+		}
+		return m
+	}
+	if span, ok := spans["Summaly.Do"]; ok {
+		m := attrs(span)
+		if got := m["summaly.media_type"].AsString(); got != "text/html" {
+			t.Errorf("media_type = %q, want %q", got, "text/html")
+		}
+		if got := m["summaly.summarizer"].AsString(); got != "*summaly.General" {
+			t.Errorf("summarizer = %q, want %q", got, "*summaly.General")
+		}
+	}
+	if span, ok := spans["fetch GET"]; ok {
+		if got := attrs(span)["summaly.bytes_read"].AsInt64(); got <= 0 {
+			t.Errorf("bytes_read = %d, want > 0", got)
+		}
+	}
+}
+
+func TestProfileWatcher(t *testing.T) {
+	name := t.TempDir() + "/profiles.json"
+	write := func(ua string, mod time.Time) {
+		b := []byte(`{"profiles": [{"host": "example.com", "userAgent": "` + ua + `"}]}`)
+		if err := os.WriteFile(name, b, 0o644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(name, mod, mod); err != nil {
+			t.Fatal(err)
+		}
+	}
+	ua := func(w *ProfileWatcher) string {
+		return w.Profiles().Match("example.com").UserAgent
+	}
+
+	now := time.Now()
+	write("v1", now)
+	w, err := NewProfileWatcher(name, 10*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	if got := ua(w); got != "v1" {
+		t.Fatalf("UserAgent = %q, want v1", got)
+	}
+
+	// 壊れた内容では前の内容のまま
+	if err := os.WriteFile(name, []byte("{"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	os.Chtimes(name, now.Add(time.Second), now.Add(time.Second))
+	time.Sleep(50 * time.Millisecond)
+	if got := ua(w); got != "v1" {
+		t.Fatalf("UserAgent = %q, want v1", got)
+	}
+
+	write("v2", now.Add(2*time.Second))
+	deadline := time.Now().Add(time.Second)
+	for ua(w) != "v2" && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if got := ua(w); got != "v2" {
+		t.Errorf("UserAgent = %q, want v2", got)
+	}
+}
+
+func TestNormalizeColor(t *testing.T) {
+	tests := []struct {
+		in   string
+		want string
+	}{
+		{in: "#ABC", want: "#aabbcc"},
+		{in: "#abcd", want: "#aabbccdd"},
+		{in: " #4285F4 ", want: "#4285f4"},
+		{in: "#4285f480", want: "#4285f480"},
+		{in: "rgb(255, 0, 0)", want: "#ff0000"},
+		{in: "rgba(0, 0, 255, 0.5)", want: "#0000ff80"},
+		{in: "rgb(0 128 0 / 100%)", want: "#008000"},
+		{in: "White", want: "#ffffff"},
+		{in: "transparent", want: ""},
+		{in: "#12345", want: ""},
+		{in: "hsl(0, 100%, 50%)", want: ""},
+		{in: "", want: ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			if got := NormalizeColor(tt.in); got != tt.want {
+				t.Errorf("NormalizeColor(%q) = %q, want %q", tt.in, got, tt.want)
+			}
+		})
+	}
+}
+
+func BenchmarkParseHTML(b *testing.B) {
+	paths, err := fs.Glob(os.DirFS("testdata/htmls"), "*.html")
+	if err != nil {
+		b.Fatal(err)
+	}
+	docs := map[string][]byte{}
+	for _, path := range paths {
+		docs[path], err = os.ReadFile("testdata/htmls/" + path)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+	// head の後ろに大きな body がある場合
+	large, _ := os.ReadFile("testdata/htmls/basic.html")
+	large = bytes.Replace(large, []byte("</body>"), bytes.Repeat([]byte("<p>Hey hey hey syuilo.</p>\n"), 40000), 1)
+	docs["large-body"] = large
+
+	for name, doc := range docs {
+		b.Run(name+"/full", func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				if _, err := html.Parse(bytes.NewReader(doc)); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+		b.Run(name+"/head", func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				if _, _, err := fetch.ParseHead(bytes.NewReader(doc), 64<<10); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
 func BenchmarkSummaly_Do(b *testing.B) {
 	client := testClient(true)
 
@@ -0,0 +1,174 @@
+package summaly
+
+import (
+	"cmp"
+	"fmt"
+	"image/color"
+	"math"
+	"strconv"
+	"strings"
+
+	"golang.org/x/image/colornames"
+)
+
+// ThemeColor はサイトのテーマカラー
+type ThemeColor struct {
+	Color string `json:"color,omitempty"`
+	Light string `json:"light,omitempty"`
+	Dark  string `json:"dark,omitempty"`
+}
+
+type themeColor struct {
+	Default string
+	Light   string
+	Dark    string
+	Other   string // light/dark 以外の media 指定
+	Tile    string // msapplication-TileColor
+}
+
+// set は media 属性に応じて theme-color を振り分ける
+func (t *themeColor) set(content, media string) {
+	media = strings.ToLower(media)
+	switch {
+	case media == "":
+		if t.Default == "" {
+			t.Default = content
+		}
+	case strings.Contains(media, "prefers-color-scheme") && strings.Contains(media, "dark"):
+		if t.Dark == "" {
+			t.Dark = content
+		}
+	case strings.Contains(media, "prefers-color-scheme") && strings.Contains(media, "light"):
+		if t.Light == "" {
+			t.Light = content
+		}
+	default:
+		if t.Other == "" {
+			t.Other = content
+		}
+	}
+}
+
+// getThemeColor は meta, manifest から *ThemeColor を返す
+func getThemeColor(m *info, manifest *Manifest) *ThemeColor {
+	var manifestColor string
+	if manifest != nil {
+		manifestColor = NormalizeColor(manifest.ThemeColor)
+	}
+
+	light := NormalizeColor(m.ThemeColor.Light)
+	dark := NormalizeColor(m.ThemeColor.Dark)
+	c := cmp.Or(
+		NormalizeColor(m.ThemeColor.Default),
+		manifestColor,
+		NormalizeColor(m.ThemeColor.Tile),
+		light,
+		NormalizeColor(m.ThemeColor.Other),
+		dark,
+	)
+	if c == "" {
+		return nil
+	}
+
+	return &ThemeColor{
+		Color: c,
+		Light: light,
+		Dark:  dark,
+	}
+}
+
+// NormalizeColor は CSS の色指定を #rrggbb(aa) に変換する
+//
+// 解釈できない場合は空文字を返す
+func NormalizeColor(s string) string {
+	s = strings.ToLower(strings.TrimSpace(s))
+	if s == "" {
+		return ""
+	}
+
+	var c color.RGBA
+	var ok bool
+	switch {
+	case strings.HasPrefix(s, "#"):
+		c, ok = parseHexColor(s[1:])
+	case strings.HasPrefix(s, "rgb"):
+		c, ok = parseRGBColor(s)
+	default:
+		c, ok = colornames.Map[s]
+	}
+	if !ok {
+		return ""
+	}
+
+	if c.A == 0xff {
+		return fmt.Sprintf("#%02x%02x%02x", c.R, c.G, c.B)
+	}
+	return fmt.Sprintf("#%02x%02x%02x%02x", c.R, c.G, c.B, c.A)
+}
+
+func parseHexColor(s string) (color.RGBA, bool) {
+	switch len(s) {
+	case 3, 4:
+		// #rgb, #rgba -> #rrggbb, #rrggbbaa
+		var b strings.Builder
+		for _, r := range s {
+			b.WriteRune(r)
+			b.WriteRune(r)
+		}
+		s = b.String()
+	case 6, 8:
+	default:
+		return color.RGBA{}, false
+	}
+	if len(s) == 6 {
+		s += "ff"
+	}
+
+	v, err := strconv.ParseUint(s, 16, 32)
+	if err != nil {
+		return color.RGBA{}, false
+	}
+	return color.RGBA{R: uint8(v >> 24), G: uint8(v >> 16), B: uint8(v >> 8), A: uint8(v)}, true
+}
+
+// parseRGBColor は rgb(), rgba() を解釈する
+//
+// カンマ区切りとスペース区切り(/ alpha)の両方に対応する
+func parseRGBColor(s string) (color.RGBA, bool) {
+	open, end := strings.IndexByte(s, '('), strings.LastIndexByte(s, ')')
+	if open < 0 || end < open {
+		return color.RGBA{}, false
+	}
+	fn := strings.TrimSpace(s[:open])
+	if fn != "rgb" && fn != "rgba" {
+		return color.RGBA{}, false
+	}
+
+	args := strings.FieldsFunc(s[open+1:end], func(r rune) bool {
+		return r == ',' || r == '/' || r == ' '
+	})
+	if len(args) != 3 && len(args) != 4 {
+		return color.RGBA{}, false
+	}
+
+	var ch [4]uint8
+	ch[3] = 0xff
+	for i, a := range args {
+		var v float64
+		var err error
+		if p, ok := strings.CutSuffix(a, "%"); ok {
+			v, err = strconv.ParseFloat(p, 64)
+			v = v / 100 * 255
+		} else if i == 3 {
+			v, err = strconv.ParseFloat(a, 64)
+			v *= 255
+		} else {
+			v, err = strconv.ParseFloat(a, 64)
+		}
+		if err != nil {
+			return color.RGBA{}, false
+		}
+		ch[i] = uint8(math.Round(min(max(v, 0), 255)))
+	}
+	return color.RGBA{R: ch[0], G: ch[1], B: ch[2], A: ch[3]}, true
+}
@@ -0,0 +1,105 @@
+package thumbnail
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+
+	"github.com/buckket/go-blurhash"
+	"golang.org/x/image/draw"
+)
+
+// Placeholder は画像の読み込み中に表示するための情報
+type Placeholder struct {
+	Width    int
+	Height   int
+	Blurhash string
+	Color    string // #rrggbb
+}
+
+// placeholderSize は blurhash, 代表色を計算する前に縮小するサイズ
+const placeholderSize = 32
+
+// NewPlaceholder は data の Placeholder を返す
+func NewPlaceholder(data []byte, maxPixels int) (*Placeholder, error) {
+	cfg, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	if maxPixels > 0 && cfg.Width*cfg.Height > maxPixels {
+		return nil, fmt.Errorf("image too large: %dx%d", cfg.Width, cfg.Height)
+	}
+
+	src, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+
+	b := src.Bounds()
+	w, h := fit(b.Dx(), b.Dy(), placeholderSize, placeholderSize)
+	small := image.NewRGBA(image.Rect(0, 0, w, h))
+	draw.BiLinear.Scale(small, small.Bounds(), src, b, draw.Src, nil)
+
+	// 縦横比に合わせて成分数を決める
+	x, y := 4, 3
+	if h > w {
+		x, y = 3, 4
+	}
+	hash, err := blurhash.Encode(x, y, small)
+	if err != nil {
+		return nil, err
+	}
+
+	c := dominantColor(small)
+	return &Placeholder{
+		Width:    cfg.Width,
+		Height:   cfg.Height,
+		Blurhash: hash,
+		Color:    fmt.Sprintf("#%02x%02x%02x", c.R, c.G, c.B),
+	}, nil
+}
+
+// dominantColor は色を 4bit に量子化して最も多い色の平均を返す
+//
+// 透明なピクセルは数えない
+func dominantColor(img *image.RGBA) color.RGBA {
+	type bucket struct {
+		n       int
+		r, g, b int
+	}
+	buckets := make(map[uint16]*bucket)
+	var best *bucket
+
+	bounds := img.Bounds()
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			c := img.RGBAAt(x, y)
+			if c.A < 0x80 {
+				continue
+			}
+			key := uint16(c.R>>4)<<8 | uint16(c.G>>4)<<4 | uint16(c.B>>4)
+			bk, ok := buckets[key]
+			if !ok {
+				bk = &bucket{}
+				buckets[key] = bk
+			}
+			bk.n++
+			bk.r += int(c.R)
+			bk.g += int(c.G)
+			bk.b += int(c.B)
+			if best == nil || bk.n > best.n {
+				best = bk
+			}
+		}
+	}
+	if best == nil {
+		return color.RGBA{A: 0xff}
+	}
+	return color.RGBA{
+		R: uint8(best.r / best.n),
+		G: uint8(best.g / best.n),
+		B: uint8(best.b / best.n),
+		A: 0xff,
+	}
+}
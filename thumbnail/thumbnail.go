@@ -0,0 +1,149 @@
+package thumbnail
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"os"
+	"path/filepath"
+	"time"
+
+	_ "image/gif"
+
+	"github.com/yulog/go-summaly/internal/diskcache"
+	"golang.org/x/image/draw"
+	_ "golang.org/x/image/webp"
+)
+
+// AllowType はデコードできる画像の Content-Type
+var AllowType = []string{"image/jpeg", "image/png", "image/gif", "image/webp"}
+
+type Options struct {
+	MaxWidth  int
+	MaxHeight int
+	Quality   int // JPEG の品質
+	MaxPixels int // デコードを許可する最大ピクセル数
+}
+
+// Resize は data を MaxWidth x MaxHeight に収まるように縮小し、再エンコードする
+//
+// 透過がなければ JPEG 、あれば PNG にする
+// 拡大はしない
+func Resize(data []byte, opts Options) ([]byte, string, error) {
+	cfg, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, "", err
+	}
+	if opts.MaxPixels > 0 && cfg.Width*cfg.Height > opts.MaxPixels {
+		return nil, "", fmt.Errorf("image too large: %dx%d", cfg.Width, cfg.Height)
+	}
+
+	src, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, "", err
+	}
+
+	b := src.Bounds()
+	w, h := fit(b.Dx(), b.Dy(), opts.MaxWidth, opts.MaxHeight)
+	dst := image.NewRGBA(image.Rect(0, 0, w, h))
+	draw.BiLinear.Scale(dst, dst.Bounds(), src, b, draw.Src, nil)
+
+	var buf bytes.Buffer
+	if dst.Opaque() {
+		err = jpeg.Encode(&buf, dst, &jpeg.Options{Quality: opts.Quality})
+		return buf.Bytes(), "image/jpeg", err
+	}
+	err = png.Encode(&buf, dst)
+	return buf.Bytes(), "image/png", err
+}
+
+// fit は w x h を maxW x maxH に収まるように縦横比を保って縮小したサイズを返す
+func fit(w, h, maxW, maxH int) (int, int) {
+	if maxW <= 0 || maxH <= 0 || (w <= maxW && h <= maxH) {
+		return w, h
+	}
+	if w*maxH > h*maxW {
+		return maxW, max(1, h*maxW/w)
+	}
+	return max(1, w*maxH/h), maxH
+}
+
+// DiskCache は縮小した画像をディスクに保存する
+//
+// Put のたびに (間隔をあけて) MaxAge より長く使われていないものを消し、
+// 合計が MaxSize バイトを超えていれば使われていないものから消す
+type DiskCache struct {
+	Dir     string
+	MaxSize int64         // 0 は無制限
+	MaxAge  time.Duration // 0 は無制限
+
+	sweeper diskcache.Sweeper
+}
+
+var extensions = map[string]string{
+	"image/jpeg": ".jpg",
+	"image/png":  ".png",
+}
+
+func (c *DiskCache) path(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	name := hex.EncodeToString(sum[:])
+	return filepath.Join(c.Dir, name[:2], name)
+}
+
+// Get は key のキャッシュを返す
+func (c *DiskCache) Get(key string) ([]byte, string, bool) {
+	p := c.path(key)
+	for ct, ext := range extensions {
+		fi, err := os.Stat(p + ext)
+		if err != nil || diskcache.Expired(fi.ModTime(), c.MaxAge) {
+			continue
+		}
+		if data, err := os.ReadFile(p + ext); err == nil {
+			diskcache.Touch(p + ext)
+			return data, ct, true
+		}
+	}
+	return nil, "", false
+}
+
+// Sweep は MaxAge, MaxSize を超えたものを消す
+func (c *DiskCache) Sweep() error {
+	return diskcache.Sweep(c.Dir, c.MaxSize, c.MaxAge)
+}
+
+// Put は key のキャッシュを保存する
+func (c *DiskCache) Put(key string, data []byte, contentType string) error {
+	ext, ok := extensions[contentType]
+	if !ok {
+		return fmt.Errorf("unsupported type: %s", contentType)
+	}
+	p := c.path(key)
+	if err := os.MkdirAll(filepath.Dir(p), 0o755); err != nil {
+		return err
+	}
+
+	// 書き込み途中のファイルを読まないように rename する
+	tmp, err := os.CreateTemp(filepath.Dir(p), ".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), p+ext); err != nil {
+		return err
+	}
+	dir, maxSize, maxAge := c.Dir, c.MaxSize, c.MaxAge
+	c.sweeper.Trigger(func() { diskcache.Sweep(dir, maxSize, maxAge) })
+	return nil
+}
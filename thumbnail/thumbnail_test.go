@@ -0,0 +1,154 @@
+package thumbnail
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/png"
+	"os"
+	"testing"
+	"time"
+)
+
+func encodePNG(t *testing.T, w, h int, c color.Color) []byte {
+	t.Helper()
+	img := image.NewNRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			img.Set(x, y, c)
+		}
+	}
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestResize(t *testing.T) {
+	opts := Options{MaxWidth: 100, MaxHeight: 100, Quality: 80, MaxPixels: 1000 * 1000}
+
+	tests := []struct {
+		name     string
+		data     []byte
+		wantType string
+		wantW    int
+		wantH    int
+		wantErr  bool
+	}{
+		{
+			name:     "landscape opaque",
+			data:     encodePNG(t, 400, 200, color.White),
+			wantType: "image/jpeg",
+			wantW:    100,
+			wantH:    50,
+		},
+		{
+			name:     "portrait transparent",
+			data:     encodePNG(t, 100, 300, color.Transparent),
+			wantType: "image/png",
+			wantW:    33,
+			wantH:    100,
+		},
+		{
+			name:     "no upscale",
+			data:     encodePNG(t, 10, 20, color.Black),
+			wantType: "image/jpeg",
+			wantW:    10,
+			wantH:    20,
+		},
+		{
+			name:    "too many pixels",
+			data:    encodePNG(t, 1001, 1000, color.Black),
+			wantErr: true,
+		},
+		{
+			name:    "not an image",
+			data:    []byte("<html></html>"),
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ct, err := Resize(tt.data, opts)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Resize() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if ct != tt.wantType {
+				t.Errorf("Resize() type = %s, want %s", ct, tt.wantType)
+			}
+			cfg, _, err := image.DecodeConfig(bytes.NewReader(got))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if cfg.Width != tt.wantW || cfg.Height != tt.wantH {
+				t.Errorf("Resize() size = %dx%d, want %dx%d", cfg.Width, cfg.Height, tt.wantW, tt.wantH)
+			}
+		})
+	}
+}
+
+func TestDiskCache(t *testing.T) {
+	c := &DiskCache{Dir: t.TempDir()}
+
+	if _, _, ok := c.Get("key"); ok {
+		t.Fatal("Get() on empty cache returned ok")
+	}
+	if err := c.Put("key", []byte("data"), "image/png"); err != nil {
+		t.Fatal(err)
+	}
+	data, ct, ok := c.Get("key")
+	if !ok || string(data) != "data" || ct != "image/png" {
+		t.Errorf("Get() = %q, %q, %v", data, ct, ok)
+	}
+	if err := c.Put("key", []byte("data"), "image/svg+xml"); err == nil {
+		t.Error("Put() with unsupported type returned nil error")
+	}
+}
+
+func TestDiskCache_Sweep(t *testing.T) {
+	// Put で始まる掃除が何も消さないよう、制限は後から設定する
+	c := &DiskCache{Dir: t.TempDir()}
+	ages := map[string]time.Duration{
+		"a": 2 * time.Hour, // MaxAge 切れ
+		"b": 2 * time.Minute,
+		"c": time.Minute,
+	}
+	for key, age := range ages {
+		if err := c.Put(key, []byte("data"), "image/png"); err != nil {
+			t.Fatal(err)
+		}
+		mod := time.Now().Add(-age)
+		os.Chtimes(c.path(key)+".png", mod, mod)
+	}
+	c.MaxAge = time.Hour
+	if _, _, ok := c.Get("a"); ok {
+		t.Error("Get() returned an expired entry")
+	}
+
+	exists := func(key string) bool {
+		_, err := os.Stat(c.path(key) + ".png")
+		return err == nil
+	}
+	tests := []struct {
+		maxSize int64
+		want    map[string]bool
+	}{
+		{8, map[string]bool{"a": false, "b": true, "c": true}},
+		{4, map[string]bool{"b": false, "c": true}},
+	}
+	for _, tt := range tests {
+		c.MaxSize = tt.maxSize
+		if err := c.Sweep(); err != nil {
+			t.Fatal(err)
+		}
+		for key, want := range tt.want {
+			if got := exists(key); got != want {
+				t.Errorf("MaxSize %d: %s exists = %v, want %v", tt.maxSize, key, got, want)
+			}
+		}
+	}
+}
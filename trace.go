@@ -0,0 +1,24 @@
+package summaly
+
+import (
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+var tracer = otel.Tracer("github.com/yulog/go-summaly")
+
+const (
+	mediaTypeKey  = attribute.Key("summaly.media_type")
+	summarizerKey = attribute.Key("summaly.summarizer")
+)
+
+// recordError は err があれば span に記録する
+func recordError(span trace.Span, err error) {
+	if err == nil {
+		return
+	}
+	span.RecordError(err)
+	span.SetStatus(codes.Error, err.Error())
+}